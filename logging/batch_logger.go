@@ -1,83 +1,660 @@
 package logging
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrorLogEntriesDropped is returned by a batchLogger's Close method if any of the log entries it was given may not have been passed to its
+// batch callback, or if the context given to Close was done before the callback had finished handling all of the batches passed to it
+type ErrorLogEntriesDropped struct {
+	Dropped int64 // The number of log entries which were dropped due to the overflow policy, because they couldn't be marshalled or were too big, because the logger was closed, or because they were pruned from the Spool
+	Failed  int64 // The number of log entries in batches for which every attempt made by the batch callback returned an error
+	Unsent  int64 // The number of log entries in batches which the batch callback was still handling when the context was done
+	Err     error // The context's error, if it was done before all of the batches were handled
+}
+
+func (e ErrorLogEntriesDropped) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d log entries dropped, %d log entries failed, %d log entries unsent: %s", e.Dropped, e.Failed, e.Unsent, e.Err.Error())
+	}
+	return fmt.Sprintf("%d log entries dropped, %d log entries failed", e.Dropped, e.Failed)
+}
+
+func (e ErrorLogEntriesDropped) Unwrap() error {
+	return e.Err
+}
+
+// BatchMetadata describes a batch of log entries being passed to a BatchCallback
+type BatchMetadata struct {
+	EntryCount           int       // The number of log entries in the batch
+	ByteSize             int       // The total size of the marshalled log entries in the batch, in bytes
+	OldestEntryCreatedAt time.Time // The time at which the oldest log entry in the batch was created
+	Attempt              int       // The number of times the batch has been passed to the callback, including this time, starting at 1
+}
+
+// A BatchCallback is given batches of log entries as a slice of slices of bytes, each of which is a marshalled LogEntry. If it returns
+// an error, the batch is passed to it again after an exponential backoff, up to the batchLogger's MaxBatchAttempts. The callback can
+// return an ErrorBatchNotRetryable to stop the batch from being retried, or an ErrorBatchRetryAfter to choose how long to wait
+type BatchCallback func(batch [][]byte, metadata BatchMetadata) error
+
 // A batchLogger receives log entries via its Enqueue method & arranges them into batches that it then passes to its batchHandler
 type batchLogger struct {
-	queue         chan *LogEntry // A channel down which LogEntrys will be queued to be sent to Firetail
-	maxBatchSize  int            // The maximum size of a batch in bytes
-	maxLogAge     time.Duration  // The maximum age of a log item to hold onto
-	batchCallback func([][]byte) // A handler that takes a batch of log entries as a slice of slices of bytes & sends them to Firetail
+	droppedEntries  int64 // The number of log entries dropped because they couldn't be marshalled or were too big; must be accessed atomically & kept 64-bit aligned
+	batches         int64 // The number of batches the log entries have been arranged into; must be accessed atomically
+	batchedEntries  int64 // The number of log entries arranged into batches; must be accessed atomically
+	inFlightEntries int64 // The number of log entries in batches currently being handled by the callback; must be accessed atomically
+	sentBatches     int64 // The number of batches for which the callback returned nil; must be accessed atomically
+	sentEntries     int64 // The number of log entries in batches for which the callback returned nil; must be accessed atomically
+	failedBatches   int64 // The number of batches for which every attempt made by the callback returned an error; must be accessed atomically
+	failedEntries   int64 // The number of log entries in batches for which every attempt made by the callback returned an error; must be accessed atomically
+	replayedBatches int64 // The number of batches from the spool for which the callback returned nil; must be accessed atomically
+	replayedEntries int64 // The number of log entries in batches from the spool for which the callback returned nil; must be accessed atomically
+
+	queue            *ringBuffer              // A bounded queue in which LogEntrys wait to be batched & sent to Firetail
+	maxBatchSize     int                      // The maximum size of a batch in bytes
+	compressedSize   *compressedSizeEstimator // If maxBatchSize applies to the compressed size of batches, estimates the compressed size of the current batch
+	maxBatchCount    int                      // The maximum number of log entries in a batch, or zero if there is no limit
+	maxLogAge        time.Duration            // The maximum age of a log item to hold onto
+	batchCallback    BatchCallback            // A handler that takes a batch of log entries as a slice of slices of bytes & sends them to Firetail
+	sink             Sink                     // The Sink the batchCallback writes to, unless a custom BatchCallback was provided
+	maxBatchAttempts int                      // The maximum number of times a batch is passed to the batchCallback if it returns an error
+	backoff          *backoff                 // Calculates how long to wait before passing a batch to the batchCallback again
+	circuitBreaker   *circuitBreaker          // Stops batches being passed to the batchCallback whilst it's consistently failing
+	flushRequests    chan chan struct{}       // A channel down which Flush asks the worker to pass on its current batch; the worker closes the given channel once it has
+	stop             chan struct{}            // Closed by Close to tell the worker to pass on its current batch & return
+	stopped          chan struct{}            // Closed by the worker once it has returned
+	abandon          chan struct{}            // Closed if the context given to Close is done, to tell batches waiting to be retried to give up
+	cancelWrites     context.CancelFunc       // Cancels the context passed to the Sink's Write method, if the context given to Close is done
+	spool            *Spool                   // An optional spool in which batches are kept if they can't be sent, to be replayed later
+	spoolAllBatches  bool                     // Whether every batch is written to the spool & only sent by the replayer
+	replayWake       chan struct{}            // Has a value sent to it (without blocking) whenever a batch is sent, so the replayer can retry straight away
+	drainRequests    chan chan struct{}       // A channel down which the replayer is asked to close the given channel once the spool is empty
+	replayStop       chan struct{}            // Closed by Close to tell the replayer to return
+	replayStopped    chan struct{}            // Closed by the replayer once it has returned
+	writesStopped    chan struct{}            // Closed once the worker & replayer have returned & every batch they passed to the Sink has been handled
+	closeOnce        sync.Once
+	abandonOnce      sync.Once
+	stopReplayOnce   sync.Once
+	waitWritesOnce   sync.Once
+	closeSpoolOnce   sync.Once
+	inFlight         sync.WaitGroup // Tracks the batches currently being handled by the callback
 }
 
 // BatchLoggerOptions is an options struct used by the NewBatchLogger constructor
 type BatchLoggerOptions struct {
-	MaxBatchSize  int            // The maximum size of a batch in bytes
-	MaxLogAge     time.Duration  // The maximum age of a log item in a batch - once an item is older than this, the batch is passed to the callback
-	LogApiKey     string         // The API key used by the default BatchCallback used to send logs to the Firetail logging API
-	LogApiUrl     string         // The URL of the Firetail logging API endpoint to send log entries to
-	BatchCallback func([][]byte) // An optional callback to which batches will be passed; the default callback sends logs to the Firetail logging API
+	MaxBatchSize             int            // The maximum size of a batch in bytes; by default this applies to the total size of the marshalled log entries, before compression
+	MaxBatchCount            int            // The maximum number of log entries in a batch; if zero, batches are only limited by MaxBatchSize
+	MaxLogAge                time.Duration  // The maximum age of a log item in a batch - once an item is older than this, the batch is passed to the callback
+	QueueCapacity            int            // The maximum number of log entries waiting to be batched before the OverflowPolicy is applied; defaults to 1024
+	OverflowPolicy           OverflowPolicy // What to do when a log entry is enqueued and the queue is full; defaults to DropOldestOnOverflow
+	LogApiKey                string         // The API key used by the default BatchCallback used to send logs to the Firetail logging API
+	LogApiUrl                string         // The URL of the Firetail logging API endpoint to send log entries to
+	Compression              Compression    // The Content-Encoding the default BatchCallback uses to compress batches sent to the Firetail logging API; defaults to NoCompression
+	MaxBatchSizeIsCompressed bool           // If true & Compression is set, MaxBatchSize applies to the estimated size of each batch once compressed, so more log entries fit in each batch
+	BatchCallback            BatchCallback  // An optional callback to which batches will be passed; the default callback sends logs to the Firetail logging API
+	Sink                     Sink           // An optional Sink to which batches will be written if BatchCallback is nil; it's closed when the batchLogger is closed
+	MaxBatchAttempts         int            // The maximum number of times a batch is passed to the BatchCallback if it returns an error; defaults to 3
+
+	RetryBackoff            time.Duration // How long to wait before the first retry of a batch, doubling with each attempt after that; defaults to 500ms
+	MaxRetryBackoff         time.Duration // The maximum time to wait between attempts, not including any Retry-After given by the Firetail logging API; defaults to 30s
+	MaxRetryAfter           time.Duration // The maximum time to stop passing batches to the BatchCallback for when it returns an ErrorBatchRetryAfter, e.g. for a Retry-After header; defaults to 60s
+	CircuitBreakerThreshold int           // The number of attempts in a row that must fail before no more batches are passed to the BatchCallback until the cooldown has elapsed; defaults to 5
+	CircuitBreakerCooldown  time.Duration // How long to wait before passing another batch to the BatchCallback once the circuit breaker has tripped; defaults to 30s
+
+	Spool           *Spool // An optional Spool in which batches are kept if every attempt to send them fails, to be replayed in order once the BatchCallback succeeds again; it's closed when the batchLogger is closed
+	SpoolAllBatches bool   // If true, every batch is written to the Spool before it's passed to the BatchCallback, rather than only those which fail
+
+	HTTPClient      *http.Client      // An optional client used by the default BatchCallback to send requests to the Firetail logging API; if set, Transport & TLSClientConfig are ignored
+	Transport       http.RoundTripper // An optional RoundTripper used by the default BatchCallback if HTTPClient is nil, e.g. to route requests through a proxy; if set, TLSClientConfig is ignored
+	TLSClientConfig *tls.Config       // An optional TLS config used by the default BatchCallback's transport, e.g. to trust a private CA or present client certificates for mTLS
+	RequestTimeout  time.Duration     // The maximum time the default BatchCallback waits for each request to the Firetail logging API; defaults to 30s
+	ExtraHeaders    http.Header       // Additional headers sent with every request the default BatchCallback makes to the Firetail logging API
+}
+
+// BatchLoggerStats holds counters describing what a batchLogger has done with the log entries it's been given
+type BatchLoggerStats struct {
+	QueueLength     int   // The number of log entries currently waiting in the queue to be batched
+	Enqueued        int64 // The number of log entries accepted into the queue
+	DroppedOverflow int64 // The number of log entries dropped by the OverflowPolicy because the queue was full
+	DroppedClosed   int64 // The number of log entries dropped because they were enqueued after the batchLogger was closed
+	DroppedInvalid  int64 // The number of log entries dropped because they couldn't be marshalled or were bigger than the MaxBatchSize
+	Batches         int64 // The number of batches the log entries accepted into the queue have been arranged into
+	BatchedEntries  int64 // The number of log entries accepted into the queue that have been arranged into batches
+	InFlight        int64 // The number of log entries in batches currently being handled by the BatchCallback
+	SentBatches     int64 // The number of batches for which the BatchCallback returned nil
+	SentEntries     int64 // The number of log entries in batches for which the BatchCallback returned nil
+	FailedBatches   int64 // The number of batches for which every attempt made by the BatchCallback returned an error
+	FailedEntries   int64 // The number of log entries in batches for which every attempt made by the BatchCallback returned an error
+	SpoolLength     int64 // The number of log entries currently waiting in the Spool to be replayed
+	SpooledBatches  int64 // The number of batches written to the Spool
+	SpooledEntries  int64 // The number of log entries in batches written to the Spool
+	ReplayedBatches int64 // The number of batches from the Spool for which the BatchCallback returned nil
+	ReplayedEntries int64 // The number of log entries in batches from the Spool for which the BatchCallback returned nil
+	DroppedSpool    int64 // The number of log entries pruned from the Spool because of its MaxBytes or MaxAge
 }
 
 // NewBatchLogger creates a new batchLogger with the provided options
 func NewBatchLogger(options BatchLoggerOptions) *batchLogger {
+	if options.QueueCapacity <= 0 {
+		options.QueueCapacity = 1024
+	}
+	if options.MaxBatchAttempts <= 0 {
+		options.MaxBatchAttempts = 3
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = 500 * time.Millisecond
+	}
+	if options.MaxRetryBackoff <= 0 {
+		options.MaxRetryBackoff = 30 * time.Second
+	}
+	if options.MaxRetryAfter <= 0 {
+		options.MaxRetryAfter = 60 * time.Second
+	}
+	if options.CircuitBreakerThreshold <= 0 {
+		options.CircuitBreakerThreshold = 5
+	}
+	if options.CircuitBreakerCooldown <= 0 {
+		options.CircuitBreakerCooldown = 30 * time.Second
+	}
+
 	newLogger := &batchLogger{
-		queue:        make(chan *LogEntry),
-		maxBatchSize: options.MaxBatchSize,
-		maxLogAge:    options.MaxLogAge,
+		queue:            newRingBuffer(options.QueueCapacity, options.OverflowPolicy),
+		maxBatchSize:     options.MaxBatchSize,
+		maxBatchCount:    options.MaxBatchCount,
+		maxBatchAttempts: options.MaxBatchAttempts,
+		maxLogAge:        options.MaxLogAge,
+		backoff:          newBackoff(options.RetryBackoff, options.MaxRetryBackoff),
+		circuitBreaker:   newCircuitBreaker(options.CircuitBreakerThreshold, options.CircuitBreakerCooldown, options.MaxRetryAfter),
+		flushRequests:    make(chan chan struct{}),
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		abandon:          make(chan struct{}),
+		spool:            options.Spool,
+		spoolAllBatches:  options.Spool != nil && options.SpoolAllBatches,
+		replayWake:       make(chan struct{}, 1),
+		drainRequests:    make(chan chan struct{}),
+		replayStop:       make(chan struct{}),
+		replayStopped:    make(chan struct{}),
+		writesStopped:    make(chan struct{}),
 	}
 
-	if options.BatchCallback == nil {
-		newLogger.batchCallback = getDefaultBatchCallback(options)
+	if options.MaxBatchSizeIsCompressed && options.Compression != NoCompression {
+		newLogger.compressedSize = newCompressedSizeEstimator(options.Compression)
+	}
+
+	switch {
+	case options.BatchCallback != nil:
+		newLogger.batchCallback = options.BatchCallback
+	case options.Sink != nil:
+		newLogger.sink = options.Sink
+	default:
+		newLogger.sink = getDefaultSink(options)
+	}
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	newLogger.cancelWrites = cancelWrites
+	if newLogger.sink != nil {
+		newLogger.batchCallback = getSinkBatchCallback(writeCtx, newLogger.sink)
 	}
 
 	go newLogger.worker()
+	if newLogger.spool != nil {
+		go newLogger.replayer()
+	} else {
+		close(newLogger.replayStopped)
+	}
 
 	return newLogger
 }
 
-// Enqueue enqueues a logentry to be batched & sent to Firetail. Should normally be run in a new goroutine as it blocks until another routine receives from l.queue.
+// Enqueue enqueues a logentry to be batched & sent to Firetail. Enqueue only blocks if the queue is full and the OverflowPolicy is
+// BlockOnOverflow. If the batchLogger has been closed, the log entry is dropped.
 func (l *batchLogger) Enqueue(logEntry *LogEntry) {
-	l.queue <- logEntry
+	l.queue.push(logEntry)
+}
+
+// Stats returns the batchLogger's current counters
+func (l *batchLogger) Stats() BatchLoggerStats {
+	queueStats := l.queue.getStats()
+	stats := BatchLoggerStats{
+		QueueLength:     l.queue.len(),
+		Enqueued:        queueStats.enqueued,
+		DroppedOverflow: queueStats.droppedOverflow,
+		DroppedClosed:   queueStats.droppedClosed,
+		DroppedInvalid:  atomic.LoadInt64(&l.droppedEntries),
+		Batches:         atomic.LoadInt64(&l.batches),
+		BatchedEntries:  atomic.LoadInt64(&l.batchedEntries),
+		InFlight:        atomic.LoadInt64(&l.inFlightEntries),
+		SentBatches:     atomic.LoadInt64(&l.sentBatches),
+		SentEntries:     atomic.LoadInt64(&l.sentEntries),
+		FailedBatches:   atomic.LoadInt64(&l.failedBatches),
+		FailedEntries:   atomic.LoadInt64(&l.failedEntries),
+		ReplayedBatches: atomic.LoadInt64(&l.replayedBatches),
+		ReplayedEntries: atomic.LoadInt64(&l.replayedEntries),
+	}
+	if l.spool != nil {
+		spoolStats := l.spool.getStats()
+		stats.SpoolLength = l.spool.len()
+		stats.SpooledBatches = spoolStats.spooledBatches
+		stats.SpooledEntries = spoolStats.spooledEntries
+		stats.DroppedSpool = spoolStats.prunedEntries
+	}
+	return stats
+}
+
+// Flush passes the batch currently being assembled to the batch callback, then waits until the callback has finished handling every batch
+// passed to it so far. If SpoolAllBatches is set, Flush also waits until the spool is empty. If ctx is done first, ctx.Err() is returned.
+func (l *batchLogger) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case l.flushRequests <- flushed:
+		<-flushed
+	case <-l.stopped:
+		// If the worker has stopped, it will have already passed on its last batch
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := l.waitForInFlight(ctx); err != nil {
+		return err
+	}
+	if l.spoolAllBatches {
+		return l.waitForSpool(ctx)
+	}
+	return nil
+}
+
+// Close stops the batchLogger from accepting any more log entries, passes the batch currently being assembled to the batch callback, then
+// waits until the callback has finished handling every batch passed to it. If any log entries were dropped, or ctx is done before the
+// callback has finished, an ErrorLogEntriesDropped is returned & any batches waiting to be retried are abandoned. If the batchLogger has a
+// spool, batches which couldn't be sent are left in it to be replayed when it's next opened, & if SpoolAllBatches is set Close first waits
+// for the spool to be replayed until ctx is done. Finally, the batchLogger's Sink is closed, & if nothing was dropped any error it returns is
+// returned. If ctx is done first, the Sink's in-flight writes are cancelled, but the Sink & the spool are only closed once every write has
+// returned, so they never race with it. If a write doesn't return before ctx is done, they're left open & Close can be called again to
+// close them. Close may be called more than once.
+func (l *batchLogger) Close(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.queue.close()
+		close(l.stop)
+	})
+
+	var err error
+	select {
+	case <-l.stopped:
+		err = l.waitForInFlight(ctx)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil && l.spoolAllBatches {
+		err = l.waitForSpool(ctx)
+	}
+	l.stopReplayOnce.Do(func() { close(l.replayStop) })
+	if err == nil && l.sink != nil {
+		err = l.waitForWrites(ctx)
+	}
+	if err != nil {
+		l.abandonOnce.Do(func() {
+			close(l.abandon)
+			l.cancelWrites()
+		})
+	}
+
+	// The Sink & the spool are only closed once every write to the Sink has returned, so if one is still running they're left open for a
+	// later call to Close. A custom BatchCallback isn't waited for, as it may never return; it has no Sink to race with, & the spool can
+	// be closed safely underneath it
+	if l.sink != nil && l.waitForWrites(ctx) != nil {
+		return l.closeErr(err, nil)
+	}
+	var sinkErr error
+	l.closeSpoolOnce.Do(func() {
+		defer l.cancelWrites()
+		if l.spool != nil {
+			// The replayer may be part way through passing a batch to the callback, in which case it'll be replayed again next time
+			l.spool.close()
+		}
+		if l.sink != nil {
+			sinkErr = l.sink.Close(ctx)
+		}
+	})
+	return l.closeErr(err, sinkErr)
+}
+
+// closeErr returns the err Close should return given the err it encountered waiting for the batchLogger's batches to be handled, if any,
+// & the err returned by its Sink's Close method, if it was closed
+func (l *batchLogger) closeErr(err, sinkErr error) error {
+	stats := l.Stats()
+	dropped := stats.DroppedOverflow + stats.DroppedClosed + stats.DroppedInvalid + stats.DroppedSpool
+	if err != nil {
+		return ErrorLogEntriesDropped{
+			Dropped: dropped,
+			Failed:  stats.FailedEntries,
+			Unsent:  stats.InFlight,
+			Err:     err,
+		}
+	}
+	if dropped > 0 || stats.FailedEntries > 0 {
+		return ErrorLogEntriesDropped{Dropped: dropped, Failed: stats.FailedEntries}
+	}
+	return sinkErr
+}
+
+// waitForWrites waits until the worker & replayer have returned & every batch they passed to the Sink has been handled, or ctx is done
+func (l *batchLogger) waitForWrites(ctx context.Context) error {
+	l.waitWritesOnce.Do(func() {
+		go func() {
+			<-l.stopped
+			l.inFlight.Wait()
+			<-l.replayStopped
+			close(l.writesStopped)
+		}()
+	})
+	select {
+	case <-l.writesStopped:
+		return nil
+	case <-ctx.Done():
+		// The writes may have stopped at the same time
+		select {
+		case <-l.writesStopped:
+			return nil
+		default:
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForInFlight waits until the batch callback has finished handling every batch passed to it so far, or ctx is done
+func (l *batchLogger) waitForInFlight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForSpool waits until the replayer has found the spool to be empty, or ctx is done
+func (l *batchLogger) waitForSpool(ctx context.Context) error {
+	drained := make(chan struct{})
+	select {
+	case l.drainRequests <- drained:
+	case <-l.replayStopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendBatch passes a batch to the batch callback in a new goroutine, keeping track of it until the callback returns. If the callback returns
+// an error, the batch is passed to it again after a backoff until it succeeds, returns an ErrorBatchNotRetryable, or maxBatchAttempts is
+// reached. Whilst the circuit breaker is tripped, the batch waits before each attempt
+func (l *batchLogger) sendBatch(batch [][]byte, batchSize int, oldestEntryCreatedAt time.Time) {
+	if len(batch) == 0 {
+		return
+	}
+	atomic.AddInt64(&l.batches, 1)
+	atomic.AddInt64(&l.batchedEntries, int64(len(batch)))
+	// If every batch is spooled, the replayer takes care of passing them to the callback; if the batch can't be spooled, we send it now
+	if l.spoolAllBatches && l.spool.append(batch, oldestEntryCreatedAt) == nil {
+		return
+	}
+	l.inFlight.Add(1)
+	atomic.AddInt64(&l.inFlightEntries, int64(len(batch)))
+	go func() {
+		defer l.inFlight.Done()
+		defer atomic.AddInt64(&l.inFlightEntries, -int64(len(batch)))
+
+		metadata := BatchMetadata{
+			EntryCount:           len(batch),
+			ByteSize:             batchSize,
+			OldestEntryCreatedAt: oldestEntryCreatedAt,
+		}
+		for metadata.Attempt = 1; metadata.Attempt <= l.maxBatchAttempts; metadata.Attempt++ {
+			if !l.circuitBreaker.allow(l.abandon) {
+				break
+			}
+
+			err := l.batchCallback(batch, metadata)
+			if err == nil {
+				l.circuitBreaker.recordSuccess()
+				atomic.AddInt64(&l.sentBatches, 1)
+				atomic.AddInt64(&l.sentEntries, int64(len(batch)))
+				l.wakeReplayer()
+				return
+			}
+
+			// If the batch isn't retryable, the callback is still working, so it shouldn't count towards tripping the circuit breaker, and
+			// there's no point spooling it
+			var notRetryable ErrorBatchNotRetryable
+			if errors.As(err, &notRetryable) {
+				l.circuitBreaker.recordSuccess()
+				atomic.AddInt64(&l.failedBatches, 1)
+				atomic.AddInt64(&l.failedEntries, int64(len(batch)))
+				return
+			}
+
+			// If the callback was told when to retry, no batches should be passed to it until then
+			var retryAfter ErrorBatchRetryAfter
+			if errors.As(err, &retryAfter) {
+				l.circuitBreaker.openFor(retryAfter.RetryAfter)
+			} else {
+				l.circuitBreaker.recordFailure()
+				if metadata.Attempt < l.maxBatchAttempts && !sleep(l.backoff.delay(metadata.Attempt), l.abandon) {
+					break
+				}
+			}
+		}
+		if l.spool != nil && l.spool.append(batch, oldestEntryCreatedAt) == nil {
+			return
+		}
+		atomic.AddInt64(&l.failedBatches, 1)
+		atomic.AddInt64(&l.failedEntries, int64(len(batch)))
+	}()
+}
+
+// wakeReplayer lets the replayer know a batch has just been sent, so it's worth trying to replay the spool again without waiting for its backoff
+func (l *batchLogger) wakeReplayer() {
+	select {
+	case l.replayWake <- struct{}{}:
+	default:
+	}
 }
 
-// worker receives log entries via the batchLogger's queue and arranges them into batches of up to the batchLogger's maxBatchSize, and passes them to the logger's
-// batchHandler when either (1) it receives a new log entry that would make the batch oversized, or (2) the oldest log entry in the current batch is older than
-// the batchLogger's maxLogAge
+// replayer passes the batches in the spool to the batch callback, oldest first, until replayStop is closed. Each batch is removed from the spool
+// once the callback returns nil or an ErrorBatchNotRetryable; if it returns any other error the replayer backs off & tries the same batch again,
+// so that batches are always replayed in order. Whenever the spool is empty, the replayer closes any channels it's been given by waitForSpool
+func (l *batchLogger) replayer() {
+	defer close(l.replayStopped)
+
+	drainWaiters := []chan struct{}{}
+	attempt := 0
+	for {
+		select {
+		case <-l.replayStop:
+			return
+		default:
+		}
+
+		spooledBatch, ok := l.spool.peek()
+		if !ok {
+			for _, drained := range drainWaiters {
+				close(drained)
+			}
+			drainWaiters = drainWaiters[:0]
+
+			select {
+			case <-l.spool.ready:
+			case drained := <-l.drainRequests:
+				drainWaiters = append(drainWaiters, drained)
+			case <-l.replayStop:
+				return
+			}
+			continue
+		}
+
+		if !l.circuitBreaker.allow(l.replayStop) {
+			return
+		}
+		attempt++
+		err := l.batchCallback(spooledBatch.batch, BatchMetadata{
+			EntryCount:           len(spooledBatch.batch),
+			ByteSize:             spooledBatch.batchSize,
+			OldestEntryCreatedAt: spooledBatch.oldestEntryCreatedAt,
+			Attempt:              attempt,
+		})
+
+		var notRetryable ErrorBatchNotRetryable
+		var retryAfter ErrorBatchRetryAfter
+		switch {
+		case err == nil:
+			l.circuitBreaker.recordSuccess()
+			l.spool.ack(spooledBatch)
+			atomic.AddInt64(&l.replayedBatches, 1)
+			atomic.AddInt64(&l.replayedEntries, int64(len(spooledBatch.batch)))
+			attempt = 0
+			continue
+
+		case errors.As(err, &notRetryable):
+			l.circuitBreaker.recordSuccess()
+			l.spool.ack(spooledBatch)
+			atomic.AddInt64(&l.failedBatches, 1)
+			atomic.AddInt64(&l.failedEntries, int64(len(spooledBatch.batch)))
+			attempt = 0
+			continue
+
+		case errors.As(err, &retryAfter):
+			// The circuit breaker will make us wait before the next attempt
+			l.circuitBreaker.openFor(retryAfter.RetryAfter)
+			continue
+		}
+
+		l.circuitBreaker.recordFailure()
+		backoffTimer := time.NewTimer(l.backoff.delay(attempt))
+		waiting := true
+		for waiting {
+			select {
+			case <-backoffTimer.C:
+				waiting = false
+			case <-l.replayWake:
+				waiting = false
+			case drained := <-l.drainRequests:
+				drainWaiters = append(drainWaiters, drained)
+			case <-l.replayStop:
+				backoffTimer.Stop()
+				return
+			}
+		}
+		backoffTimer.Stop()
+	}
+}
+
+// worker takes log entries from the batchLogger's queue and arranges them into batches of up to the batchLogger's maxBatchSize and maxBatchCount, and passes
+// them to the logger's batchHandler when either (1) the next log entry would make the batch oversized, (2) the batch has maxBatchCount entries in it, (3) the
+// oldest log entry in the current batch is older than the batchLogger's maxLogAge, or (4) the batchLogger is flushed or closed. The worker blocks until one
+// of these things might have happened, so it uses no CPU whilst idle
 func (l *batchLogger) worker() {
 	currentBatch := [][]byte{}
 	currentBatchSize := 0
-	var overflowEntry *LogEntry
-	var overflowEntryBytes *[]byte
 	var oldestEntryCreatedAt *time.Time
 
+	// maxLogAgeTimer fires when the oldest entry in the current batch reaches maxLogAge. Whilst the batch is empty, it's stopped
+	maxLogAgeTimer := time.NewTimer(l.maxLogAge)
+	maxLogAgeTimer.Stop()
+	resetMaxLogAgeTimer := func() {
+		if !maxLogAgeTimer.Stop() {
+			select {
+			case <-maxLogAgeTimer.C:
+			default:
+			}
+		}
+		if oldestEntryCreatedAt != nil {
+			maxLogAgeTimer.Reset(time.Until(oldestEntryCreatedAt.Add(l.maxLogAge)))
+		}
+	}
+
+	sendCurrentBatch := func() {
+		// Pass the batch to the batchHandler! :)
+		if oldestEntryCreatedAt != nil {
+			l.sendBatch(currentBatch, currentBatchSize, *oldestEntryCreatedAt)
+		}
+
+		// Clear out the current batch & set oldestEntryCreatedAt to nil
+		currentBatch = [][]byte{}
+		currentBatchSize = 0
+		oldestEntryCreatedAt = nil
+		if l.compressedSize != nil {
+			l.compressedSize.reset()
+		}
+	}
+
 	for {
-		batchIsReady := false
+		var flushed chan struct{}
+		stopping := false
 
-		// Read a new entry from the queue if there's one available
+		// Block until there's something to do
 		select {
-		case newEntry := <-l.queue:
+		case <-l.queue.ready:
+			// There are new entries in the queue to add to the batch
+		case <-maxLogAgeTimer.C:
+			// The oldest entry in the batch has reached maxLogAge, which we'll check below
+		case flushed = <-l.flushRequests:
+			// We've been asked to flush, so the batch is ready to send regardless of its age
+		case <-l.stop:
+			// We've been asked to stop, so we need to pass on everything left in the queue & return
+			stopping = true
+		}
+
+		// Take every entry waiting in the queue & add it to the batch
+		for {
+			newEntry, ok := l.queue.pop()
+			if !ok {
+				break
+			}
+
 			// Marshal the entry to bytes...
 			entryBytes, err := json.Marshal(newEntry)
 			if err != nil {
-				// TODO: log that we're skipping this entry?
+				atomic.AddInt64(&l.droppedEntries, 1)
 				continue
 			}
 
-			if len(entryBytes) > l.maxBatchSize {
-				// TODO: log that we're skipping this entry?
-				continue
-			}
+			if l.compressedSize != nil {
+				// If adding it makes the batch too big once compressed, the current batch is ready to send without it
+				if l.compressedSize.add(entryBytes) > l.maxBatchSize && len(currentBatch) > 0 {
+					sendCurrentBatch()
+					l.compressedSize.add(entryBytes)
+				}
+				if l.compressedSize.estimate() > l.maxBatchSize {
+					atomic.AddInt64(&l.droppedEntries, 1)
+					l.compressedSize.reset()
+					continue
+				}
+			} else {
+				if len(entryBytes) > l.maxBatchSize {
+					atomic.AddInt64(&l.droppedEntries, 1)
+					continue
+				}
 
-			// If it's too big to add to the batch, place it in the overflow, flag the batch is ready to send & break from this case
-			if len(entryBytes)+currentBatchSize > l.maxBatchSize {
-				overflowEntry = newEntry
-				overflowEntryBytes = &entryBytes
-				batchIsReady = true
-				break
+				// If it's too big to add to the batch, the current batch is ready to send
+				if len(entryBytes)+currentBatchSize > l.maxBatchSize {
+					sendCurrentBatch()
+				}
 			}
 
 			// Append it to the batch & increment the currentBatchSize appropriately
@@ -89,39 +666,29 @@ func (l *batchLogger) worker() {
 				createdAt := time.UnixMilli(newEntry.DateCreated)
 				oldestEntryCreatedAt = &createdAt
 			}
-		default:
-			// If there's no new entry available, just break
-			break
-		}
 
-		// If the oldest entry in the currentBatch was logged long enough ago, then the currentBatch is ready to send
-		if oldestEntryCreatedAt != nil && time.Since(*oldestEntryCreatedAt) > l.maxLogAge {
-			batchIsReady = true
+			// If the batch is now full, it's ready to send
+			if l.maxBatchCount > 0 && len(currentBatch) >= l.maxBatchCount {
+				sendCurrentBatch()
+			}
 		}
 
-		if batchIsReady {
-			// Pass the batch to the batchHandler! :)
-			go l.batchCallback(currentBatch)
-
-			// Clear out the current batch & set oldestEntryCreatedAt to nil
-			currentBatch = [][]byte{}
-			currentBatchSize = 0
-			oldestEntryCreatedAt = nil
-
-			// If there's an overflow entry, add it to the batch immediately
-			if overflowEntry != nil {
-				createdAt := time.UnixMilli(overflowEntry.DateCreated)
-				oldestEntryCreatedAt = &createdAt
+		// If the oldest entry in the currentBatch was logged long enough ago, or we're flushing or stopping, then the currentBatch is ready to send
+		if flushed != nil || stopping || (oldestEntryCreatedAt != nil && time.Since(*oldestEntryCreatedAt) >= l.maxLogAge) {
+			sendCurrentBatch()
+		}
 
-				currentBatch = append(currentBatch, *overflowEntryBytes)
-				currentBatchSize += len(*overflowEntryBytes)
+		// If we were asked to flush, let Flush know the batch has been passed on
+		if flushed != nil {
+			close(flushed)
+		}
 
-				overflowEntry = nil
-				overflowEntryBytes = nil
-			}
+		if stopping {
+			maxLogAgeTimer.Stop()
+			close(l.stopped)
+			return
 		}
 
-		// Give the CPU some time to do other things :)
-		time.Sleep(1)
+		resetMaxLogAgeTimer()
 	}
 }
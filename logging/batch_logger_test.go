@@ -1,9 +1,13 @@
 package logging
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"math/rand"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,13 +19,13 @@ func SetupLogger(batchChannel chan *[][]byte, maxBatchSize int, maxLogAge time.D
 	batchLogger := NewBatchLogger(BatchLoggerOptions{
 		MaxBatchSize: maxBatchSize,
 		MaxLogAge:    maxLogAge,
+		// Use a custom batchHandler to throw the batches into a queue that we can receive from for testing
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			batchChannel <- &b
+			return nil
+		},
 	})
 
-	// Replace the batchHandler with a custom one to throw the batches into a queue that we can receive from for testing
-	batchLogger.batchCallback = func(b [][]byte) {
-		batchChannel <- &b
-	}
-
 	return batchLogger
 }
 
@@ -172,3 +176,351 @@ func TestOldLogTriggersBatch(t *testing.T) {
 	// Assert that the batch has all the same byte slices as the expected batch
 	require.ElementsMatch(t, expectedBatch, *batch)
 }
+
+func TestFlushSendsCurrentBatch(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, time.Minute)
+
+	testLogEntry := LogEntry{
+		DateCreated: time.Now().UnixMilli(),
+	}
+	batchLogger.Enqueue(&testLogEntry)
+
+	// The log entry is younger than MaxLogAge, so there shouldn't be a batch yet
+	assert.Equal(t, 0, len(batchChannel))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Flush(ctx))
+
+	// Flush should only return once the callback has handled the batch
+	require.Equal(t, 1, len(batchChannel))
+	batch := <-batchChannel
+	assert.Equal(t, 1, len(*batch))
+}
+
+func TestCloseSendsRemainingBatch(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, time.Minute)
+
+	testLogEntry := LogEntry{
+		DateCreated: time.Now().UnixMilli(),
+	}
+	batchLogger.Enqueue(&testLogEntry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Close(ctx))
+
+	require.Equal(t, 1, len(batchChannel))
+	batch := <-batchChannel
+	assert.Equal(t, 1, len(*batch))
+
+	// Closing again should be a no-op
+	require.Nil(t, batchLogger.Close(ctx))
+	require.Nil(t, batchLogger.Flush(ctx))
+}
+
+func TestEnqueueAfterCloseIsDropped(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Close(ctx))
+
+	testLogEntry := LogEntry{
+		DateCreated: time.Now().UnixMilli(),
+	}
+	batchLogger.Enqueue(&testLogEntry)
+
+	err := batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Dropped)
+	assert.Nil(t, err.(ErrorLogEntriesDropped).Err)
+	assert.Equal(t, 0, len(batchChannel))
+}
+
+func TestCloseReportsUnsentEntries(t *testing.T) {
+	// Use a batchHandler that never returns
+	blockCallback := make(chan struct{})
+	defer close(blockCallback)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			<-blockCallback
+			return nil
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		batchLogger.Enqueue(&LogEntry{
+			DateCreated: time.Now().UnixMilli(),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(0), err.(ErrorLogEntriesDropped).Dropped)
+	assert.Equal(t, int64(3), err.(ErrorLogEntriesDropped).Unsent)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestStatsCountEnqueuedAndDropped(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, time.Minute)
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Close(ctx))
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	assert.Equal(t, BatchLoggerStats{Enqueued: 1, DroppedClosed: 1, Batches: 1, BatchedEntries: 1, SentBatches: 1, SentEntries: 1}, batchLogger.Stats())
+}
+
+func TestBatchesDoNotExceedMaxCount(t *testing.T) {
+	const TestLogEntryCount = 25
+	const MaxBatchCount = 10
+
+	batchChannel := make(chan *[][]byte, TestLogEntryCount)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:  1024 * 512,
+		MaxBatchCount: MaxBatchCount,
+		MaxLogAge:     time.Minute,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			batchChannel <- &b
+			return nil
+		},
+	})
+
+	for i := 0; i < TestLogEntryCount; i++ {
+		batchLogger.Enqueue(&LogEntry{
+			DateCreated: time.Now().UnixMilli(),
+		})
+	}
+
+	// Full batches should be sent without waiting for MaxLogAge
+	for i := 0; i < TestLogEntryCount/MaxBatchCount; i++ {
+		select {
+		case batch := <-batchChannel:
+			assert.Equal(t, MaxBatchCount, len(*batch))
+		case <-time.After(time.Second):
+			t.Fatal("full batch was not sent")
+		}
+	}
+
+	// The remainder should only be sent once the logger is flushed
+	assert.Equal(t, 0, len(batchChannel))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Flush(ctx))
+	batch := <-batchChannel
+	assert.Equal(t, TestLogEntryCount%MaxBatchCount, len(*batch))
+}
+
+func TestMaxLogAgeTimerTriggersBatch(t *testing.T) {
+	const MaxLogAge = 50 * time.Millisecond
+
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, MaxLogAge)
+
+	enqueuedAt := time.Now()
+	batchLogger.Enqueue(&LogEntry{
+		DateCreated: enqueuedAt.UnixMilli(),
+	})
+
+	// Without any other entries being enqueued, the batch should be sent once the entry reaches MaxLogAge
+	select {
+	case batch := <-batchChannel:
+		assert.Equal(t, 1, len(*batch))
+		assert.GreaterOrEqual(t, time.Since(enqueuedAt), MaxLogAge-time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not sent once its oldest entry reached MaxLogAge")
+	}
+}
+
+// getBusyBatchLoggerGoroutines returns the IDs of the goroutines running a batchLogger's worker or replayer which aren't parked, e.g. in a
+// blocking select or channel receive
+func getBusyBatchLoggerGoroutines() map[string]bool {
+	stacks := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) {
+			stacks = stacks[:n]
+			break
+		}
+		stacks = make([]byte, 2*len(stacks))
+	}
+
+	busyGoroutines := map[string]bool{}
+	for _, goroutine := range strings.Split(string(stacks), "\n\n") {
+		header, frames, _ := strings.Cut(goroutine, "\n")
+		if !strings.Contains(frames, "(*batchLogger).worker") && !strings.Contains(frames, "(*batchLogger).replayer") {
+			continue
+		}
+		// The header is like "goroutine 7 [select, 1 minutes]:"
+		id, state, _ := strings.Cut(header, " [")
+		if !strings.HasPrefix(state, "select") && !strings.HasPrefix(state, "chan receive") {
+			busyGoroutines[id] = true
+		}
+	}
+	return busyGoroutines
+}
+
+func TestIdleBatchLoggersDontSpin(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		batchLogger := NewBatchLogger(BatchLoggerOptions{
+			MaxBatchSize: 1024 * 512,
+			MaxLogAge:    time.Minute,
+		})
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.Nil(t, batchLogger.Close(ctx))
+		})
+	}
+
+	// Give the goroutines a moment to start & park. A busy-polling goroutine is never parked, whereas one woken by a timer or an entry from
+	// another test is only busy for a moment, so only the goroutines which are busy every time we look are counted
+	time.Sleep(50 * time.Millisecond)
+	busyGoroutines := getBusyBatchLoggerGoroutines()
+	for i := 0; i < 10 && len(busyGoroutines) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stillBusyGoroutines := getBusyBatchLoggerGoroutines()
+		for id := range busyGoroutines {
+			if !stillBusyGoroutines[id] {
+				delete(busyGoroutines, id)
+			}
+		}
+	}
+	assert.Empty(t, busyGoroutines)
+}
+
+func BenchmarkBatchLoggerThroughput(b *testing.B) {
+	var receivedCount int64
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:   1024 * 512,
+		MaxLogAge:      time.Second,
+		OverflowPolicy: BlockOnOverflow,
+		BatchCallback: func(batch [][]byte, m BatchMetadata) error {
+			atomic.AddInt64(&receivedCount, int64(len(batch)))
+			return nil
+		},
+	})
+
+	testLogEntry := &LogEntry{
+		DateCreated: time.Now().UnixMilli(),
+		Request: Request{
+			Body:         "{\"description\":\"This is a test request body\"}",
+			Headers:      map[string][]string{"Content-Type": {"application/json"}},
+			HTTPProtocol: HTTP2,
+			IP:           "8.8.8.8",
+			Method:       Post,
+			URI:          "http://firetail.io/not-real",
+			Resource:     "/not-real",
+		},
+		Response: Response{
+			Body:       "{\"description\":\"This is a test response body\"}",
+			Headers:    map[string][]string{"Content-Type": {"application/json"}},
+			StatusCode: 200,
+		},
+	}
+
+	b.ResetTimer()
+	startTime := time.Now()
+	for i := 0; i < b.N; i++ {
+		batchLogger.Enqueue(testLogEntry)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.Nil(b, batchLogger.Close(ctx))
+	b.StopTimer()
+
+	// Closing the logger should have flushed every entry, & none should have been dropped as the overflow policy blocks
+	require.Equal(b, int64(b.N), atomic.LoadInt64(&receivedCount))
+
+	// This should comfortably exceed 50,000 entries/s
+	b.ReportMetric(float64(b.N)/time.Since(startTime).Seconds(), "entries/s")
+}
+
+func TestBatchCallbackIsRetried(t *testing.T) {
+	const MaxBatchAttempts = 3
+
+	metadataChannel := make(chan BatchMetadata, MaxBatchAttempts)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:     1024 * 512,
+		MaxLogAge:        time.Minute,
+		MaxBatchAttempts: MaxBatchAttempts,
+		RetryBackoff:     time.Millisecond,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			metadataChannel <- m
+			return errors.New("test error")
+		},
+	})
+
+	testLogEntry := LogEntry{
+		DateCreated: time.Now().UnixMilli() - 1000,
+	}
+	testLogEntryBytes, err := json.Marshal(testLogEntry)
+	require.Nil(t, err)
+	batchLogger.Enqueue(&testLogEntry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Failed)
+
+	// The callback should have been given the batch MaxBatchAttempts times, with the attempt number incrementing each time
+	require.Equal(t, MaxBatchAttempts, len(metadataChannel))
+	for attempt := 1; attempt <= MaxBatchAttempts; attempt++ {
+		metadata := <-metadataChannel
+		assert.Equal(t, BatchMetadata{
+			EntryCount:           1,
+			ByteSize:             len(testLogEntryBytes),
+			OldestEntryCreatedAt: time.UnixMilli(testLogEntry.DateCreated),
+			Attempt:              attempt,
+		}, metadata)
+	}
+
+	stats := batchLogger.Stats()
+	assert.Equal(t, int64(1), stats.FailedBatches)
+	assert.Equal(t, int64(1), stats.FailedEntries)
+	assert.Equal(t, int64(0), stats.SentBatches)
+}
+
+func TestBatchCallbackSucceedsOnRetry(t *testing.T) {
+	attempts := make(chan int, 2)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		RetryBackoff: time.Millisecond,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			attempts <- m.Attempt
+			if m.Attempt == 1 {
+				return errors.New("test error")
+			}
+			return nil
+		},
+	})
+
+	batchLogger.Enqueue(&LogEntry{
+		DateCreated: time.Now().UnixMilli(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Close(ctx))
+
+	assert.Equal(t, 2, len(attempts))
+	stats := batchLogger.Stats()
+	assert.Equal(t, int64(1), stats.SentBatches)
+	assert.Equal(t, int64(1), stats.SentEntries)
+	assert.Equal(t, int64(0), stats.FailedBatches)
+}
@@ -0,0 +1,348 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// BodyMask determines how the values selected by a BodyRule or ParameterRule are masked
+type BodyMask int
+
+const (
+	// The value will be removed entirely. If it's an element of an array, the array is shortened. If it's the whole body, the body is removed
+	RemoveBodyValue BodyMask = iota
+
+	// The value will be replaced with the BodyRule's Replacement
+	ReplaceBodyValue
+
+	// The value will be hashed. Strings are hashed as they are, & any other values are hashed as JSON
+	HashBodyValue
+
+	// The value will be truncated to the BodyRule's TruncateLength characters. Values that aren't strings are truncated as JSON
+	TruncateBodyValue
+
+	// All but the last four characters of the value will be replaced with asterisks, e.g. for card numbers. Values that aren't strings are
+	// masked as JSON, & values with four characters or fewer are masked entirely
+	KeepLastFourOfBodyValue
+)
+
+// BodyRule describes values to mask in the JSON bodies of requests or responses, before they are reported to Firetail
+type BodyRule struct {
+	// Selector selects the values the rule applies to. It may be a JSON Pointer (RFC 6901), such as "/card/number" or "/items/0/price", or
+	// a JSONPath starting with "$", such as "$.card.number", "$.items[*].price", "$['api-key']" or "$..password". JSONPaths may use child
+	// names, array indices, wildcards & recursive descent, but not filters, slices or unions
+	Selector string
+
+	// Mask determines what happens to the selected values. Defaults to RemoveBodyValue
+	Mask BodyMask
+
+	// Replacement is the value used by ReplaceBodyValue. Defaults to "[REDACTED]"
+	Replacement string
+
+	// TruncateLength is the number of characters TruncateBodyValue truncates values to
+	TruncateLength int
+
+	// Resource optionally restricts the rule to log entries whose request matched this resource in the OpenAPI spec, e.g. "/pets/{id}"
+	Resource string
+
+	// Method optionally restricts the rule to log entries whose request was made with this method, e.g. "POST"
+	Method Method
+}
+
+// bodyRuleSet is a list of BodyRules whose selectors have been parsed, so they can be applied to the bodies of many log entries
+type bodyRuleSet []parsedBodyRule
+
+type parsedBodyRule struct {
+	BodyRule
+	segments []selectorSegment
+}
+
+// newBodyRuleSet parses the selectors of a list of BodyRules. Errs if any of them are invalid
+func newBodyRuleSet(rules []BodyRule) (bodyRuleSet, error) {
+	ruleSet := bodyRuleSet{}
+	for _, rule := range rules {
+		segments, err := parseSelector(rule.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if rule.TruncateLength < 0 {
+			return nil, fmt.Errorf("body rule for %q has a negative TruncateLength", rule.Selector)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED]"
+		}
+		ruleSet = append(ruleSet, parsedBodyRule{rule, segments})
+	}
+	return ruleSet, nil
+}
+
+// apply applies the rules which match the request of a log entry to one of its bodies. The body is only parsed & marshalled once, no matter
+// how many rules apply to it. If the body isn't JSON, it's returned as it is, or removed if removeUnparseable is true. Values masked with
+// HashBodyValue are hashed with hash
+func (ruleSet bodyRuleSet) apply(logEntry *LogEntry, body string, removeUnparseable bool, hash func(string) string) string {
+	rules := bodyRuleSet{}
+	for _, rule := range ruleSet {
+		if (rule.Resource == "" || rule.Resource == logEntry.Request.Resource) && (rule.Method == "" || rule.Method == logEntry.Request.Method) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 || body == "" {
+		return body
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber() // So large numbers aren't mangled by being decoded as float64s
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		if removeUnparseable {
+			return ""
+		}
+		return body
+	}
+
+	for _, rule := range rules {
+		rule := rule
+		var keep bool
+		value, keep = applySelector(value, rule.segments, func(value interface{}) (interface{}, bool) {
+			return maskValue(value, rule.Mask, rule.Replacement, rule.TruncateLength, hash)
+		})
+		if !keep {
+			return ""
+		}
+	}
+
+	var maskedBody bytes.Buffer
+	encoder := json.NewEncoder(&maskedBody)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(maskedBody.String(), "\n")
+}
+
+// maskValue applies a BodyMask to a value, returning false if the value should be removed
+func maskValue(value interface{}, mask BodyMask, replacement string, truncateLength int, hash func(string) string) (interface{}, bool) {
+	switch mask {
+	case ReplaceBodyValue:
+		return replacement, true
+
+	case HashBodyValue:
+		return hash(stringifyBodyValue(value)), true
+
+	case TruncateBodyValue:
+		s := stringifyBodyValue(value)
+		if utf8.RuneCountInString(s) <= truncateLength {
+			return s, true
+		}
+		return string([]rune(s)[:truncateLength]), true
+
+	case KeepLastFourOfBodyValue:
+		runes := []rune(stringifyBodyValue(value))
+		kept := 0
+		if len(runes) > 4 {
+			kept = 4
+		}
+		return strings.Repeat("*", len(runes)-kept) + string(runes[len(runes)-kept:]), true
+
+	default:
+		return nil, false
+	}
+}
+
+// stringifyBodyValue returns a string as it is, or any other value as JSON
+func stringifyBodyValue(value interface{}) string {
+	if s, isString := value.(string); isString {
+		return s
+	}
+	marshalledValue, _ := json.Marshal(value) // Values decoded from JSON can always be marshalled back to JSON
+	return string(marshalledValue)
+}
+
+// selectorSegment is one step of a JSON Pointer or JSONPath, which selects children of the objects or arrays it's applied to
+type selectorSegment struct {
+	name      string // The name of the object member selected, if hasName is true
+	hasName   bool
+	index     int  // The index of the array element selected, or -1
+	wildcard  bool // If true, every child is selected
+	recursive bool // If true, the segment also applies to every descendant (JSONPath's ..)
+}
+
+func (s selectorSegment) matchesName(name string) bool {
+	return s.wildcard || (s.hasName && s.name == name)
+}
+
+func (s selectorSegment) matchesIndex(index int) bool {
+	return s.wildcard || s.index == index
+}
+
+// applySelector applies mask to every value within value selected by the segments of a selector, returning false if value itself should
+// be removed
+func applySelector(value interface{}, segments []selectorSegment, mask func(interface{}) (interface{}, bool)) (interface{}, bool) {
+	if len(segments) == 0 {
+		return mask(value)
+	}
+	segment := segments[0]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if segment.matchesName(name) {
+				if maskedChild, keep := applySelector(child, segments[1:], mask); keep {
+					v[name] = maskedChild
+				} else {
+					delete(v, name)
+				}
+			}
+		}
+		if segment.recursive {
+			for name, child := range v {
+				v[name], _ = applySelector(child, segments, mask)
+			}
+		}
+
+	case []interface{}:
+		kept := make([]interface{}, 0, len(v))
+		for index, child := range v {
+			if segment.matchesIndex(index) {
+				maskedChild, keep := applySelector(child, segments[1:], mask)
+				if !keep {
+					continue
+				}
+				child = maskedChild
+			}
+			if segment.recursive {
+				child, _ = applySelector(child, segments, mask)
+			}
+			kept = append(kept, child)
+		}
+		return kept, true
+	}
+
+	return value, true
+}
+
+// parseSelector parses a JSON Pointer or, if it starts with "$", a JSONPath
+func parseSelector(selector string) ([]selectorSegment, error) {
+	if strings.HasPrefix(selector, "$") {
+		return parseJSONPath(selector)
+	}
+	return parseJSONPointer(selector)
+}
+
+// parseJSONPointer parses a JSON Pointer, as defined in RFC 6901. Each of its reference tokens selects the object member with that name, or
+// the array element with that index
+func parseJSONPointer(pointer string) ([]selectorSegment, error) {
+	if pointer == "" {
+		return []selectorSegment{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must be empty or start with \"/\"", pointer)
+	}
+	segments := []selectorSegment{}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		name := strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		segment := selectorSegment{name: name, hasName: true, index: -1}
+		if index, err := strconv.Atoi(token); err == nil && index >= 0 && strconv.Itoa(index) == token {
+			segment.index = index
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// parseJSONPath parses a JSONPath made up of child names (.name or ['name']), array indices ([0]), wildcards (.* or [*]) & recursive
+// descent (..name, ..* or ..[0])
+func parseJSONPath(path string) ([]selectorSegment, error) {
+	segments := []selectorSegment{}
+	invalid := func(reason string) error {
+		return fmt.Errorf("JSONPath %q is invalid: %s", path, reason)
+	}
+
+	for i := 1; i < len(path); {
+		segment := selectorSegment{index: -1}
+		switch {
+		case strings.HasPrefix(path[i:], ".."):
+			segment.recursive = true
+			i += 2
+		case path[i] == '.':
+			i++
+		case path[i] == '[':
+		default:
+			return nil, invalid(fmt.Sprintf("unexpected %q at offset %d", path[i], i))
+		}
+
+		if i < len(path) && path[i] == '[' {
+			end, err := parseJSONPathBracket(path, i, &segment)
+			if err != nil {
+				return nil, invalid(err.Error())
+			}
+			i = end
+		} else {
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == i {
+				return nil, invalid(fmt.Sprintf("missing name at offset %d", i))
+			}
+			if path[i:end] == "*" {
+				segment.wildcard = true
+			} else {
+				segment.name, segment.hasName = path[i:end], true
+			}
+			i = end
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// parseJSONPathBracket parses a bracketed JSONPath segment starting at path[start], which may be a wildcard, an array index or a quoted name,
+// into segment. Returns the offset of the end of the bracket
+func parseJSONPathBracket(path string, start int, segment *selectorSegment) (int, error) {
+	i := start + 1
+	if i >= len(path) {
+		return 0, fmt.Errorf("unterminated bracket at offset %d", start)
+	}
+
+	switch quote := path[i]; {
+	case quote == '\'' || quote == '"':
+		var name strings.Builder
+		for i++; i < len(path) && path[i] != quote; i++ {
+			if path[i] == '\\' && i+1 < len(path) {
+				i++
+			}
+			name.WriteByte(path[i])
+		}
+		if i >= len(path) {
+			return 0, fmt.Errorf("unterminated string at offset %d", start+1)
+		}
+		segment.name, segment.hasName = name.String(), true
+		i++
+
+	case quote == '*':
+		segment.wildcard = true
+		i++
+
+	default:
+		end := i
+		for end < len(path) && path[end] >= '0' && path[end] <= '9' {
+			end++
+		}
+		index, err := strconv.Atoi(path[i:end])
+		if err != nil {
+			return 0, fmt.Errorf("expected a quoted name, index or * at offset %d", i)
+		}
+		segment.index = index
+		i = end
+	}
+
+	if i >= len(path) || path[i] != ']' {
+		return 0, fmt.Errorf("expected \"]\" at offset %d", i)
+	}
+	return i + 1, nil
+}
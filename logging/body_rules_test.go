@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBodyRulesBody = `{"user":{"name":"Alice","password":"hunter2"},"cards":[{"number":"4111111111111111","cvc":123},{"number":"5500005555555559","cvc":456}],"notes":"<b>hi</b>","id":12345678901234567890}`
+
+func applyTestBodyRules(t *testing.T, body string, rules ...BodyRule) string {
+	ruleSet, err := newBodyRuleSet(rules)
+	require.Nil(t, err)
+	return ruleSet.apply(&LogEntry{}, body, false, hashString)
+}
+
+func TestBodyRuleMasks(t *testing.T) {
+	for _, testCase := range []struct {
+		rule         BodyRule
+		expectedBody string
+	}{
+		{
+			BodyRule{Selector: "/user/password"},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice"}}`,
+		},
+		{
+			BodyRule{Selector: "$.user.password", Mask: ReplaceBodyValue},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"[REDACTED]"}}`,
+		},
+		{
+			BodyRule{Selector: "$.user.password", Mask: ReplaceBodyValue, Replacement: "***"},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"***"}}`,
+		},
+		{
+			BodyRule{Selector: "/user/password", Mask: HashBodyValue},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"` + hashString("hunter2") + `"}}`,
+		},
+		{
+			BodyRule{Selector: "$.cards[*].cvc", Mask: HashBodyValue},
+			`{"cards":[{"cvc":"` + hashString("123") + `","number":"4111111111111111"},{"cvc":"` + hashString("456") + `","number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"hunter2"}}`,
+		},
+		{
+			BodyRule{Selector: "$.user.name", Mask: TruncateBodyValue, TruncateLength: 2},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Al","password":"hunter2"}}`,
+		},
+		{
+			BodyRule{Selector: "$.user", Mask: TruncateBodyValue, TruncateLength: 8},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":"{\"name\":"}`,
+		},
+		{
+			BodyRule{Selector: "$.cards[*].number", Mask: KeepLastFourOfBodyValue},
+			`{"cards":[{"cvc":123,"number":"************1111"},{"cvc":456,"number":"************5559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"hunter2"}}`,
+		},
+		{
+			BodyRule{Selector: "/id", Mask: KeepLastFourOfBodyValue},
+			`{"cards":[{"cvc":123,"number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":"****************7890","notes":"<b>hi</b>","user":{"name":"Alice","password":"hunter2"}}`,
+		},
+		{
+			BodyRule{Selector: "/cards/0/cvc", Mask: KeepLastFourOfBodyValue},
+			`{"cards":[{"cvc":"***","number":"4111111111111111"},{"cvc":456,"number":"5500005555555559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"hunter2"}}`,
+		},
+	} {
+		assert.Equal(t, testCase.expectedBody, applyTestBodyRules(t, testBodyRulesBody, testCase.rule), testCase.rule.Selector)
+	}
+}
+
+func TestBodyRuleSelectors(t *testing.T) {
+	body := `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"m~n":6,"x y":7,"items":[1,2,3]}`
+	for _, testCase := range []struct {
+		selector     string
+		expectedBody string
+	}{
+		{"/a/b/0/c", `{"a":{"b":[{"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"/a/b/1", `{"a":{"b":[{"c":1,"d":2}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"/a~1b", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"/m~0n", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"x y":7}`},
+		{"/items/01", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"/does/not/exist", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$.a.b[1]", `{"a":{"b":[{"c":1,"d":2}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$.a.b[*].c", `{"a":{"b":[{"d":2},{}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$['a/b']", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$[\"x y\"]", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6}`},
+		{"$..c", `{"a":{"b":[{"d":2},{}]},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$..[0]", `{"a":{"b":[{"c":3}],"c":4},"a/b":5,"items":[2,3],"m~n":6,"x y":7}`},
+		{"$.items.*", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[],"m~n":6,"x y":7}`},
+		{"$.a.*", `{"a":{},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+		{"$.a.b.c", `{"a":{"b":[{"c":1,"d":2},{"c":3}],"c":4},"a/b":5,"items":[1,2,3],"m~n":6,"x y":7}`},
+	} {
+		assert.Equal(t, testCase.expectedBody, applyTestBodyRules(t, body, BodyRule{Selector: testCase.selector}), testCase.selector)
+	}
+}
+
+func TestBodyRuleSelectingWholeBody(t *testing.T) {
+	assert.Equal(t, "", applyTestBodyRules(t, testBodyRulesBody, BodyRule{Selector: ""}))
+	assert.Equal(t, "", applyTestBodyRules(t, testBodyRulesBody, BodyRule{Selector: "$"}))
+	assert.Equal(t, `"[REDACTED]"`, applyTestBodyRules(t, testBodyRulesBody, BodyRule{Selector: "$", Mask: ReplaceBodyValue}))
+}
+
+func TestMultipleBodyRules(t *testing.T) {
+	assert.Equal(
+		t,
+		`{"cards":[{"number":"************1111"},{"number":"************5559"}],"id":12345678901234567890,"notes":"<b>hi</b>","user":{"name":"Alice","password":"[REDACTED]"}}`,
+		applyTestBodyRules(
+			t, testBodyRulesBody,
+			BodyRule{Selector: "$..password", Mask: ReplaceBodyValue},
+			BodyRule{Selector: "$.cards[*].number", Mask: KeepLastFourOfBodyValue},
+			BodyRule{Selector: "$.cards[*].cvc"},
+		),
+	)
+}
+
+func TestBodyRulesAreRestrictedByResourceAndMethod(t *testing.T) {
+	ruleSet, err := newBodyRuleSet([]BodyRule{
+		{Selector: "/password", Resource: "/users", Method: Post},
+		{Selector: "/token", Resource: "/sessions"},
+	})
+	require.Nil(t, err)
+	body := `{"password":"hunter2","token":"abc"}`
+
+	assert.Equal(t, `{"token":"abc"}`, ruleSet.apply(&LogEntry{Request: Request{Resource: "/users", Method: Post}}, body, false, hashString))
+	assert.Equal(t, body, ruleSet.apply(&LogEntry{Request: Request{Resource: "/users", Method: Put}}, body, false, hashString))
+	assert.Equal(t, `{"password":"hunter2"}`, ruleSet.apply(&LogEntry{Request: Request{Resource: "/sessions", Method: Get}}, body, false, hashString))
+	assert.Equal(t, body, ruleSet.apply(&LogEntry{Request: Request{Resource: "/pets", Method: Post}}, body, false, hashString))
+}
+
+func TestBodyRulesWithUnparseableBodies(t *testing.T) {
+	ruleSet, err := newBodyRuleSet([]BodyRule{{Selector: "/password"}})
+	require.Nil(t, err)
+	for _, body := range []string{"password=hunter2", `{"password":"hunter2"`, `{"password":"hunter2"} {}`} {
+		assert.Equal(t, body, ruleSet.apply(&LogEntry{}, body, false, hashString), body)
+		assert.Equal(t, "", ruleSet.apply(&LogEntry{}, body, true, hashString), body)
+	}
+	assert.Equal(t, "", ruleSet.apply(&LogEntry{}, "", true, hashString))
+}
+
+func TestInvalidBodyRules(t *testing.T) {
+	for _, rule := range []BodyRule{
+		{Selector: "password"},
+		{Selector: "$password"},
+		{Selector: "$."},
+		{Selector: "$.a..", Mask: HashBodyValue},
+		{Selector: "$.a["},
+		{Selector: "$.a[b]"},
+		{Selector: "$.a['b"},
+		{Selector: "$.a['b'"},
+		{Selector: "$.a[1:2]"},
+		{Selector: "/a", Mask: TruncateBodyValue, TruncateLength: -1},
+	} {
+		_, err := newBodyRuleSet([]BodyRule{rule})
+		assert.NotNil(t, err, rule.Selector)
+	}
+}
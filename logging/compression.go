@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a Content-Encoding used by the default BatchCallback to compress the batches it sends to the Firetail logging API
+type Compression int
+
+const (
+	// Batches are sent uncompressed
+	NoCompression Compression = iota
+
+	// Batches are compressed with gzip
+	GzipCompression
+
+	// Batches are compressed with zstd
+	ZstdCompression
+)
+
+// contentEncoding returns the value of the Content-Encoding header to send with a payload compressed with c
+func (c Compression) contentEncoding() string {
+	switch c {
+	case GzipCompression:
+		return "gzip"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// compressor is implemented by both gzip.Writer & zstd.Encoder
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(io.Writer)
+}
+
+// newCompressor returns a compressor which writes to w, or nil if c is NoCompression
+func newCompressor(c Compression, w io.Writer) compressor {
+	switch c {
+	case GzipCompression:
+		return gzip.NewWriter(w)
+	case ZstdCompression:
+		// NewWriter only errs if it's given invalid options
+		encoder, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		return encoder
+	default:
+		return nil
+	}
+}
+
+// compressPayload compresses payload with c, returning it unchanged if c is NoCompression
+func compressPayload(c Compression, payload []byte) ([]byte, error) {
+	compressed := &bytes.Buffer{}
+	compressor := newCompressor(c, compressed)
+	if compressor == nil {
+		return payload, nil
+	}
+	if _, err := compressor.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// compressedSizeEstimator keeps track of how big a batch's payload would be once compressed as log entries are added to it. The compressor
+// is flushed after each entry so the size is known, which makes the estimate slightly pessimistic compared to compressing the payload in
+// one go, as the default BatchCallback does
+type compressedSizeEstimator struct {
+	compressor compressor
+	size       countingWriter
+}
+
+func newCompressedSizeEstimator(c Compression) *compressedSizeEstimator {
+	estimator := &compressedSizeEstimator{}
+	estimator.compressor = newCompressor(c, &estimator.size)
+	return estimator
+}
+
+// add adds an entry to the batch & returns the estimated compressed size of the batch's payload including it
+func (e *compressedSizeEstimator) add(entry []byte) int {
+	// Writes to a countingWriter can't fail
+	e.compressor.Write(entry)
+	e.compressor.Write([]byte{'\n'})
+	e.compressor.Flush()
+	return e.estimate()
+}
+
+// estimate returns the estimated compressed size of the batch's payload, including the compressor's trailer
+func (e *compressedSizeEstimator) estimate() int {
+	return int(e.size) + compressorTrailerSize
+}
+
+// reset empties the batch
+func (e *compressedSizeEstimator) reset() {
+	e.size = 0
+	e.compressor.Reset(&e.size)
+}
+
+// compressorTrailerSize is an upper bound on the number of bytes written by closing a flushed compressor (gzip writes an 8 byte footer
+// after an empty final block, & zstd writes a 3 byte empty final block)
+const compressorTrailerSize = 10
+
+// countingWriter discards everything written to it, counting the number of bytes
+type countingWriter int
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decompressPayload(t *testing.T, c Compression, payload []byte) []byte {
+	var reader io.Reader
+	switch c {
+	case GzipCompression:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+		require.Nil(t, err)
+		reader = gzipReader
+	case ZstdCompression:
+		zstdReader, err := zstd.NewReader(bytes.NewReader(payload))
+		require.Nil(t, err)
+		defer zstdReader.Close()
+		reader = zstdReader
+	default:
+		reader = bytes.NewReader(payload)
+	}
+	decompressed, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	return decompressed
+}
+
+func testPayloadEntries(count int) [][]byte {
+	entries := [][]byte{}
+	for i := 0; i < count; i++ {
+		entries = append(entries, []byte(fmt.Sprintf(`{"id":%d,"body":"%s"}`, i, strings.Repeat("test body ", 20))))
+	}
+	return entries
+}
+
+func TestCompressPayload(t *testing.T) {
+	payload := bytes.Join(testPayloadEntries(100), []byte{'\n'})
+	for _, compression := range []Compression{NoCompression, GzipCompression, ZstdCompression} {
+		compressed, err := compressPayload(compression, payload)
+		require.Nil(t, err)
+		if compression != NoCompression {
+			assert.Less(t, len(compressed), len(payload)/10)
+		}
+		assert.Equal(t, payload, decompressPayload(t, compression, compressed))
+	}
+}
+
+func TestCompressedSizeEstimateIsPessimistic(t *testing.T) {
+	for _, compression := range []Compression{GzipCompression, ZstdCompression} {
+		estimator := newCompressedSizeEstimator(compression)
+		for i := 0; i < 2; i++ {
+			payload := []byte{}
+			estimate := 0
+			for _, entry := range testPayloadEntries(50) {
+				estimate = estimator.add(entry)
+				payload = append(append(payload, entry...), '\n')
+			}
+			compressed, err := compressPayload(compression, payload)
+			require.Nil(t, err)
+			assert.GreaterOrEqual(t, estimate, len(compressed))
+			// Flushing adds a few bytes per entry, but the estimate shouldn't be any more pessimistic than that
+			assert.Less(t, estimate, len(compressed)+50*16)
+
+			// The estimator should give the same estimate after it's reset
+			estimator.reset()
+		}
+	}
+}
+
+func TestMaxBatchSizeAppliesToCompressedSize(t *testing.T) {
+	const MaxBatchSize = 1024
+
+	payloads := make(chan []byte, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		payload, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		payloads <- payload
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer server.Close()
+
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:             MaxBatchSize,
+		MaxLogAge:                time.Minute,
+		LogApiKey:                "test-api-key",
+		LogApiUrl:                server.URL,
+		Compression:              GzipCompression,
+		MaxBatchSizeIsCompressed: true,
+	})
+	for i := 0; i < 100; i++ {
+		batchLogger.Enqueue(&LogEntry{
+			DateCreated: time.Now().UnixMilli(),
+			Request:     Request{Body: strings.Repeat("test body ", 20)},
+		})
+	}
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	// Each log entry is ~450 bytes uncompressed, so 100 would need ~50 batches if MaxBatchSize applied to their raw size
+	require.Less(t, len(payloads), 10)
+	for len(payloads) > 0 {
+		payload := <-payloads
+		assert.LessOrEqual(t, len(payload), MaxBatchSize)
+		decompressed := decompressPayload(t, GzipCompression, payload)
+		assert.Greater(t, len(decompressed), MaxBatchSize)
+	}
+	assert.Equal(t, int64(100), batchLogger.Stats().SentEntries)
+}
+
+func TestOversizedCompressedEntryIsDropped(t *testing.T) {
+	batchChannel := make(chan [][]byte, 1)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:             64,
+		MaxLogAge:                time.Minute,
+		Compression:              ZstdCompression,
+		MaxBatchSizeIsCompressed: true,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			batchChannel <- b
+			return nil
+		},
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	err := batchLogger.Close(context.Background())
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Dropped)
+	assert.Equal(t, 0, len(batchChannel))
+}
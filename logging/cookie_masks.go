@@ -0,0 +1,97 @@
+package logging
+
+import "strings"
+
+// maskCookies applies a cookies mask to each of the cookies in the Cookie & Set-Cookie headers of a map of headers. Cookies not in the mask
+// have defaultMask applied to them. The attributes of each Set-Cookie header, such as Secure, HttpOnly & SameSite, are preserved. The
+// headers are copied rather than modified in place
+func maskCookies(
+	headers map[string][]string, cookiesMask map[string]HeaderMask, defaultMask HeaderMask, hash func(string) string,
+) map[string][]string {
+	maskedHeaders := make(map[string][]string, len(headers))
+	for headerName, headerValues := range headers {
+		isSetCookie := strings.EqualFold(headerName, "set-cookie")
+		if !isSetCookie && !strings.EqualFold(headerName, "cookie") {
+			maskedHeaders[headerName] = headerValues
+			continue
+		}
+		maskedValues := []string{}
+		for _, headerValue := range headerValues {
+			var maskedValue string
+			var keep bool
+			if isSetCookie {
+				maskedValue, keep = maskSetCookie(headerValue, cookiesMask, defaultMask, hash)
+			} else {
+				maskedValue, keep = maskCookieHeader(headerValue, cookiesMask, defaultMask, hash)
+			}
+			if keep {
+				maskedValues = append(maskedValues, maskedValue)
+			}
+		}
+		if len(maskedValues) > 0 {
+			maskedHeaders[headerName] = maskedValues
+		}
+	}
+	return maskedHeaders
+}
+
+// maskCookieHeader masks each of the cookies in the value of a Cookie header, e.g. "session=abc; theme=dark". Returns false if every cookie
+// was removed
+func maskCookieHeader(value string, cookiesMask map[string]HeaderMask, defaultMask HeaderMask, hash func(string) string) (string, bool) {
+	maskedCookies := []string{}
+	for _, cookie := range strings.Split(value, ";") {
+		cookie = strings.TrimSpace(cookie)
+		if cookie == "" {
+			continue
+		}
+		if maskedCookie, keep := maskCookie(cookie, cookiesMask, defaultMask, hash); keep {
+			maskedCookies = append(maskedCookies, maskedCookie)
+		}
+	}
+	return strings.Join(maskedCookies, "; "), len(maskedCookies) > 0
+}
+
+// maskSetCookie masks the cookie in the value of a Set-Cookie header, e.g. "session=abc; Path=/; Secure; HttpOnly", leaving its attributes
+// as they are. Returns false if the cookie was removed
+func maskSetCookie(value string, cookiesMask map[string]HeaderMask, defaultMask HeaderMask, hash func(string) string) (string, bool) {
+	cookie, attributes, hasAttributes := strings.Cut(value, ";")
+	maskedCookie, keep := maskCookie(strings.TrimSpace(cookie), cookiesMask, defaultMask, hash)
+	if !keep {
+		return "", false
+	}
+	if hasAttributes {
+		return maskedCookie + ";" + attributes, true
+	}
+	return maskedCookie, true
+}
+
+// maskCookie applies the mask for a cookie's name to a cookie's name-value pair, e.g. "session=abc". Names are case sensitive. Values are
+// masked without any quotes around them. Returns false if the cookie should be removed
+func maskCookie(cookie string, cookiesMask map[string]HeaderMask, defaultMask HeaderMask, hash func(string) string) (string, bool) {
+	name, value, _ := strings.Cut(cookie, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	mask, hasMask := cookiesMask[name]
+	if !hasMask || mask == UnsetHeader {
+		mask = defaultMask
+	}
+
+	unquotedValue := value
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		unquotedValue = value[1 : len(value)-1]
+	}
+
+	switch mask {
+	case RemoveHeader:
+		return "", false
+	case RemoveHeaderValues:
+		return name + "=", true
+	case HashHeaderValues:
+		return name + "=" + hash(unquotedValue), true
+	case HashHeader:
+		return hash(name) + "=" + hash(unquotedValue), true
+	case RedactJWTSignature:
+		return name + "=" + redactJWTSignature(unquotedValue), true
+	default:
+		return cookie, true
+	}
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestCookiesMask(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{
+		RequestHeadersMask: map[string]HeaderMask{"cookie": PreserveHeader},
+		RequestCookiesMask: map[string]HeaderMask{
+			"theme":   PreserveHeader,
+			"session": HashHeaderValues,
+			"tracker": RemoveHeader,
+			"csrf":    RemoveHeaderValues,
+			"secret":  HashHeader,
+		},
+		RequestCookiesMaskDefault: RemoveHeader,
+	})
+	requestHeaders := map[string][]string{
+		"Cookie":     {`theme=dark; session="abc"; tracker=xyz; csrf=def; secret=ghi; unknown=jkl`, "tracker=xyz"},
+		"User-Agent": {"test"},
+	}
+	sanitisedLogEntry := sanitiser(LogEntry{Request: Request{Headers: requestHeaders}})
+
+	assert.Equal(t, map[string][]string{
+		"Cookie":     {"theme=dark; session=" + hashString("abc") + "; csrf=; " + hashString("secret") + "=" + hashString("ghi")},
+		"User-Agent": {"test"},
+	}, sanitisedLogEntry.Request.Headers)
+
+	// The original headers shouldn't have been modified
+	assert.Equal(t, []string{"tracker=xyz"}, requestHeaders["Cookie"][1:])
+}
+
+func TestRequestCookiesMaskIsCaseSensitive(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{RequestCookiesMask: map[string]HeaderMask{"session": RemoveHeader}})
+	sanitisedLogEntry := sanitiser(LogEntry{Request: Request{Headers: map[string][]string{"cookie": {"Session=abc; session=def"}}}})
+	assert.Equal(t, map[string][]string{"cookie": {"Session=abc"}}, sanitisedLogEntry.Request.Headers)
+}
+
+func TestResponseCookiesMaskPreservesAttributes(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{
+		ResponseCookiesMask:        map[string]HeaderMask{"theme": PreserveHeader, "tracker": RemoveHeader},
+		ResponseCookiesMaskDefault: HashHeaderValues,
+	})
+	sanitisedLogEntry := sanitiser(LogEntry{Response: Response{Headers: map[string][]string{
+		"Set-Cookie": {
+			"session=abc; Path=/; Secure; HttpOnly; SameSite=Strict",
+			"theme=dark; Max-Age=3600",
+			"tracker=xyz; Domain=example.com",
+			"token=def",
+		},
+	}}})
+
+	assert.Equal(t, map[string][]string{
+		"Set-Cookie": {
+			"session=" + hashString("abc") + "; Path=/; Secure; HttpOnly; SameSite=Strict",
+			"theme=dark; Max-Age=3600",
+			"token=" + hashString("def"),
+		},
+	}, sanitisedLogEntry.Response.Headers)
+}
+
+func TestResponseCookiesMaskRemovesEmptyHeaders(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{ResponseCookiesMaskDefault: RemoveHeader})
+	sanitisedLogEntry := sanitiser(LogEntry{Response: Response{Headers: map[string][]string{
+		"Set-Cookie":   {"session=abc; Secure"},
+		"Content-Type": {"application/json"},
+	}}})
+	assert.Equal(t, map[string][]string{"Content-Type": {"application/json"}}, sanitisedLogEntry.Response.Headers)
+}
+
+func TestDefaultSanitiserHashesSetCookieValues(t *testing.T) {
+	sanitisedLogEntry := DefaultSanitiser()(LogEntry{Response: Response{Headers: map[string][]string{
+		"Set-Cookie": {"session=abc; Path=/; HttpOnly"},
+	}}})
+	assert.Equal(t, []string{"session=" + hashString("abc") + "; Path=/; HttpOnly"}, sanitisedLogEntry.Response.Headers["Set-Cookie"])
+}
+
+func TestDefaultSanitiserHashesCookieValues(t *testing.T) {
+	sanitisedLogEntry := DefaultSanitiser()(LogEntry{Request: Request{Headers: map[string][]string{
+		"Cookie": {"session=abc; theme=dark; csrf=def"},
+	}}})
+	assert.Equal(
+		t,
+		[]string{"session=" + hashString("abc") + "; theme=" + hashString("dark") + "; csrf=" + hashString("def")},
+		sanitisedLogEntry.Request.Headers["Cookie"],
+	)
+}
@@ -0,0 +1,25 @@
+package logging
+
+import "context"
+
+// getDefaultSink returns a Sink which sends batches to the Firetail logging API, configured by the options
+func getDefaultSink(options BatchLoggerOptions) Sink {
+	return NewFiretailSink(FiretailSinkOptions{
+		LogApiKey:       options.LogApiKey,
+		LogApiUrl:       options.LogApiUrl,
+		Compression:     options.Compression,
+		HTTPClient:      options.HTTPClient,
+		Transport:       options.Transport,
+		TLSClientConfig: options.TLSClientConfig,
+		RequestTimeout:  options.RequestTimeout,
+		ExtraHeaders:    options.ExtraHeaders,
+	})
+}
+
+// getSinkBatchCallback returns a BatchCallback which writes batches to a Sink with ctx, so the writes can be cancelled. If the Sink returns
+// an error, the batchLogger will retry it for us
+func getSinkBatchCallback(ctx context.Context, sink Sink) BatchCallback {
+	return func(batch [][]byte, metadata BatchMetadata) error {
+		return sink.Write(ctx, batch)
+	}
+}
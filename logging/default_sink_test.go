@@ -0,0 +1,261 @@
+package logging
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDefaultSink(t *testing.T, handler http.HandlerFunc) Sink {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return getDefaultSink(BatchLoggerOptions{
+		LogApiKey: "test-api-key",
+		LogApiUrl: server.URL,
+	})
+}
+
+func TestDefaultSinkSucceeds(t *testing.T) {
+	sink := setupDefaultSink(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-api-key", r.Header.Get("x-ft-api-key"))
+		w.Write([]byte(`{"message":"success"}`))
+	})
+	assert.Nil(t, sink.Write(context.Background(), [][]byte{[]byte("{}")}))
+}
+
+func TestDefaultSinkUnauthorisedIsNotRetryable(t *testing.T) {
+	for _, statusCode := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		sink := setupDefaultSink(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+			w.Write([]byte(`{"message":"invalid api key"}`))
+		})
+		err := sink.Write(context.Background(), [][]byte{[]byte("{}")})
+		require.IsType(t, ErrorBatchNotRetryable{}, err)
+		require.IsType(t, ErrorFiretailApiResponse{}, err.(ErrorBatchNotRetryable).Err)
+		apiErr := err.(ErrorBatchNotRetryable).Err.(ErrorFiretailApiResponse)
+		assert.Equal(t, statusCode, apiErr.StatusCode)
+		assert.Equal(t, "invalid api key", apiErr.Body["message"])
+	}
+}
+
+func TestDefaultSinkHonoursRetryAfter(t *testing.T) {
+	for _, statusCode := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		sink := setupDefaultSink(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(statusCode)
+		})
+		err := sink.Write(context.Background(), [][]byte{[]byte("{}")})
+		require.IsType(t, ErrorBatchRetryAfter{}, err)
+		assert.Equal(t, 3*time.Second, err.(ErrorBatchRetryAfter).RetryAfter)
+		assert.Equal(t, statusCode, err.(ErrorBatchRetryAfter).Err.(ErrorFiretailApiResponse).StatusCode)
+	}
+}
+
+func TestDefaultSinkServerErrorIsRetryable(t *testing.T) {
+	sink := setupDefaultSink(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	err := sink.Write(context.Background(), [][]byte{[]byte("{}")})
+	require.IsType(t, ErrorFiretailApiResponse{}, err)
+	assert.Equal(t, http.StatusInternalServerError, err.(ErrorFiretailApiResponse).StatusCode)
+}
+
+func TestDefaultSinkIsRetriedWithBackoff(t *testing.T) {
+	requests := make(chan time.Time, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- time.Now()
+		if len(requests) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer server.Close()
+
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		LogApiKey:    "test-api-key",
+		LogApiUrl:    server.URL,
+		RetryBackoff: 50 * time.Millisecond,
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	require.Equal(t, 3, len(requests))
+	first, second, third := <-requests, <-requests, <-requests
+	assert.GreaterOrEqual(t, second.Sub(first), 25*time.Millisecond)
+	assert.GreaterOrEqual(t, third.Sub(second), 50*time.Millisecond)
+}
+
+func TestDefaultSinkRetryAfterIsLimitedToMaxRetryAfter(t *testing.T) {
+	for _, retryAfter := range []string{"86400", time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat)} {
+		requests := make(chan struct{}, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- struct{}{}
+			if len(requests) < 2 {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"message":"success"}`))
+		}))
+		defer server.Close()
+
+		batchLogger := NewBatchLogger(BatchLoggerOptions{
+			MaxBatchSize:  1024 * 512,
+			MaxLogAge:     time.Minute,
+			LogApiKey:     "test-api-key",
+			LogApiUrl:     server.URL,
+			MaxRetryAfter: 50 * time.Millisecond,
+		})
+		batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+		// The batch should be retried once the MaxRetryAfter has elapsed, rather than after a day
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		require.Nil(t, batchLogger.Close(ctx))
+		assert.Equal(t, 2, len(requests))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	retryAfter, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, retryAfter)
+
+	retryAfter, ok = parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, retryAfter, float64(2*time.Second))
+
+	retryAfter, ok = parseRetryAfter("99999999999999999")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(math.MaxInt64), retryAfter)
+
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func generateTestCertificate(t *testing.T) tls.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(certificateBytes)
+	require.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{certificateBytes}, PrivateKey: privateKey, Leaf: leaf}
+}
+
+func TestDefaultSinkUsesTransportAndExtraHeaders(t *testing.T) {
+	var request *http.Request
+	sink := getDefaultSink(BatchLoggerOptions{
+		LogApiKey:    "test-api-key",
+		LogApiUrl:    "https://firetail.invalid/logs/bulk",
+		ExtraHeaders: http.Header{"X-Test-Header": []string{"test-value"}, "X-Ft-Api-Key": []string{"not-the-api-key"}},
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			request = r
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"message":"success"}`)),
+			}, nil
+		}),
+	})
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte("{}")}))
+	require.NotNil(t, request)
+	assert.Equal(t, "test-value", request.Header.Get("X-Test-Header"))
+	// The extra headers shouldn't be able to override the API key
+	assert.Equal(t, []string{"test-api-key"}, request.Header.Values("x-ft-api-key"))
+}
+
+func TestDefaultSinkUsesHTTPClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	// Without the test server's client, its certificate isn't trusted
+	options := BatchLoggerOptions{LogApiKey: "test-api-key", LogApiUrl: server.URL}
+	assert.NotNil(t, getDefaultSink(options).Write(context.Background(), [][]byte{[]byte("{}")}))
+
+	options.HTTPClient = server.Client()
+	assert.Nil(t, getDefaultSink(options).Write(context.Background(), [][]byte{[]byte("{}")}))
+}
+
+func TestDefaultSinkPresentsClientCertificate(t *testing.T) {
+	clientCertificate := generateTestCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate.Leaf)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	options := BatchLoggerOptions{
+		LogApiKey:       "test-api-key",
+		LogApiUrl:       server.URL,
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+	}
+	assert.NotNil(t, getDefaultSink(options).Write(context.Background(), [][]byte{[]byte("{}")}))
+
+	options.TLSClientConfig = &tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{clientCertificate}}
+	assert.Nil(t, getDefaultSink(options).Write(context.Background(), [][]byte{[]byte("{}")}))
+}
+
+func TestDefaultSinkTimesOut(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	sink := getDefaultSink(BatchLoggerOptions{
+		LogApiKey:      "test-api-key",
+		LogApiUrl:      server.URL,
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	startTime := time.Now()
+	err := sink.Write(context.Background(), [][]byte{[]byte("{}")})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(startTime), time.Second)
+}
@@ -0,0 +1,209 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSinkClosed is returned when a batch is written to a Sink after it has been closed
+var ErrSinkClosed = errors.New("sink closed")
+
+// FanOutOutput configures one of the Sinks to which a FanOutSink writes each batch
+type FanOutOutput struct {
+	Sink            Sink                // The Sink to write batches to
+	Filter          func(LogEntry) bool // An optional func which decides whether each log entry is written to the Sink; if nil, every log entry is written
+	BufferSize      int                 // The maximum number of batches waiting to be written to the Sink, beyond which further batches are dropped for this Sink; defaults to 16
+	MaxAttempts     int                 // The maximum number of times each batch is written to the Sink if it returns an error; defaults to 3
+	RetryBackoff    time.Duration       // How long to wait before the first retry of a batch, doubling with each attempt after that; defaults to 500ms
+	MaxRetryBackoff time.Duration       // The maximum time to wait between attempts, not including any ErrorBatchRetryAfter returned by the Sink; defaults to 30s
+}
+
+// FanOutOutputStats holds counters describing what a FanOutSink has done with the log entries it's been given for one of its outputs
+type FanOutOutputStats struct {
+	Written  int64 // The number of log entries the Sink has successfully written
+	Failed   int64 // The number of log entries in batches for which every attempt to write them to the Sink failed
+	Dropped  int64 // The number of log entries dropped because the output's buffer was full, or the FanOutSink was closed before they were written
+	Filtered int64 // The number of log entries the output's Filter didn't write to the Sink
+}
+
+// A FanOutSink is a Sink which writes each batch to several other Sinks. Each Sink has its own buffer of batches, written by its own goroutine
+// with its own retries, so a slow or failing Sink doesn't hold up the others
+type FanOutSink struct {
+	outputs []*fanOutOutput
+	mutex   sync.RWMutex
+	closed  bool
+}
+
+type fanOutOutput struct {
+	written  int64 // must be accessed atomically & kept 64-bit aligned
+	failed   int64 // must be accessed atomically
+	dropped  int64 // must be accessed atomically
+	filtered int64 // must be accessed atomically
+
+	FanOutOutput
+	backoff *backoff
+	batches chan [][]byte
+	ctx     context.Context    // Passed to the Sink's Write method, & cancelled if the FanOutSink's Close is given a context which is done first
+	cancel  context.CancelFunc // Cancels ctx
+	stopped chan struct{}      // Closed once the output's goroutine has written every batch in its buffer
+}
+
+// NewFanOutSink creates a FanOutSink which writes each batch to every one of the outputs given
+func NewFanOutSink(outputs ...FanOutOutput) *FanOutSink {
+	sink := &FanOutSink{}
+	for _, options := range outputs {
+		if options.BufferSize <= 0 {
+			options.BufferSize = 16
+		}
+		if options.MaxAttempts <= 0 {
+			options.MaxAttempts = 3
+		}
+		if options.RetryBackoff <= 0 {
+			options.RetryBackoff = 500 * time.Millisecond
+		}
+		if options.MaxRetryBackoff <= 0 {
+			options.MaxRetryBackoff = 30 * time.Second
+		}
+		output := &fanOutOutput{
+			FanOutOutput: options,
+			backoff:      newBackoff(options.RetryBackoff, options.MaxRetryBackoff),
+			batches:      make(chan [][]byte, options.BufferSize),
+			stopped:      make(chan struct{}),
+		}
+		output.ctx, output.cancel = context.WithCancel(context.Background())
+		sink.outputs = append(sink.outputs, output)
+		go output.worker()
+	}
+	return sink
+}
+
+// Write implements Sink. The batch is filtered for each output & added to its buffer without blocking, so Write only returns an error if the
+// FanOutSink has been closed; whether each Sink succeeds in writing the batch is reflected in the FanOutSink's Stats
+func (s *FanOutSink) Write(ctx context.Context, batch [][]byte) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return ErrorBatchNotRetryable{ErrSinkClosed}
+	}
+	for _, output := range s.outputs {
+		filteredBatch := output.filter(batch)
+		if len(filteredBatch) == 0 {
+			continue
+		}
+		select {
+		case output.batches <- filteredBatch:
+		default:
+			atomic.AddInt64(&output.dropped, int64(len(filteredBatch)))
+		}
+	}
+	return nil
+}
+
+// Close implements Sink. It waits for every output to finish writing the batches in its buffer, then closes each of their Sinks. If ctx is
+// done first, the outputs stop retrying & any batches left in their buffers are dropped. The first error returned by any of the Sinks' Close
+// methods, or ctx.Err(), is returned
+func (s *FanOutSink) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, output := range s.outputs {
+			close(output.batches)
+		}
+	}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for _, output := range s.outputs {
+		select {
+		case <-output.stopped:
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			// Once cancelled, the output drops the rest of its buffer as soon as its Sink's Write method returns
+			output.cancel()
+			<-output.stopped
+		}
+	}
+	for _, output := range s.outputs {
+		if err := output.Sink.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stats returns the counters for each of the FanOutSink's outputs, in the order they were given to NewFanOutSink
+func (s *FanOutSink) Stats() []FanOutOutputStats {
+	stats := make([]FanOutOutputStats, len(s.outputs))
+	for i, output := range s.outputs {
+		stats[i] = FanOutOutputStats{
+			Written:  atomic.LoadInt64(&output.written),
+			Failed:   atomic.LoadInt64(&output.failed),
+			Dropped:  atomic.LoadInt64(&output.dropped),
+			Filtered: atomic.LoadInt64(&output.filtered),
+		}
+	}
+	return stats
+}
+
+// filter returns the log entries in the batch which should be written to the output's Sink. Log entries which can't be unmarshalled for the
+// Filter to inspect are written regardless
+func (o *fanOutOutput) filter(batch [][]byte) [][]byte {
+	if o.Filter == nil {
+		return batch
+	}
+	filteredBatch := [][]byte{}
+	for _, entry := range batch {
+		logEntry, err := UnmarshalLogEntry(entry)
+		if err == nil && !o.Filter(logEntry) {
+			atomic.AddInt64(&o.filtered, 1)
+			continue
+		}
+		filteredBatch = append(filteredBatch, entry)
+	}
+	return filteredBatch
+}
+
+// worker writes each batch in the output's buffer to its Sink, retrying with a backoff until it succeeds, returns an ErrorBatchNotRetryable,
+// or MaxAttempts is reached
+func (o *fanOutOutput) worker() {
+	defer close(o.stopped)
+	for batch := range o.batches {
+		if o.ctx.Err() != nil {
+			atomic.AddInt64(&o.dropped, int64(len(batch)))
+			continue
+		}
+		if o.write(batch) {
+			atomic.AddInt64(&o.written, int64(len(batch)))
+		} else {
+			atomic.AddInt64(&o.failed, int64(len(batch)))
+		}
+	}
+}
+
+// write makes up to MaxAttempts attempts to write a batch to the output's Sink, returning true if one succeeds
+func (o *fanOutOutput) write(batch [][]byte) bool {
+	for attempt := 1; attempt <= o.MaxAttempts; attempt++ {
+		err := o.Sink.Write(o.ctx, batch)
+		if err == nil {
+			return true
+		}
+		var notRetryable ErrorBatchNotRetryable
+		if errors.As(err, &notRetryable) || attempt == o.MaxAttempts {
+			return false
+		}
+		delay := o.backoff.delay(attempt)
+		var retryAfter ErrorBatchRetryAfter
+		if errors.As(err, &retryAfter) {
+			delay = retryAfter.RetryAfter
+		}
+		if !sleep(delay, o.ctx.Done()) {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSink is a Sink which records the batches written to it, optionally failing or blocking
+type testSink struct {
+	mutex   sync.Mutex
+	batches [][][]byte
+	write   func(ctx context.Context, attempt int) error
+	writes  int
+	closed  bool
+}
+
+func (s *testSink) Write(ctx context.Context, batch [][]byte) error {
+	s.mutex.Lock()
+	s.writes++
+	writes := s.writes
+	s.mutex.Unlock()
+	if s.write != nil {
+		if err := s.write(ctx, writes); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *testSink) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
+
+func testLogEntryBytes(t *testing.T, statusCode int64) []byte {
+	entry, err := (&LogEntry{Response: Response{StatusCode: statusCode}}).Marshal()
+	require.Nil(t, err)
+	return entry
+}
+
+func TestFanOutSinkWritesToEverySink(t *testing.T) {
+	firstSink, secondSink := &testSink{}, &testSink{}
+	sink := NewFanOutSink(FanOutOutput{Sink: firstSink}, FanOutOutput{Sink: secondSink})
+
+	batch := [][]byte{testLogEntryBytes(t, 200)}
+	require.Nil(t, sink.Write(context.Background(), batch))
+	require.Nil(t, sink.Close(context.Background()))
+
+	for _, s := range []*testSink{firstSink, secondSink} {
+		assert.Equal(t, [][][]byte{batch}, s.batches)
+		assert.True(t, s.closed)
+	}
+	assert.Equal(t, []FanOutOutputStats{{Written: 1}, {Written: 1}}, sink.Stats())
+
+	assert.IsType(t, ErrorBatchNotRetryable{}, sink.Write(context.Background(), batch))
+}
+
+func TestFanOutSinkFiltersEntries(t *testing.T) {
+	allSink, serverErrorSink := &testSink{}, &testSink{}
+	sink := NewFanOutSink(
+		FanOutOutput{Sink: allSink},
+		FanOutOutput{
+			Sink:   serverErrorSink,
+			Filter: func(logEntry LogEntry) bool { return logEntry.Response.StatusCode >= 500 },
+		},
+	)
+
+	batch := [][]byte{testLogEntryBytes(t, 200), testLogEntryBytes(t, 503), testLogEntryBytes(t, 404)}
+	require.Nil(t, sink.Write(context.Background(), batch))
+	// A batch with no entries that pass the filter shouldn't be written to the sink at all
+	require.Nil(t, sink.Write(context.Background(), [][]byte{testLogEntryBytes(t, 200)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	assert.Equal(t, 2, len(allSink.batches))
+	assert.Equal(t, [][][]byte{{testLogEntryBytes(t, 503)}}, serverErrorSink.batches)
+	assert.Equal(t, []FanOutOutputStats{{Written: 4}, {Written: 1, Filtered: 3}}, sink.Stats())
+}
+
+func TestFanOutSinkRetriesIndependently(t *testing.T) {
+	workingSink := &testSink{}
+	flakySink := &testSink{write: func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			return errors.New("test error")
+		}
+		return nil
+	}}
+	brokenSink := &testSink{write: func(ctx context.Context, attempt int) error {
+		return ErrorBatchNotRetryable{errors.New("test error")}
+	}}
+	sink := NewFanOutSink(
+		FanOutOutput{Sink: workingSink},
+		FanOutOutput{Sink: flakySink, RetryBackoff: time.Millisecond},
+		FanOutOutput{Sink: brokenSink, RetryBackoff: time.Millisecond},
+	)
+
+	require.Nil(t, sink.Write(context.Background(), [][]byte{testLogEntryBytes(t, 200)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	assert.Equal(t, []FanOutOutputStats{{Written: 1}, {Written: 1}, {Failed: 1}}, sink.Stats())
+	assert.Equal(t, 2, flakySink.writes)
+	assert.Equal(t, 1, brokenSink.writes)
+}
+
+func TestFanOutSinkBufferIsBounded(t *testing.T) {
+	unblock := make(chan struct{})
+	blockedSink := &testSink{write: func(ctx context.Context, attempt int) error {
+		select {
+		case <-unblock:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+	workingSink := &testSink{}
+	sink := NewFanOutSink(FanOutOutput{Sink: blockedSink, BufferSize: 2}, FanOutOutput{Sink: workingSink})
+
+	// The blocked sink's worker takes the first batch, its buffer holds the next two, & the rest are dropped for it
+	for i := 0; i < 5; i++ {
+		require.Nil(t, sink.Write(context.Background(), [][]byte{testLogEntryBytes(t, 200)}))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(2), sink.Stats()[0].Dropped)
+
+	// If Close's context is done before the blocked sink catches up, the batches left in its buffer are dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, sink.Close(ctx))
+	close(unblock)
+
+	assert.Equal(t, FanOutOutputStats{Failed: 1, Dropped: 4}, sink.Stats()[0])
+	assert.Equal(t, FanOutOutputStats{Written: 5}, sink.Stats()[1])
+	assert.Equal(t, 5, len(workingSink.batches))
+}
+
+func TestFanOutSinkWithWriterSink(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	sink := NewFanOutSink(FanOutOutput{Sink: NewWriterSink(buffer)})
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"id":1}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+	assert.Equal(t, "{\"id\":1}\n", buffer.String())
+}
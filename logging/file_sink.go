@@ -0,0 +1,302 @@
+package logging
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedFileTimeFormat is the format of the rotation time appended to the names of rotated files, which sorts lexically
+const rotatedFileTimeFormat = "20060102T150405.000000000"
+
+// FileSyncPolicy determines how often a FileSink calls fsync on the file it's writing to
+type FileSyncPolicy int
+
+const (
+	// The file is only synced when it's rotated or closed
+	SyncOnRotate FileSyncPolicy = iota
+
+	// The file is synced after every batch is written to it
+	SyncEveryBatch
+
+	// The file is synced after a batch is written to it if it hasn't been synced for the FileSinkOptions' SyncInterval
+	SyncPeriodically
+)
+
+// FileSinkOptions is an options struct used by the NewFileSink constructor
+type FileSinkOptions struct {
+	Path             string         // The path of the file to which log entries are appended; it's created if it doesn't exist
+	MaxSize          int64          // The size in bytes beyond which the file is rotated before the next batch is written; if zero, the file isn't rotated by size
+	RotationInterval time.Duration  // How long after the file was created a batch must be written to it for it to be rotated first; if zero, the file isn't rotated by age
+	MaxFiles         int            // The maximum number of rotated files to keep, beyond which the oldest are deleted; if zero, all rotated files are kept
+	Compress         bool           // If true, rotated files are compressed with gzip
+	SyncPolicy       FileSyncPolicy // How often the file is synced to disk; defaults to SyncOnRotate
+	SyncInterval     time.Duration  // How often the file is synced if SyncPolicy is SyncPeriodically; defaults to 1s
+}
+
+// A FileSink is a Sink which appends batches of log entries to a local file as newline-delimited JSON, in the same format they're sent
+// to the Firetail logging API. When the file is rotated, it's renamed with the time of its rotation appended to its path, e.g.
+// firetail.jsonl.20060102T150405.000000000, and optionally compressed with gzip. Several FileSinks created for the same path in one process
+// share the same file, so they can be used safely by several middlewares at once; the file is closed once all of them have been closed,
+// and the options given when the first of them was created are used
+type FileSink struct {
+	file      *rotatingFile
+	closeOnce sync.Once
+}
+
+var (
+	openFilesMutex sync.Mutex
+	openFiles      = map[string]*rotatingFile{} // The rotatingFiles currently open, by absolute path
+)
+
+// NewFileSink opens the file at the path given by the options for appending, creating it if it doesn't exist
+func NewFileSink(options FileSinkOptions) (*FileSink, error) {
+	path, err := filepath.Abs(options.Path)
+	if err != nil {
+		return nil, err
+	}
+	options.Path = path
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+
+	openFilesMutex.Lock()
+	defer openFilesMutex.Unlock()
+
+	file, isOpen := openFiles[path]
+	if !isOpen {
+		file = &rotatingFile{options: options}
+		if err := file.open(); err != nil {
+			return nil, err
+		}
+		openFiles[path] = file
+	}
+	file.references++
+	return &FileSink{file: file}, nil
+}
+
+// Write implements Sink
+func (s *FileSink) Write(ctx context.Context, batch [][]byte) error {
+	return s.file.write(joinBatch(batch))
+}
+
+// Close implements Sink. If this is the last open FileSink for its path, the file is synced & closed, and Close waits for any rotated files
+// to finish being compressed
+func (s *FileSink) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		openFilesMutex.Lock()
+		s.file.references--
+		isLastReference := s.file.references == 0
+		if isLastReference {
+			delete(openFiles, s.file.options.Path)
+		}
+		openFilesMutex.Unlock()
+
+		if isLastReference {
+			err = s.file.close()
+		}
+	})
+	return err
+}
+
+// rotatingFile is the file underlying one or more FileSinks
+type rotatingFile struct {
+	mutex       sync.Mutex
+	options     FileSinkOptions
+	references  int // The number of open FileSinks using the rotatingFile; guarded by openFilesMutex
+	file        *os.File
+	size        int64
+	createdAt   time.Time
+	lastSynced  time.Time
+	compressing sync.WaitGroup // Tracks the rotated files currently being compressed
+	pruneMutex  sync.Mutex     // Held whilst a rotated file is compressed & the oldest rotated files are pruned, so they're done one at a time
+	closed      bool
+}
+
+// open opens the file for appending. If it already exists & isn't empty, the time it was last modified is used as the time it was created,
+// so that it's rotated by age as soon as it's written to if it's too old. It must be called with the mutex held or before the file is shared
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.options.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = fileInfo.Size()
+	f.createdAt = time.Now()
+	if f.size > 0 {
+		f.createdAt = fileInfo.ModTime()
+	}
+	f.lastSynced = time.Now()
+	return nil
+}
+
+// write appends b to the file, rotating it first if necessary
+func (f *rotatingFile) write(b []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return ErrorBatchNotRetryable{ErrSinkClosed}
+	}
+	if f.shouldRotate(len(b)) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if f.options.SyncPolicy == SyncEveryBatch || (f.options.SyncPolicy == SyncPeriodically && time.Since(f.lastSynced) >= f.options.SyncInterval) {
+		f.lastSynced = time.Now()
+		return f.file.Sync()
+	}
+	return nil
+}
+
+// shouldRotate returns true if the file needs to be rotated before writeSize bytes are written to it. Empty files are never rotated, so
+// a batch bigger than MaxSize is written to a file of its own. It must be called with the mutex held
+func (f *rotatingFile) shouldRotate(writeSize int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.options.MaxSize > 0 && f.size+int64(writeSize) > f.options.MaxSize {
+		return true
+	}
+	return f.options.RotationInterval > 0 && time.Since(f.createdAt) >= f.options.RotationInterval
+}
+
+// rotate syncs & closes the file, renames it, opens a new file in its place, & then compresses the rotated file & deletes the oldest rotated
+// files in the background. It must be called with the mutex held
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotatedPath := f.options.Path + "." + time.Now().UTC().Format(rotatedFileTimeFormat)
+	renameErr := os.Rename(f.options.Path, rotatedPath)
+	// Even if the rename failed, we need to reopen the file so we can keep writing to it
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+		f.pruneMutex.Lock()
+		defer f.pruneMutex.Unlock()
+		if f.options.Compress {
+			compressFile(rotatedPath)
+		}
+		f.pruneRotatedFiles()
+	}()
+	return nil
+}
+
+// pruneRotatedFiles deletes the oldest rotated files until there are at most MaxFiles. Only files named like the rotated files this sink
+// writes, i.e. the path followed by a rotation time & optionally .gz, are counted, so other files that happen to share the path's prefix,
+// such as backups or lock files, are never deleted
+func (f *rotatingFile) pruneRotatedFiles() {
+	if f.options.MaxFiles <= 0 {
+		return
+	}
+	dirEntries, err := os.ReadDir(filepath.Dir(f.options.Path))
+	if err != nil {
+		return
+	}
+	// Compressed files which are still being written have a .tmp suffix & aren't counted
+	kept := []string{}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() && isRotatedFileName(filepath.Base(f.options.Path), dirEntry.Name()) {
+			kept = append(kept, filepath.Join(filepath.Dir(f.options.Path), dirEntry.Name()))
+		}
+	}
+	// The rotation time in each file's name sorts lexically
+	sort.Strings(kept)
+	for len(kept) > f.options.MaxFiles {
+		os.Remove(kept[0])
+		kept = kept[1:]
+	}
+}
+
+// isRotatedFileName returns true if name is the name of a file rotated from the file named baseName, e.g. firetail.jsonl.20230102T150405.000000000
+// or firetail.jsonl.20230102T150405.000000000.gz
+func isRotatedFileName(baseName string, name string) bool {
+	if !strings.HasPrefix(name, baseName+".") {
+		return false
+	}
+	rotationTime := strings.TrimSuffix(strings.TrimPrefix(name, baseName+"."), ".gz")
+	if len(rotationTime) != len(rotatedFileTimeFormat) {
+		return false
+	}
+	_, err := time.Parse(rotatedFileTimeFormat, rotationTime)
+	return err == nil
+}
+
+// close syncs & closes the file, then waits for any rotated files to be compressed
+func (f *rotatingFile) close() error {
+	f.mutex.Lock()
+	f.closed = true
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.mutex.Unlock()
+	f.compressing.Wait()
+	return err
+}
+
+// compressFile compresses the file at path with gzip, replacing it with a file of the same name with a .gz suffix. If it fails, the
+// uncompressed file is left in place
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	temporaryPath := path + ".gz.tmp"
+	destination, err := os.OpenFile(temporaryPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(destination)
+	_, err = io.Copy(gzipWriter, source)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err == nil {
+		err = destination.Sync()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, path+".gz")
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return os.Remove(path)
+}
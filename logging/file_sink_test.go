@@ -0,0 +1,266 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getRotatedFiles returns the paths of the files rotated from path, oldest first
+func getRotatedFiles(t *testing.T, path string) []string {
+	candidatePaths, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	rotatedPaths := []string{}
+	for _, candidatePath := range candidatePaths {
+		if isRotatedFileName(filepath.Base(path), filepath.Base(candidatePath)) {
+			rotatedPaths = append(rotatedPaths, candidatePath)
+		}
+	}
+	sort.Strings(rotatedPaths)
+	return rotatedPaths
+}
+
+// readRotatedFile reads a rotated file, decompressing it if it has a .gz suffix
+func readRotatedFile(t *testing.T, path string) []byte {
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		require.Nil(t, err)
+		reader = gzipReader
+	}
+	contents, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	return contents
+}
+
+func TestFileSinkAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	require.Nil(t, os.WriteFile(path, []byte("{\"existing\":true}\n"), 0600))
+
+	sink, err := NewFileSink(FileSinkOptions{Path: path})
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"existing":false}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"existing\":true}\n{\"existing\":false}\n", string(contents))
+	assert.Empty(t, getRotatedFiles(t, path))
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 20})
+	require.Nil(t, err)
+
+	// Each batch is 16 bytes, so every batch after the first should go in a new file
+	for i := 0; i < 3; i++ {
+		require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"batch":false}`)}))
+	}
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 2, len(rotatedPaths))
+	for _, rotatedPath := range append(rotatedPaths, path) {
+		assert.Equal(t, "{\"batch\":false}\n", string(readRotatedFile(t, rotatedPath)))
+	}
+}
+
+func TestFileSinkWritesOversizedBatchToOwnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 4})
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"oversized":true}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"oversized\":true}\n", string(contents))
+	assert.Empty(t, getRotatedFiles(t, path))
+}
+
+func TestFileSinkRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, RotationInterval: 50 * time.Millisecond})
+	require.Nil(t, err)
+
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"first":true}`)}))
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"first":true}`)}))
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"first":false}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 1, len(rotatedPaths))
+	assert.Equal(t, "{\"first\":true}\n{\"first\":true}\n", string(readRotatedFile(t, rotatedPaths[0])))
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"first\":false}\n", string(contents))
+}
+
+func TestFileSinkRotatesOldExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	require.Nil(t, os.WriteFile(path, []byte("{\"existing\":true}\n"), 0600))
+	lastModified := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(path, lastModified, lastModified))
+
+	sink, err := NewFileSink(FileSinkOptions{Path: path, RotationInterval: time.Minute})
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"existing":false}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 1, len(rotatedPaths))
+	assert.Equal(t, "{\"existing\":true}\n", string(readRotatedFile(t, rotatedPaths[0])))
+}
+
+func TestFileSinkCompressesRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 20, Compress: true})
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"batch":false}`)}))
+	}
+	// Close should wait for the rotated files to be compressed
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 2, len(rotatedPaths))
+	for _, rotatedPath := range rotatedPaths {
+		assert.True(t, strings.HasSuffix(rotatedPath, ".gz"))
+		assert.Equal(t, "{\"batch\":false}\n", string(readRotatedFile(t, rotatedPath)))
+	}
+}
+
+func TestFileSinkDeletesOldestRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 2, MaxFiles: 2, Compress: true})
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte{'0' + byte(i)}}))
+	}
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 2, len(rotatedPaths))
+	assert.Equal(t, "2\n", string(readRotatedFile(t, rotatedPaths[0])))
+	assert.Equal(t, "3\n", string(readRotatedFile(t, rotatedPaths[1])))
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "4\n", string(contents))
+}
+
+func TestFileSinkOnlyDeletesItsOwnRotatedFiles(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "firetail.jsonl")
+	// These share the log file's prefix, & the first sorts before any rotated file, but neither was written by the sink
+	siblingPaths := []string{path + ".1.bak", path + ".lock"}
+	for _, siblingPath := range siblingPaths {
+		require.Nil(t, os.WriteFile(siblingPath, []byte("not a log file"), 0600))
+	}
+
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 2, MaxFiles: 1})
+	require.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte{'0' + byte(i)}}))
+	}
+	require.Nil(t, sink.Close(context.Background()))
+
+	rotatedPaths := getRotatedFiles(t, path)
+	require.Equal(t, 1, len(rotatedPaths))
+	assert.Equal(t, "2\n", string(readRotatedFile(t, rotatedPaths[0])))
+	for _, siblingPath := range siblingPaths {
+		contents, err := os.ReadFile(siblingPath)
+		require.Nil(t, err)
+		assert.Equal(t, "not a log file", string(contents))
+	}
+}
+
+func TestIsRotatedFileName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"firetail.jsonl.20230102T150405.000000000":        true,
+		"firetail.jsonl.20230102T150405.000000000.gz":     true,
+		"firetail.jsonl.20230102T150405.000000000.gz.tmp": false,
+		"firetail.jsonl.bak":                              false,
+		"firetail.jsonl.lock":                             false,
+		"firetail.jsonl.20231302T150405.000000000":        false,
+		"firetail.jsonl":                                  false,
+		"other.jsonl.20230102T150405.000000000":           false,
+	} {
+		assert.Equal(t, expected, isRotatedFileName("firetail.jsonl", name), name)
+	}
+}
+
+func TestFileSinkSyncPolicies(t *testing.T) {
+	for _, syncPolicy := range []FileSyncPolicy{SyncOnRotate, SyncEveryBatch, SyncPeriodically} {
+		path := filepath.Join(t.TempDir(), "firetail.jsonl")
+		sink, err := NewFileSink(FileSinkOptions{Path: path, SyncPolicy: syncPolicy, SyncInterval: time.Nanosecond})
+		require.Nil(t, err)
+		require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{}`)}))
+		require.Nil(t, sink.Close(context.Background()))
+
+		contents, err := os.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, "{}\n", string(contents))
+	}
+}
+
+func TestFileSinksShareFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sinks := []*FileSink{}
+	for i := 0; i < 3; i++ {
+		sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 1024})
+		require.Nil(t, err)
+		sinks = append(sinks, sink)
+	}
+	assert.Same(t, sinks[0].file, sinks[1].file)
+	assert.Same(t, sinks[0].file, sinks[2].file)
+
+	wg := sync.WaitGroup{}
+	for _, sink := range sinks {
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(sink *FileSink) {
+				defer wg.Done()
+				assert.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"first":true}`), []byte(`{"first":false}`)}))
+			}(sink)
+		}
+	}
+	wg.Wait()
+
+	// Closing all but the last sink shouldn't close the file
+	require.Nil(t, sinks[0].Close(context.Background()))
+	require.Nil(t, sinks[1].Close(context.Background()))
+	require.Nil(t, sinks[2].Write(context.Background(), [][]byte{[]byte(`{"first":true}`), []byte(`{"first":false}`)}))
+	require.Nil(t, sinks[2].Close(context.Background()))
+	assert.IsType(t, ErrorBatchNotRetryable{}, sinks[2].Write(context.Background(), [][]byte{[]byte(`{}`)}))
+
+	// Every batch should be intact, in either the file or one of its rotations
+	contents := []byte{}
+	for _, rotatedPath := range append(getRotatedFiles(t, path), path) {
+		rotatedContents := readRotatedFile(t, rotatedPath)
+		assert.LessOrEqual(t, len(rotatedContents), 1024)
+		contents = append(contents, rotatedContents...)
+	}
+	assert.Equal(t, bytes.Repeat([]byte("{\"first\":true}\n{\"first\":false}\n"), 301), contents)
+
+	// A new sink for the same path should reopen the file
+	sink, err := NewFileSink(FileSinkOptions{Path: path})
+	require.Nil(t, err)
+	assert.NotSame(t, sinks[0].file, sink.file)
+	require.Nil(t, sink.Close(context.Background()))
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorFiretailApiResponse is returned by the Firetail Sink when the Firetail logging API responds to a batch with anything other than a
+// success message
+type ErrorFiretailApiResponse struct {
+	StatusCode int                    // The status code of the response
+	Body       map[string]interface{} // The decoded response body, which is nil if it wasn't a JSON object
+}
+
+func (e ErrorFiretailApiResponse) Error() string {
+	return fmt.Sprintf("got err response from firetail api with status code %d: %v", e.StatusCode, e.Body)
+}
+
+// FiretailSinkOptions is an options struct used by the NewFiretailSink constructor
+type FiretailSinkOptions struct {
+	LogApiKey       string            // The API key used to send logs to the Firetail logging API; if empty, batches are discarded
+	LogApiUrl       string            // The URL of the Firetail logging API endpoint to send log entries to; if empty, batches are discarded
+	Compression     Compression       // The Content-Encoding used to compress batches; defaults to NoCompression
+	HTTPClient      *http.Client      // An optional client used to send requests; if set, Transport & TLSClientConfig are ignored
+	Transport       http.RoundTripper // An optional RoundTripper used if HTTPClient is nil, e.g. to route requests through a proxy; if set, TLSClientConfig is ignored
+	TLSClientConfig *tls.Config       // An optional TLS config, e.g. to trust a private CA or present client certificates for mTLS
+	RequestTimeout  time.Duration     // The maximum time to wait for each request; defaults to 30s
+	ExtraHeaders    http.Header       // Additional headers sent with every request
+}
+
+// firetailSink is a Sink which sends batches to the Firetail logging API
+type firetailSink struct {
+	options FiretailSinkOptions
+	client  *http.Client
+}
+
+// NewFiretailSink creates a Sink which sends batches of log entries to the Firetail logging API. Its Write method returns an
+// ErrorBatchNotRetryable if the API rejects a batch with a client error, and an ErrorBatchRetryAfter if the API responds with a 429 or
+// 503 & a Retry-After header
+func NewFiretailSink(options FiretailSinkOptions) Sink {
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = 30 * time.Second
+	}
+	return &firetailSink{
+		options: options,
+		client:  getDefaultHTTPClient(options),
+	}
+}
+
+// Write implements Sink
+func (s *firetailSink) Write(ctx context.Context, batch [][]byte) error {
+	// If there's no log API url or log API key set then we can't log, so just return
+	if s.options.LogApiUrl == "" || s.options.LogApiKey == "" {
+		return nil
+	}
+
+	reqBytes, err := compressPayload(s.options.Compression, joinBatch(batch))
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+
+	// If the request times out, it's treated like any other network error & retried
+	ctx, cancel := context.WithTimeout(ctx, s.options.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.options.LogApiUrl, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+
+	for key, vals := range s.options.ExtraHeaders {
+		for _, val := range vals {
+			req.Header.Add(key, val)
+		}
+	}
+	req.Header.Set("x-ft-api-key", s.options.LogApiKey)
+	if contentEncoding := s.options.Compression.contentEncoding(); contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+	// Drain anything left in the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	if res["message"] == "success" {
+		return nil
+	}
+
+	apiErr := ErrorFiretailApiResponse{StatusCode: resp.StatusCode, Body: res}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		if retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); hasRetryAfter {
+			return ErrorBatchRetryAfter{apiErr, retryAfter}
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout:
+		// Other client errors (e.g. an invalid API key) won't go away if we retry the batch
+		return ErrorBatchNotRetryable{apiErr}
+	}
+	return apiErr
+}
+
+// Close implements Sink, closing any idle connections to the Firetail logging API
+func (s *firetailSink) Close(ctx context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// getDefaultHTTPClient returns the HTTPClient from the options if it's set, otherwise a new client using the Transport from the options or, if
+// that's not set either, a clone of http.DefaultTransport (which uses any proxy set in the environment) with the TLSClientConfig from the options
+func getDefaultHTTPClient(options FiretailSinkOptions) *http.Client {
+	if options.HTTPClient != nil {
+		return options.HTTPClient
+	}
+	if options.Transport != nil {
+		return &http.Client{Transport: options.Transport}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.TLSClientConfig != nil {
+		transport.TLSClientConfig = options.TLSClientConfig
+	}
+	return &http.Client{Transport: transport}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be either a number of seconds or a HTTP date, into a duration
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// Durations too long to represent would overflow, so they're capped; the batchLogger limits them to its MaxRetryAfter anyway
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if retryAt, err := http.ParseTime(value); err == nil {
+		retryAfter := time.Until(retryAt)
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		return retryAfter, true
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// HashOptions configures how the values masked with HashHeaderValues, HashHeader & HashBodyValue are hashed. Values are hashed with
+// HMAC-SHA256 using a secret key, so they can't be brute-forced from the logs without the key, whilst the same value always has the same
+// hash so it can still be correlated across log entries
+type HashOptions struct {
+	// Keys are the secret keys used to hash values. The first key is the current key, which is used to hash every value. Any others are
+	// previous keys, kept after the keys have been rotated so that a Hasher can still find the hashes of values logged before the rotation
+	Keys []HashKey
+
+	// Length is an optional number of hex characters to truncate each hash to, between 8 & 64. Defaults to 64, the full length of the hash
+	Length int
+}
+
+// HashKey is a secret key used to hash values
+type HashKey struct {
+	// ID is an optional identifier for the key. If set, it's prepended to each hash made with the key, followed by a colon, e.g.
+	// "2023-01:5d41402a...", so it's clear which key each hash was made with once the keys have been rotated
+	ID string
+
+	// Secret is the secret key. It should be at least 32 random bytes, loaded from somewhere secure such as an environment variable
+	Secret []byte
+}
+
+// Hasher hashes values in the same way as a sanitiser given the HashOptions it was created from. This can be used to search your logs for a
+// value, such as a leaked API key. The zero value hashes values with an unkeyed SHA-1, like a sanitiser without HashOptions
+type Hasher struct {
+	keys   []HashKey
+	length int
+}
+
+// NewHasher validates the HashOptions & returns a Hasher which hashes values with them. Errs if there are no keys, if any of the keys has no
+// secret, if a key ID is used more than once, or if the Length is invalid
+func NewHasher(options HashOptions) (*Hasher, error) {
+	if len(options.Keys) == 0 {
+		return nil, errors.New("hash options must have at least one key")
+	}
+	keys := make([]HashKey, 0, len(options.Keys))
+	keyIDs := map[string]bool{}
+	for _, key := range options.Keys {
+		if len(key.Secret) == 0 {
+			return nil, fmt.Errorf("hash key %q has no secret", key.ID)
+		}
+		if keyIDs[key.ID] {
+			return nil, fmt.Errorf("hash key ID %q is used more than once", key.ID)
+		}
+		keyIDs[key.ID] = true
+		// The secrets are copied so the Hasher isn't affected if the options are modified after it's created
+		keys = append(keys, HashKey{ID: key.ID, Secret: append([]byte{}, key.Secret...)})
+	}
+	length := options.Length
+	if length == 0 {
+		length = sha256.Size * 2
+	}
+	if length < 8 || length > sha256.Size*2 {
+		return nil, fmt.Errorf("hash length must be between 8 and %d, not %d", sha256.Size*2, length)
+	}
+	return &Hasher{keys: keys, length: length}, nil
+}
+
+// Hash returns the hash of a value made with the current key, as it would appear in a sanitised log entry
+func (h Hasher) Hash(value string) string {
+	if len(h.keys) == 0 {
+		return hashString(value)
+	}
+	return h.hashWithKey(h.keys[0], value)
+}
+
+// Hashes returns the hashes of a value made with each of the keys, including previous keys, so the value can be found in log entries
+// sanitised before & after the keys were rotated
+func (h Hasher) Hashes(value string) []string {
+	if len(h.keys) == 0 {
+		return []string{hashString(value)}
+	}
+	hashes := []string{}
+	for _, key := range h.keys {
+		hashes = append(hashes, h.hashWithKey(key, value))
+	}
+	return hashes
+}
+
+func (h Hasher) hashWithKey(key HashKey, value string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(value)) // A hash.Hash's Write implementation never returns a non-nil err.
+	hash := hex.EncodeToString(mac.Sum(nil))[:h.length]
+	if key.ID != "" {
+		return key.ID + ":" + hash
+	}
+	return hash
+}
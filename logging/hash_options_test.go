@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHMACValue = "The quick brown fox jumps over the lazy dog"
+
+// The HMAC-SHA256 of testHMACValue with the key "key"
+const testHMACHash = "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+
+// newTestHasher creates a Hasher with the options given, failing the test if they're invalid
+func newTestHasher(t *testing.T, options HashOptions) *Hasher {
+	hasher, err := NewHasher(options)
+	require.Nil(t, err)
+	return hasher
+}
+
+func TestHasherHash(t *testing.T) {
+	assert.Equal(t, testHMACHash, newTestHasher(t, HashOptions{Keys: []HashKey{{Secret: []byte("key")}}}).Hash(testHMACValue))
+	assert.Equal(t, "k1:"+testHMACHash, newTestHasher(t, HashOptions{Keys: []HashKey{{ID: "k1", Secret: []byte("key")}}}).Hash(testHMACValue))
+	assert.Equal(t, "k1:f7bc83f4", newTestHasher(t, HashOptions{Keys: []HashKey{{ID: "k1", Secret: []byte("key")}}, Length: 8}).Hash(testHMACValue))
+}
+
+func TestHasherHashes(t *testing.T) {
+	hasher := newTestHasher(t, HashOptions{Keys: []HashKey{
+		{ID: "k2", Secret: []byte("new-key")},
+		{ID: "k1", Secret: []byte("key")},
+	}})
+	hashes := hasher.Hashes(testHMACValue)
+	require.Len(t, hashes, 2)
+	assert.Equal(t, hasher.Hash(testHMACValue), hashes[0])
+	assert.Equal(t, "k1:"+testHMACHash, hashes[1])
+}
+
+func TestHasherIsNotAffectedByModifyingOptions(t *testing.T) {
+	hashOptions := HashOptions{Keys: []HashKey{{Secret: []byte("key")}}}
+	hasher := newTestHasher(t, hashOptions)
+	hashOptions.Keys[0].Secret[0] = 'K'
+	hashOptions.Keys = nil
+	assert.Equal(t, testHMACHash, hasher.Hash(testHMACValue))
+}
+
+func TestZeroHasherIsUnkeyed(t *testing.T) {
+	assert.Equal(t, hashString(testHMACValue), Hasher{}.Hash(testHMACValue))
+	assert.Equal(t, []string{hashString(testHMACValue)}, Hasher{}.Hashes(testHMACValue))
+}
+
+func TestInvalidHashOptions(t *testing.T) {
+	for _, hashOptions := range []HashOptions{
+		{},
+		{Keys: []HashKey{{ID: "k1"}}},
+		{Keys: []HashKey{{ID: "k1", Secret: []byte("key")}, {ID: "k1", Secret: []byte("other-key")}}},
+		{Keys: []HashKey{{Secret: []byte("key")}}, Length: 7},
+		{Keys: []HashKey{{Secret: []byte("key")}}, Length: 65},
+	} {
+		hasher, err := NewHasher(hashOptions)
+		assert.NotNil(t, err)
+		assert.Nil(t, hasher)
+		_, err = NewSanitiser(SanitiserOptions{HashOptions: &hashOptions})
+		assert.NotNil(t, err)
+		assert.Panics(t, func() { GetSanitiser(SanitiserOptions{HashOptions: &hashOptions}) })
+	}
+}
+
+func TestSanitiserUsesHashOptions(t *testing.T) {
+	hashOptions := &HashOptions{Keys: []HashKey{{ID: "k1", Secret: []byte("key")}}, Length: 16}
+	sanitiser := GetSanitiser(SanitiserOptions{
+		RequestHeadersMask:  map[string]HeaderMask{"x-api-key": HashHeaderValues, "x-secret-header": HashHeader},
+		ResponseHeadersMask: map[string]HeaderMask{"set-token": HashHeaderValues},
+		ParameterRules:      []ParameterRule{{In: QueryParameter, Name: "api_key", Mask: HashBodyValue}},
+		RequestBodyRules:    []BodyRule{{Selector: "/apiKey", Mask: HashBodyValue}},
+		HashOptions:         hashOptions,
+	})
+	hasher := newTestHasher(t, *hashOptions)
+	hash := hasher.Hash(testHMACValue)
+
+	// The same value should have the same hash wherever it's found, & in every log entry
+	for i := 0; i < 2; i++ {
+		sanitisedLogEntry := sanitiser(LogEntry{
+			Request: Request{
+				Headers: map[string][]string{"x-api-key": {testHMACValue}, "x-secret-header": {testHMACValue}},
+				URI:     "https://example.com/?api_key=The+quick+brown+fox+jumps+over+the+lazy+dog",
+				Body:    `{"apiKey":"` + testHMACValue + `"}`,
+			},
+			Response: Response{Headers: map[string][]string{"set-token": {testHMACValue}}},
+		})
+		assert.Equal(t, "k1:f7bc83f430538424", hash)
+		assert.Equal(t, map[string][]string{
+			"x-api-key":                    {hash},
+			hasher.Hash("x-secret-header"): {hash},
+		}, sanitisedLogEntry.Request.Headers)
+		assert.Equal(t, "https://example.com/?api_key=k1%3Af7bc83f430538424", sanitisedLogEntry.Request.URI)
+		assert.Equal(t, `{"apiKey":"`+hash+`"}`, sanitisedLogEntry.Request.Body)
+		assert.Equal(t, map[string][]string{"set-token": {hash}}, sanitisedLogEntry.Response.Headers)
+	}
+}
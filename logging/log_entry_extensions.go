@@ -0,0 +1,41 @@
+package logging
+
+import "encoding/json"
+
+// LogEntryExtensions holds the fields this library adds to the log entries described by the firetail logging schema. It's embedded in
+// LogEntry, so its fields are marshalled alongside LogEntry's own. They're all optional & omitted when they're unset, so log entries
+// without them are unchanged & the Version is still 1.0.0-alpha
+type LogEntryExtensions struct {
+	Upgrade     *Upgrade     `json:"upgrade,omitempty"`     // Details of the session if the connection was upgraded to another protocol, e.g. a WebSocket
+	EventStream *EventStream `json:"eventStream,omitempty"` // Details of the stream if the response was a stream of Server-Sent Events
+	Validation  *Validation  `json:"validation,omitempty"`  // The outcome of validating the request & response against the OpenAPI spec, if validation was enabled
+	TraceID     string       `json:"traceId,omitempty"`     // The W3C trace ID propagated with the request in its traceparent header
+	SpanID      string       `json:"spanId,omitempty"`      // The ID of the caller's span, propagated with the request in its traceparent header
+	TraceState  string       `json:"traceState,omitempty"`  // The vendor-specific trace state propagated with the request in its tracestate header
+	RequestID   string       `json:"requestId,omitempty"`   // The ID of the request, read from its request ID header or generated if it didn't have one
+	Metadata    *Metadata    `json:"metadata,omitempty"`    // Information your application added to the log entry whilst handling the request
+}
+
+type Upgrade struct {
+	Protocol      string  `json:"protocol"`       // The protocol the connection was upgraded to, from the request's Upgrade header
+	Duration      float64 `json:"duration"`       // The time the upgraded connection was open for, in milliseconds
+	BytesReceived int64   `json:"bytesReceived"`  // The number of bytes read from the client over the upgraded connection
+	BytesSent     int64   `json:"bytesSent"`      // The number of bytes written to the client over the upgraded connection
+	Open          bool    `json:"open,omitempty"` // True if the connection was still open when the middleware was closed, in which case Duration & the byte counts only cover the time until then
+}
+
+type EventStream struct {
+	EventCount int64 `json:"eventCount"` // The number of events with a data payload that were sent to the client
+	Truncated  bool  `json:"truncated"`  // Whether the transcript of the events in the response body was truncated
+}
+
+type Validation struct {
+	Passed bool   `json:"passed"`          // Whether the request, and the response if it was validated, passed validation
+	Error  string `json:"error,omitempty"` // A description of the error the request or response failed with, if it didn't pass, without the values that failed
+}
+
+type Metadata struct {
+	Principal string                     `json:"principal,omitempty"` // The ID of the user or client the request was made by
+	Tags      []string                   `json:"tags,omitempty"`      // Tags describing the request, e.g. the feature flags enabled for it
+	Fields    map[string]json.RawMessage `json:"fields,omitempty"`    // Custom fields, e.g. a customer ID or the outcome of the request
+}
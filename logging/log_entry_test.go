@@ -1,8 +1,10 @@
 package logging
 
 import (
+	"encoding/json"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -42,3 +44,26 @@ func TestMarshalUnmarshalYieldsSameResult(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, marshalledTestLogEntry, remarshalledTestLogEntry)
 }
+
+func TestLogEntryExtensionsAreMarshalledAlongsideLogEntry(t *testing.T) {
+	testLogEntry := LogEntry{
+		Version: The100Alpha,
+		LogEntryExtensions: LogEntryExtensions{
+			Validation: &Validation{Passed: true},
+			RequestID:  "test-request-id",
+		},
+	}
+
+	marshalledTestLogEntry, err := testLogEntry.Marshal()
+	require.Nil(t, err)
+	var fields map[string]json.RawMessage
+	require.Nil(t, json.Unmarshal(marshalledTestLogEntry, &fields))
+	assert.JSONEq(t, `{"passed":true}`, string(fields["validation"]))
+	assert.JSONEq(t, `"test-request-id"`, string(fields["requestId"]))
+	assert.NotContains(t, fields, "LogEntryExtensions")
+	assert.NotContains(t, fields, "upgrade")
+
+	unmarshalledTestLogEntry, err := UnmarshalLogEntry(marshalledTestLogEntry)
+	require.Nil(t, err)
+	assert.Equal(t, testLogEntry, unmarshalledTestLogEntry)
+}
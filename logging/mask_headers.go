@@ -33,6 +33,11 @@ const (
 )
 
 func MaskHeaders(unmaskedHeaders map[string][]string, headersMask map[string]HeaderMask, isStrict bool) map[string][]string {
+	return maskHeaders(unmaskedHeaders, headersMask, isStrict, hashString)
+}
+
+// maskHeaders applies a headers mask, using hash to hash any header names & values that should be hashed
+func maskHeaders(unmaskedHeaders map[string][]string, headersMask map[string]HeaderMask, isStrict bool, hash func(string) string) map[string][]string {
 	maskedHeaders := map[string][]string{}
 
 	for headerName, headerValues := range unmaskedHeaders {
@@ -61,12 +66,12 @@ func MaskHeaders(unmaskedHeaders map[string][]string, headersMask map[string]Hea
 			break
 
 		case HashHeaderValues:
-			maskedHeaders[headerName] = hashValues(headerValues)
+			maskedHeaders[headerName] = hashValues(headerValues, hash)
 			break
 
 		case HashHeader:
-			hashedHeaderName := hashString(headerName)
-			maskedHeaders[hashedHeaderName] = hashValues(headerValues)
+			hashedHeaderName := hash(headerName)
+			maskedHeaders[hashedHeaderName] = hashValues(headerValues, hash)
 			break
 
 		case RedactJWTSignature:
@@ -94,10 +99,10 @@ func MaskHeaders(unmaskedHeaders map[string][]string, headersMask map[string]Hea
 	return maskedHeaders
 }
 
-func hashValues(values []string) []string {
+func hashValues(values []string, hash func(string) string) []string {
 	hashedValues := []string{}
 	for _, value := range values {
-		hashedValue := hashString(value)
+		hashedValue := hash(value)
 		hashedValues = append(hashedValues, hashedValue)
 	}
 	return hashedValues
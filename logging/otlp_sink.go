@@ -0,0 +1,356 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrorOTLPResponse is returned by the OTLP Sink when an OTLP receiver responds to an export request with anything other than a 2xx
+type ErrorOTLPResponse struct {
+	Signal     string // The signal that was being exported, either "logs" or "traces"
+	StatusCode int    // The status code of the response
+}
+
+func (e ErrorOTLPResponse) Error() string {
+	return fmt.Sprintf("got err response from otlp receiver exporting %s with status code %d", e.Signal, e.StatusCode)
+}
+
+// OTLPSinkOptions is an options struct used by the NewOTLPSink constructor
+type OTLPSinkOptions struct {
+	Endpoint           string            // The base URL of an OTLP/HTTP receiver, e.g. http://localhost:4318; log records are sent to /v1/logs & spans to /v1/traces
+	ServiceName        string            // The service.name resource attribute; defaults to unknown_service
+	ResourceAttributes map[string]string // Additional resource attributes, e.g. deployment.environment
+	ExportSpans        bool              // If true, a server span is also exported for each log entry, carrying the outcome of its validation
+	Compression        Compression       // The Content-Encoding used to compress requests; OTLP receivers are only required to support GzipCompression
+	Headers            http.Header       // Additional headers sent with every request, e.g. for authentication
+	HTTPClient         *http.Client      // An optional client used to send requests; defaults to a client using http.DefaultTransport
+	RequestTimeout     time.Duration     // The maximum time to wait for each request; defaults to 10s
+}
+
+// otlpSink is a Sink which exports log entries to an OTLP/HTTP receiver
+type otlpSink struct {
+	options OTLPSinkOptions
+	client  *http.Client
+}
+
+// NewOTLPSink creates a Sink which exports each log entry as an OpenTelemetry log record, and optionally a span, to an OTLP/HTTP receiver
+// such as the OpenTelemetry collector, encoded as protobuf. Only OTLP/HTTP with the binary protobuf encoding is supported; OTLP/gRPC & the
+// JSON encoding aren't, so the receiver must have its HTTP protocol enabled, which listens on port 4318 by default. Each log record's body
+// is the log entry's JSON, and it's given attributes from the HTTP semantic conventions (http.request.method, url.full,
+// http.response.status_code, http.route etc.). Log records are exported before spans, so if exporting the spans fails & the batch is
+// retried, its log records may be exported more than once
+func NewOTLPSink(options OTLPSinkOptions) Sink {
+	if options.ServiceName == "" {
+		options.ServiceName = "unknown_service"
+	}
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = 10 * time.Second
+	}
+	client := options.HTTPClient
+	if client == nil {
+		client = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+	return &otlpSink{
+		options: options,
+		client:  client,
+	}
+}
+
+// otlpLogEntry is a log entry to be exported, along with the trace context its log record & span, if any, are exported with
+type otlpLogEntry struct {
+	raw          []byte
+	logEntry     LogEntry
+	traceID      []byte
+	spanID       []byte
+	parentSpanID []byte
+}
+
+// Write implements Sink
+func (s *otlpSink) Write(ctx context.Context, batch [][]byte) error {
+	logEntries := make([]otlpLogEntry, 0, len(batch))
+	for _, raw := range batch {
+		logEntry, err := UnmarshalLogEntry(raw)
+		if err != nil {
+			// The batchLogger only passes us marshalled LogEntrys, so this shouldn't happen
+			continue
+		}
+		logEntries = append(logEntries, s.getOTLPLogEntry(raw, logEntry))
+	}
+	if len(logEntries) == 0 {
+		return nil
+	}
+
+	logsRequest, err := s.encodeLogsRequest(logEntries)
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+	if err := s.export(ctx, "logs", logsRequest); err != nil {
+		return err
+	}
+	if !s.options.ExportSpans {
+		return nil
+	}
+	tracesRequest, err := s.encodeTracesRequest(logEntries)
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+	return s.export(ctx, "traces", tracesRequest)
+}
+
+// getOTLPLogEntry determines the trace context a log entry is exported with. If the log entry has a trace ID & span ID propagated from its
+// caller, its span is made a child of the caller's span in the same trace; otherwise, its span is the root of a new trace. If spans aren't
+// being exported, its log record is correlated with the caller's span if it has one
+func (s *otlpSink) getOTLPLogEntry(raw []byte, logEntry LogEntry) otlpLogEntry {
+	entry := otlpLogEntry{raw: raw, logEntry: logEntry}
+	traceID, traceIDErr := hex.DecodeString(logEntry.TraceID)
+	callerSpanID, callerSpanIDErr := hex.DecodeString(logEntry.SpanID)
+	hasTraceContext := traceIDErr == nil && len(traceID) == 16 && callerSpanIDErr == nil && len(callerSpanID) == 8
+
+	if !s.options.ExportSpans {
+		if hasTraceContext {
+			entry.traceID, entry.spanID = traceID, callerSpanID
+		}
+		return entry
+	}
+
+	entry.spanID = make([]byte, 8)
+	rand.Read(entry.spanID)
+	if hasTraceContext {
+		entry.traceID, entry.parentSpanID = traceID, callerSpanID
+	} else {
+		entry.traceID = make([]byte, 16)
+		rand.Read(entry.traceID)
+	}
+	return entry
+}
+
+// Close implements Sink, closing any idle connections to the OTLP receiver
+func (s *otlpSink) Close(ctx context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// export sends an encoded export request for the signal given to the OTLP receiver
+func (s *otlpSink) export(ctx context.Context, signal string, payload []byte) error {
+	reqBytes, err := compressPayload(s.options.Compression, payload)
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.options.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(s.options.Endpoint, "/")+"/v1/"+signal, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return ErrorBatchNotRetryable{err}
+	}
+	for key, vals := range s.options.Headers {
+		for _, val := range vals {
+			req.Header.Add(key, val)
+		}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if contentEncoding := s.options.Compression.contentEncoding(); contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused; a partial success response doesn't tell us anything we can act on
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	// The OTLP spec says which status codes are retryable, & that a Retry-After header should be honoured if they have one
+	otlpErr := ErrorOTLPResponse{Signal: signal, StatusCode: resp.StatusCode}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); hasRetryAfter {
+			return ErrorBatchRetryAfter{otlpErr, retryAfter}
+		}
+		return otlpErr
+	default:
+		return ErrorBatchNotRetryable{otlpErr}
+	}
+}
+
+// otlpScopeName is the name of the InstrumentationScope the log records & spans are exported with
+const otlpScopeName = "github.com/FireTail-io/firetail-go-lib"
+
+// otlpTraceFlagSampled is the W3C trace flag recorded on log records which are correlated with a span, as each span is exported
+const otlpTraceFlagSampled = 1
+
+// encodeLogsRequest encodes an ExportLogsServiceRequest containing a LogRecord for each log entry
+func (s *otlpSink) encodeLogsRequest(logEntries []otlpLogEntry) ([]byte, error) {
+	observedTime := uint64(time.Now().UnixNano())
+	logRecords := make([]*logspb.LogRecord, 0, len(logEntries))
+	for _, entry := range logEntries {
+		severityNumber, severityText := getOTLPSeverity(entry.logEntry)
+		logRecord := &logspb.LogRecord{
+			TimeUnixNano:         uint64(entry.logEntry.DateCreated) * uint64(time.Millisecond),
+			ObservedTimeUnixNano: observedTime,
+			SeverityNumber:       severityNumber,
+			SeverityText:         severityText,
+			Body:                 getOTLPAnyValue(string(entry.raw)),
+			Attributes:           getOTLPAttributes(entry.logEntry),
+		}
+		if entry.traceID != nil {
+			logRecord.Flags = otlpTraceFlagSampled
+			logRecord.TraceId = entry.traceID
+			logRecord.SpanId = entry.spanID
+		}
+		logRecords = append(logRecords, logRecord)
+	}
+	return proto.Marshal(&collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: s.getResource(),
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: otlpScopeName},
+				LogRecords: logRecords,
+			}},
+		}},
+	})
+}
+
+// encodeTracesRequest encodes an ExportTraceServiceRequest containing a server Span for each log entry
+func (s *otlpSink) encodeTracesRequest(logEntries []otlpLogEntry) ([]byte, error) {
+	spans := make([]*tracepb.Span, 0, len(logEntries))
+	for _, entry := range logEntries {
+		startTime := uint64(entry.logEntry.DateCreated) * uint64(time.Millisecond)
+		span := &tracepb.Span{
+			TraceId:           entry.traceID,
+			SpanId:            entry.spanID,
+			Name:              getOTLPSpanName(entry.logEntry),
+			Kind:              tracepb.Span_SPAN_KIND_SERVER,
+			StartTimeUnixNano: startTime,
+			EndTimeUnixNano:   startTime + uint64(entry.logEntry.ExecutionTime*float64(time.Millisecond)),
+			Attributes:        getOTLPAttributes(entry.logEntry),
+			Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_UNSET},
+		}
+		if entry.parentSpanID != nil {
+			span.TraceState = entry.logEntry.TraceState
+			span.ParentSpanId = entry.parentSpanID
+		}
+		// Per the HTTP semantic conventions, only server errors are span errors; validation failures are recorded as attributes
+		if entry.logEntry.Response.StatusCode >= 500 {
+			span.Status.Code = tracepb.Status_STATUS_CODE_ERROR
+		}
+		spans = append(spans, span)
+	}
+	return proto.Marshal(&coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: s.getResource(),
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: otlpScopeName},
+				Spans: spans,
+			}},
+		}},
+	})
+}
+
+// getResource returns the Resource describing the service the log entries came from
+func (s *otlpSink) getResource() *resourcepb.Resource {
+	attributes := []*commonpb.KeyValue{getOTLPAttribute("service.name", s.options.ServiceName)}
+	keys := make([]string, 0, len(s.options.ResourceAttributes))
+	for key := range s.options.ResourceAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attributes = append(attributes, getOTLPAttribute(key, s.options.ResourceAttributes[key]))
+	}
+	return &resourcepb.Resource{Attributes: attributes}
+}
+
+// getOTLPSeverity returns the severity of a log entry's LogRecord, based upon its response status code
+func getOTLPSeverity(logEntry LogEntry) (logspb.SeverityNumber, string) {
+	switch {
+	case logEntry.Response.StatusCode >= 500:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"
+	case logEntry.Response.StatusCode >= 400:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARN"
+	default:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "INFO"
+	}
+}
+
+// getOTLPSpanName returns the name of a log entry's Span, which is its method followed by its route if it has one
+func getOTLPSpanName(logEntry LogEntry) string {
+	if logEntry.Request.Resource == "" {
+		return string(logEntry.Request.Method)
+	}
+	return string(logEntry.Request.Method) + " " + logEntry.Request.Resource
+}
+
+// getOTLPAttributes returns the attributes of a log entry's LogRecord & Span
+func getOTLPAttributes(logEntry LogEntry) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{
+		getOTLPAttribute("http.request.method", string(logEntry.Request.Method)),
+		getOTLPAttribute("url.full", logEntry.Request.URI),
+		getOTLPAttribute("http.response.status_code", logEntry.Response.StatusCode),
+		getOTLPAttribute("firetail.execution_time", logEntry.ExecutionTime),
+	}
+	if logEntry.Request.Resource != "" {
+		attributes = append(attributes, getOTLPAttribute("http.route", logEntry.Request.Resource))
+	}
+	if logEntry.Request.IP != "" {
+		attributes = append(attributes, getOTLPAttribute("client.address", logEntry.Request.IP))
+	}
+	if protocolVersion := strings.TrimPrefix(string(logEntry.Request.HTTPProtocol), "HTTP/"); protocolVersion != "" {
+		attributes = append(attributes, getOTLPAttribute("network.protocol.version", protocolVersion))
+	}
+	if logEntry.RequestID != "" {
+		attributes = append(attributes, getOTLPAttribute("firetail.request_id", logEntry.RequestID))
+	}
+	if logEntry.Metadata != nil && logEntry.Metadata.Principal != "" {
+		attributes = append(attributes, getOTLPAttribute("enduser.id", logEntry.Metadata.Principal))
+	}
+	if logEntry.Validation != nil {
+		attributes = append(attributes, getOTLPAttribute("firetail.validation.passed", logEntry.Validation.Passed))
+		if logEntry.Validation.Error != "" {
+			attributes = append(attributes, getOTLPAttribute("firetail.validation.error", logEntry.Validation.Error))
+		}
+	}
+	return attributes
+}
+
+// getOTLPAttribute returns a KeyValue whose value is a string, int64, float64 or bool
+func getOTLPAttribute(key string, value interface{}) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: getOTLPAnyValue(value)}
+}
+
+// getOTLPAnyValue returns an AnyValue holding a string, int64, float64 or bool
+func getOTLPAnyValue(value interface{}) *commonpb.AnyValue {
+	switch value := value.(type) {
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: value}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}}
+	default:
+		return &commonpb.AnyValue{}
+	}
+}
@@ -0,0 +1,314 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeOTLPLogsRequest unmarshals the body of a request sent to an OTLP receiver's /v1/logs endpoint
+func decodeOTLPLogsRequest(t *testing.T, body []byte) *collogspb.ExportLogsServiceRequest {
+	request := &collogspb.ExportLogsServiceRequest{}
+	require.Nil(t, proto.Unmarshal(body, request))
+	return request
+}
+
+// decodeOTLPTracesRequest unmarshals the body of a request sent to an OTLP receiver's /v1/traces endpoint
+func decodeOTLPTracesRequest(t *testing.T, body []byte) *coltracepb.ExportTraceServiceRequest {
+	request := &coltracepb.ExportTraceServiceRequest{}
+	require.Nil(t, proto.Unmarshal(body, request))
+	return request
+}
+
+// getLogRecords returns the log records in an ExportLogsServiceRequest, which should have one ResourceLogs with one ScopeLogs
+func getLogRecords(t *testing.T, request *collogspb.ExportLogsServiceRequest) []*logspb.LogRecord {
+	require.Len(t, request.ResourceLogs, 1)
+	require.Len(t, request.ResourceLogs[0].ScopeLogs, 1)
+	return request.ResourceLogs[0].ScopeLogs[0].LogRecords
+}
+
+// getSpans returns the spans in an ExportTraceServiceRequest, which should have one ResourceSpans with one ScopeSpans
+func getSpans(t *testing.T, request *coltracepb.ExportTraceServiceRequest) []*tracepb.Span {
+	require.Len(t, request.ResourceSpans, 1)
+	require.Len(t, request.ResourceSpans[0].ScopeSpans, 1)
+	return request.ResourceSpans[0].ScopeSpans[0].Spans
+}
+
+// getOTLPAttributeValues converts a list of KeyValues into a map of attribute keys to their string, bool, int64 or float64 values
+func getOTLPAttributeValues(attributes []*commonpb.KeyValue) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, attribute := range attributes {
+		switch value := attribute.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			values[attribute.Key] = value.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			values[attribute.Key] = value.BoolValue
+		case *commonpb.AnyValue_IntValue:
+			values[attribute.Key] = value.IntValue
+		case *commonpb.AnyValue_DoubleValue:
+			values[attribute.Key] = value.DoubleValue
+		}
+	}
+	return values
+}
+
+// otlpReceiver is a stand-in for an OTLP/HTTP receiver which records the requests it's sent
+type otlpReceiver struct {
+	mutex      sync.Mutex
+	statusCode int
+	requests   map[string][]*http.Request
+	bodies     map[string][][]byte
+}
+
+func setupOTLPReceiver(t *testing.T, statusCode int) (*otlpReceiver, *httptest.Server) {
+	receiver := &otlpReceiver{
+		statusCode: statusCode,
+		requests:   map[string][]*http.Request{},
+		bodies:     map[string][][]byte{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		receiver.mutex.Lock()
+		receiver.requests[r.URL.Path] = append(receiver.requests[r.URL.Path], r)
+		receiver.bodies[r.URL.Path] = append(receiver.bodies[r.URL.Path], body)
+		receiver.mutex.Unlock()
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(receiver.statusCode)
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+var testOTLPLogEntry = LogEntry{
+	DateCreated:   1666356293610,
+	ExecutionTime: 425.5,
+	Request: Request{
+		HTTPProtocol: HTTP11,
+		IP:           "8.8.8.8",
+		Method:       Post,
+		URI:          "http://firetail.io/pets/1",
+		Resource:     "/pets/{id}",
+	},
+	Response: Response{
+		StatusCode: 400,
+	},
+	Version: The100Alpha,
+	LogEntryExtensions: LogEntryExtensions{
+		Validation: &Validation{
+			Passed: false,
+			Error:  "request body invalid",
+		},
+	},
+}
+
+func TestOTLPSinkExportsLogRecords(t *testing.T) {
+	receiver, server := setupOTLPReceiver(t, http.StatusOK)
+	sink := NewOTLPSink(OTLPSinkOptions{
+		Endpoint:           server.URL + "/",
+		ServiceName:        "pet-store",
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+		Headers:            http.Header{"Authorization": {"Bearer token"}},
+	})
+
+	marshalledLogEntry, err := testOTLPLogEntry.Marshal()
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{marshalledLogEntry, marshalledLogEntry}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	// Spans weren't enabled, so only the logs should have been exported
+	require.Equal(t, 1, len(receiver.requests))
+	require.Equal(t, 1, len(receiver.requests["/v1/logs"]))
+	assert.Equal(t, "application/x-protobuf", receiver.requests["/v1/logs"][0].Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", receiver.requests["/v1/logs"][0].Header.Get("Authorization"))
+
+	request := decodeOTLPLogsRequest(t, receiver.bodies["/v1/logs"][0])
+	require.Len(t, request.ResourceLogs, 1)
+	assert.Equal(t, map[string]interface{}{
+		"service.name":           "pet-store",
+		"deployment.environment": "test",
+	}, getOTLPAttributeValues(request.ResourceLogs[0].Resource.Attributes))
+	require.Len(t, request.ResourceLogs[0].ScopeLogs, 1)
+	assert.Equal(t, otlpScopeName, request.ResourceLogs[0].ScopeLogs[0].Scope.Name)
+
+	logRecords := getLogRecords(t, request)
+	require.Equal(t, 2, len(logRecords))
+	for _, logRecord := range logRecords {
+		assert.Equal(t, uint64(1666356293610000000), logRecord.TimeUnixNano)
+		assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_WARN, logRecord.SeverityNumber)
+		assert.Equal(t, "WARN", logRecord.SeverityText)
+		assert.Equal(t, string(marshalledLogEntry), logRecord.Body.GetStringValue())
+		assert.Equal(t, map[string]interface{}{
+			"http.request.method":        "POST",
+			"url.full":                   "http://firetail.io/pets/1",
+			"http.response.status_code":  int64(400),
+			"http.route":                 "/pets/{id}",
+			"client.address":             "8.8.8.8",
+			"network.protocol.version":   "1.1",
+			"firetail.execution_time":    425.5,
+			"firetail.validation.passed": false,
+			"firetail.validation.error":  "request body invalid",
+		}, getOTLPAttributeValues(logRecord.Attributes))
+		assert.Nil(t, logRecord.TraceId)
+		assert.Nil(t, logRecord.SpanId)
+		assert.Equal(t, uint32(0), logRecord.Flags)
+		assert.NotZero(t, logRecord.ObservedTimeUnixNano)
+	}
+}
+
+func TestOTLPSinkExportsSpans(t *testing.T) {
+	receiver, server := setupOTLPReceiver(t, http.StatusOK)
+	sink := NewOTLPSink(OTLPSinkOptions{
+		Endpoint:    server.URL,
+		ExportSpans: true,
+	})
+
+	logEntry := testOTLPLogEntry
+	logEntry.Response.StatusCode = 500
+	marshalledLogEntry, err := logEntry.Marshal()
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{marshalledLogEntry}))
+
+	require.Equal(t, 1, len(receiver.requests["/v1/logs"]))
+	require.Equal(t, 1, len(receiver.requests["/v1/traces"]))
+
+	logRecords := getLogRecords(t, decodeOTLPLogsRequest(t, receiver.bodies["/v1/logs"][0]))
+	require.Len(t, logRecords, 1)
+	logRecord := logRecords[0]
+	assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, logRecord.SeverityNumber)
+
+	tracesRequest := decodeOTLPTracesRequest(t, receiver.bodies["/v1/traces"][0])
+	require.Len(t, tracesRequest.ResourceSpans, 1)
+	assert.Equal(
+		t,
+		map[string]interface{}{"service.name": "unknown_service"},
+		getOTLPAttributeValues(tracesRequest.ResourceSpans[0].Resource.Attributes),
+	)
+	spans := getSpans(t, tracesRequest)
+	require.Equal(t, 1, len(spans))
+	span := spans[0]
+
+	// The log record should be correlated with the span
+	require.Equal(t, 16, len(span.TraceId))
+	require.Equal(t, 8, len(span.SpanId))
+	assert.Equal(t, span.TraceId, logRecord.TraceId)
+	assert.Equal(t, span.SpanId, logRecord.SpanId)
+	assert.Equal(t, uint32(otlpTraceFlagSampled), logRecord.Flags)
+	assert.Nil(t, span.ParentSpanId)
+
+	assert.Equal(t, "POST /pets/{id}", span.Name)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_SERVER, span.Kind)
+	assert.Equal(t, uint64(1666356293610000000), span.StartTimeUnixNano)
+	assert.Equal(t, uint64(1666356293610000000+425500000), span.EndTimeUnixNano)
+	attributes := getOTLPAttributeValues(span.Attributes)
+	assert.Equal(t, false, attributes["firetail.validation.passed"])
+	assert.Equal(t, "request body invalid", attributes["firetail.validation.error"])
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, span.Status.Code)
+}
+
+func TestOTLPSinkUsesPropagatedTraceContext(t *testing.T) {
+	logEntry := testOTLPLogEntry
+	logEntry.TraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	logEntry.SpanID = "00f067aa0ba902b7"
+	logEntry.TraceState = "congo=t61rcWkgMzE"
+	logEntry.RequestID = "test-request-id"
+	logEntry.Metadata = &Metadata{Principal: "test-principal"}
+	marshalledLogEntry, err := logEntry.Marshal()
+	require.Nil(t, err)
+	traceID, err := hex.DecodeString(logEntry.TraceID)
+	require.Nil(t, err)
+	callerSpanID, err := hex.DecodeString(logEntry.SpanID)
+	require.Nil(t, err)
+
+	// Without spans, the log record should be correlated with the caller's span
+	receiver, server := setupOTLPReceiver(t, http.StatusOK)
+	sink := NewOTLPSink(OTLPSinkOptions{Endpoint: server.URL})
+	require.Nil(t, sink.Write(context.Background(), [][]byte{marshalledLogEntry}))
+	logRecord := getLogRecords(t, decodeOTLPLogsRequest(t, receiver.bodies["/v1/logs"][0]))[0]
+	assert.Equal(t, traceID, logRecord.TraceId)
+	assert.Equal(t, callerSpanID, logRecord.SpanId)
+	attributes := getOTLPAttributeValues(logRecord.Attributes)
+	assert.Equal(t, "test-request-id", attributes["firetail.request_id"])
+	assert.Equal(t, "test-principal", attributes["enduser.id"])
+
+	// With spans, the span should be a child of the caller's span & the log record should be correlated with it
+	receiver, server = setupOTLPReceiver(t, http.StatusOK)
+	sink = NewOTLPSink(OTLPSinkOptions{Endpoint: server.URL, ExportSpans: true})
+	require.Nil(t, sink.Write(context.Background(), [][]byte{marshalledLogEntry}))
+	logRecord = getLogRecords(t, decodeOTLPLogsRequest(t, receiver.bodies["/v1/logs"][0]))[0]
+	span := getSpans(t, decodeOTLPTracesRequest(t, receiver.bodies["/v1/traces"][0]))[0]
+	assert.Equal(t, traceID, span.TraceId)
+	assert.NotEqual(t, callerSpanID, span.SpanId)
+	assert.Equal(t, "congo=t61rcWkgMzE", span.TraceState)
+	assert.Equal(t, callerSpanID, span.ParentSpanId)
+	assert.Equal(t, traceID, logRecord.TraceId)
+	assert.Equal(t, span.SpanId, logRecord.SpanId)
+}
+
+func TestOTLPSinkCompression(t *testing.T) {
+	receiver, server := setupOTLPReceiver(t, http.StatusOK)
+	sink := NewOTLPSink(OTLPSinkOptions{
+		Endpoint:    server.URL,
+		Compression: GzipCompression,
+	})
+	marshalledLogEntry, err := testOTLPLogEntry.Marshal()
+	require.Nil(t, err)
+	require.Nil(t, sink.Write(context.Background(), [][]byte{marshalledLogEntry}))
+
+	require.Equal(t, 1, len(receiver.requests["/v1/logs"]))
+	assert.Equal(t, "gzip", receiver.requests["/v1/logs"][0].Header.Get("Content-Encoding"))
+	gzipReader, err := gzip.NewReader(bytes.NewReader(receiver.bodies["/v1/logs"][0]))
+	require.Nil(t, err)
+	decompressed, err := io.ReadAll(gzipReader)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(getLogRecords(t, decodeOTLPLogsRequest(t, decompressed))))
+}
+
+func TestOTLPSinkSkipsInvalidLogEntries(t *testing.T) {
+	receiver, server := setupOTLPReceiver(t, http.StatusOK)
+	sink := NewOTLPSink(OTLPSinkOptions{Endpoint: server.URL})
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte("not json")}))
+	assert.Equal(t, 0, len(receiver.requests))
+}
+
+func TestOTLPSinkErrors(t *testing.T) {
+	for statusCode, expectedErr := range map[int]error{
+		http.StatusBadRequest:          ErrorBatchNotRetryable{ErrorOTLPResponse{"logs", http.StatusBadRequest}},
+		http.StatusInternalServerError: ErrorBatchNotRetryable{ErrorOTLPResponse{"logs", http.StatusInternalServerError}},
+		http.StatusServiceUnavailable:  ErrorBatchRetryAfter{ErrorOTLPResponse{"logs", http.StatusServiceUnavailable}, 5 * time.Second},
+		http.StatusTooManyRequests:     ErrorBatchRetryAfter{ErrorOTLPResponse{"logs", http.StatusTooManyRequests}, 5 * time.Second},
+	} {
+		_, server := setupOTLPReceiver(t, statusCode)
+		sink := NewOTLPSink(OTLPSinkOptions{Endpoint: server.URL})
+		marshalledLogEntry, err := testOTLPLogEntry.Marshal()
+		require.Nil(t, err)
+		assert.Equal(t, expectedErr, sink.Write(context.Background(), [][]byte{marshalledLogEntry}))
+	}
+}
+
+func TestOTLPSinkUnreachableReceiver(t *testing.T) {
+	sink := NewOTLPSink(OTLPSinkOptions{Endpoint: "http://127.0.0.1:0"})
+	marshalledLogEntry, err := testOTLPLogEntry.Marshal()
+	require.Nil(t, err)
+	err = sink.Write(context.Background(), [][]byte{marshalledLogEntry})
+	// Network errors should be retried
+	require.NotNil(t, err)
+	assert.False(t, errors.As(err, &ErrorBatchNotRetryable{}))
+}
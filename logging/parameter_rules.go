@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParameterLocation is where in a request or response the parameter a ParameterRule applies to is found
+type ParameterLocation int
+
+const (
+	// The parameter is a request header. Header names are case insensitive
+	RequestHeaderParameter ParameterLocation = iota
+
+	// The parameter is in the query string of the request's URI. Query parameter names are case insensitive, as they are in the
+	// QueryParamsMask
+	QueryParameter
+
+	// The parameter is a response header. Header names are case insensitive
+	ResponseHeaderParameter
+
+	// The parameter is a segment of the path of the request's URI, named by the resource the request matched in the OpenAPI spec, e.g. the
+	// token in /reset/{token}. Path parameter names are case insensitive, as they are in the PathParamsMask
+	PathParameter
+)
+
+// ParameterRule describes a header or query parameter whose values should be masked before they are reported to Firetail, optionally only
+// for the requests made to a particular resource
+type ParameterRule struct {
+	// In is where the parameter is found
+	In ParameterLocation
+
+	// Name is the name of the header or query parameter
+	Name string
+
+	// Mask determines what happens to each of the parameter's values, as for a BodyRule. RemoveBodyValue removes the parameter entirely.
+	// Defaults to RemoveBodyValue
+	Mask BodyMask
+
+	// Replacement is the value used by ReplaceBodyValue. Defaults to "[REDACTED]"
+	Replacement string
+
+	// TruncateLength is the number of characters TruncateBodyValue truncates values to
+	TruncateLength int
+
+	// Resource optionally restricts the rule to log entries whose request matched this resource in the OpenAPI spec, e.g. "/pets/{id}"
+	Resource string
+
+	// Method optionally restricts the rule to log entries whose request was made with this method, e.g. "POST"
+	Method Method
+}
+
+// validateParameterRules checks the options of a list of ParameterRules & fills in their defaults
+func validateParameterRules(rules []ParameterRule) ([]ParameterRule, error) {
+	validatedRules := []ParameterRule{}
+	for _, rule := range rules {
+		if rule.TruncateLength < 0 {
+			return nil, fmt.Errorf("parameter rule for %q has a negative TruncateLength", rule.Name)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED]"
+		}
+		validatedRules = append(validatedRules, rule)
+	}
+	return validatedRules, nil
+}
+
+// applyParameterRules applies the rules which match the request of a log entry to its headers & URI. Values masked with HashBodyValue are
+// hashed with hash
+func applyParameterRules(logEntry *LogEntry, rules []ParameterRule, hash func(string) string) {
+	for _, rule := range rules {
+		if (rule.Resource != "" && rule.Resource != logEntry.Request.Resource) || (rule.Method != "" && rule.Method != logEntry.Request.Method) {
+			continue
+		}
+		switch rule.In {
+		case RequestHeaderParameter:
+			logEntry.Request.Headers = maskHeaderParameter(logEntry.Request.Headers, rule, hash)
+		case ResponseHeaderParameter:
+			logEntry.Response.Headers = maskHeaderParameter(logEntry.Response.Headers, rule, hash)
+		case QueryParameter:
+			logEntry.Request.URI = maskQueryParameters(logEntry.Request.URI, func(name string, value string) (string, string, bool) {
+				if !strings.EqualFold(name, rule.Name) {
+					return name, value, true
+				}
+				maskedValue, keep := maskParameterValue(value, rule, hash)
+				return name, maskedValue, keep
+			})
+		case PathParameter:
+			logEntry.Request.URI = maskPathParameters(logEntry.Request.URI, logEntry.Request.Resource, func(name string, value string) string {
+				if !strings.EqualFold(name, rule.Name) {
+					return value
+				}
+				// Path segments can't be removed, so they're replaced with the parameter's name from the resource instead
+				if maskedValue, keep := maskParameterValue(value, rule, hash); keep {
+					return maskedValue
+				}
+				return "{" + name + "}"
+			})
+		}
+	}
+}
+
+// maskHeaderParameter returns a copy of headers with the values of the header the rule describes masked
+func maskHeaderParameter(headers map[string][]string, rule ParameterRule, hash func(string) string) map[string][]string {
+	maskedHeaders := make(map[string][]string, len(headers))
+	for headerName, headerValues := range headers {
+		if !strings.EqualFold(headerName, rule.Name) {
+			maskedHeaders[headerName] = headerValues
+			continue
+		}
+		// The values are copied, as the slice may be shared with the request or response
+		maskedValues := []string{}
+		for _, value := range headerValues {
+			if maskedValue, keep := maskParameterValue(value, rule, hash); keep {
+				maskedValues = append(maskedValues, maskedValue)
+			}
+		}
+		if len(maskedValues) > 0 {
+			maskedHeaders[headerName] = maskedValues
+		}
+	}
+	return maskedHeaders
+}
+
+func maskParameterValue(value string, rule ParameterRule, hash func(string) string) (string, bool) {
+	maskedValue, keep := maskValue(value, rule.Mask, rule.Replacement, rule.TruncateLength, hash)
+	if !keep {
+		return "", false
+	}
+	return maskedValue.(string), true
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParameterRulesMaskHeaders(t *testing.T) {
+	requestHeaders := map[string][]string{
+		"X-Session": {"session-1", "session-2"},
+		"X-Other":   {"other"},
+	}
+	logEntry := LogEntry{
+		Request:  Request{Headers: requestHeaders},
+		Response: Response{Headers: map[string][]string{"X-Token": {"response-token"}}},
+	}
+	rules, err := validateParameterRules([]ParameterRule{
+		{In: RequestHeaderParameter, Name: "x-session", Mask: ReplaceBodyValue},
+		{In: ResponseHeaderParameter, Name: "X-TOKEN"},
+	})
+	require.Nil(t, err)
+	applyParameterRules(&logEntry, rules, hashString)
+
+	assert.Equal(t, map[string][]string{"X-Session": {"[REDACTED]", "[REDACTED]"}, "X-Other": {"other"}}, logEntry.Request.Headers)
+	assert.Equal(t, map[string][]string{}, logEntry.Response.Headers)
+
+	// The original headers shouldn't have been modified
+	assert.Equal(t, []string{"session-1", "session-2"}, requestHeaders["X-Session"])
+}
+
+func TestParameterRulesMaskQueryParameters(t *testing.T) {
+	for _, testCase := range []struct {
+		uri         string
+		rule        ParameterRule
+		expectedURI string
+	}{
+		{"https://example.com/reset?user=alice&token=abc&page=1", ParameterRule{In: QueryParameter, Name: "token"}, "https://example.com/reset?user=alice&page=1"},
+		{"https://example.com/reset?token=abc", ParameterRule{In: QueryParameter, Name: "token"}, "https://example.com/reset"},
+		{"https://example.com/reset?token=abc&token=def", ParameterRule{In: QueryParameter, Name: "token", Mask: ReplaceBodyValue, Replacement: "x"}, "https://example.com/reset?token=x&token=x"},
+		{"https://example.com/reset?a+b=c%20d&api%5Fkey=abc%2B", ParameterRule{In: QueryParameter, Name: "api_key", Mask: HashBodyValue}, "https://example.com/reset?a+b=c%20d&api%5Fkey=" + hashString("abc+")},
+		{"https://example.com/reset?card=4111111111111111", ParameterRule{In: QueryParameter, Name: "card", Mask: KeepLastFourOfBodyValue}, "https://example.com/reset?card=%2A%2A%2A%2A%2A%2A%2A%2A%2A%2A%2A%2A1111"},
+		{"https://example.com/reset?token&other", ParameterRule{In: QueryParameter, Name: "token", Mask: ReplaceBodyValue}, "https://example.com/reset?token=%5BREDACTED%5D&other"},
+		{"https://example.com/reset?Token=abc", ParameterRule{In: QueryParameter, Name: "token"}, "https://example.com/reset"},
+		{"https://example.com/reset?token=abc", ParameterRule{In: QueryParameter, Name: "Token"}, "https://example.com/reset"},
+		{"https://example.com/reset", ParameterRule{In: QueryParameter, Name: "token"}, "https://example.com/reset"},
+	} {
+		rules, err := validateParameterRules([]ParameterRule{testCase.rule})
+		require.Nil(t, err)
+		logEntry := LogEntry{Request: Request{URI: testCase.uri}}
+		applyParameterRules(&logEntry, rules, hashString)
+		assert.Equal(t, testCase.expectedURI, logEntry.Request.URI, testCase.uri)
+	}
+}
+
+func TestParameterRulesAreRestrictedByResourceAndMethod(t *testing.T) {
+	rules, err := validateParameterRules([]ParameterRule{
+		{In: QueryParameter, Name: "token", Resource: "/reset", Method: Post},
+	})
+	require.Nil(t, err)
+
+	logEntry := LogEntry{Request: Request{URI: "https://example.com/reset?token=abc", Resource: "/reset", Method: Post}}
+	applyParameterRules(&logEntry, rules, hashString)
+	assert.Equal(t, "https://example.com/reset", logEntry.Request.URI)
+
+	logEntry = LogEntry{Request: Request{URI: "https://example.com/reset?token=abc", Resource: "/reset", Method: Get}}
+	applyParameterRules(&logEntry, rules, hashString)
+	assert.Equal(t, "https://example.com/reset?token=abc", logEntry.Request.URI)
+}
+
+func TestInvalidParameterRules(t *testing.T) {
+	_, err := validateParameterRules([]ParameterRule{{Name: "token", Mask: TruncateBodyValue, TruncateLength: -1}})
+	assert.NotNil(t, err)
+	assert.Panics(t, func() {
+		GetSanitiser(SanitiserOptions{ParameterRules: []ParameterRule{{Name: "token", Mask: TruncateBodyValue, TruncateLength: -1}}})
+	})
+}
+
+func TestParameterRulesMaskPathParameters(t *testing.T) {
+	rules, err := validateParameterRules([]ParameterRule{
+		{In: PathParameter, Name: "token", Mask: HashBodyValue},
+		{In: PathParameter, Name: "id"},
+	})
+	require.Nil(t, err)
+
+	logEntry := LogEntry{Request: Request{URI: "https://example.com/users/1/reset/abc?page=1", Resource: "/users/{id}/reset/{token}"}}
+	applyParameterRules(&logEntry, rules, hashString)
+	assert.Equal(t, "https://example.com/users/{id}/reset/"+hashString("abc")+"?page=1", logEntry.Request.URI)
+
+	// Path parameter names should be matched case insensitively
+	logEntry = LogEntry{Request: Request{URI: "https://example.com/users/1/reset/abc", Resource: "/users/{userId}/reset/{Token}"}}
+	rules, err = validateParameterRules([]ParameterRule{{In: PathParameter, Name: "token", Mask: HashBodyValue}})
+	require.Nil(t, err)
+	applyParameterRules(&logEntry, rules, hashString)
+	assert.Equal(t, "https://example.com/users/1/reset/"+hashString("abc"), logEntry.Request.URI)
+}
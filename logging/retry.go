@@ -0,0 +1,202 @@
+package logging
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrorBatchNotRetryable can be returned by a BatchCallback to stop the batchLogger from passing the batch to it again, for example
+// because the batch was rejected for a reason that won't change if it's retried
+type ErrorBatchNotRetryable struct {
+	Err error
+}
+
+func (e ErrorBatchNotRetryable) Error() string {
+	return fmt.Sprintf("batch not retryable: %s", e.Err.Error())
+}
+
+func (e ErrorBatchNotRetryable) Unwrap() error {
+	return e.Err
+}
+
+// ErrorBatchRetryAfter can be returned by a BatchCallback to ask the batchLogger to wait for a specific duration before passing the batch
+// to it again, for example because the Firetail logging API responded with a Retry-After header. No batches will be passed to the callback
+// until the duration, or the batchLogger's MaxRetryAfter if it's shorter, has elapsed
+type ErrorBatchRetryAfter struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e ErrorBatchRetryAfter) Error() string {
+	return fmt.Sprintf("batch should be retried after %s: %s", e.RetryAfter, e.Err.Error())
+}
+
+func (e ErrorBatchRetryAfter) Unwrap() error {
+	return e.Err
+}
+
+// backoff calculates how long to wait before passing a batch to the callback again, doubling with each attempt from initialBackoff up to
+// maxBackoff. A random jitter of up to half the delay is subtracted so that batches which failed at the same time aren't all retried at once
+type backoff struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	randomMutex    sync.Mutex
+	random         *rand.Rand
+}
+
+func newBackoff(initialBackoff, maxBackoff time.Duration) *backoff {
+	return &backoff{
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// delay returns how long to wait after the given attempt (starting at 1) failed before making the next one
+func (b *backoff) delay(attempt int) time.Duration {
+	delay := b.initialBackoff
+	for i := 1; i < attempt && delay < b.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > b.maxBackoff {
+		delay = b.maxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	b.randomMutex.Lock()
+	defer b.randomMutex.Unlock()
+	return delay - time.Duration(b.random.Int63n(int64(delay)/2+1))
+}
+
+// circuitBreaker stops batches from being passed to the callback whilst it's consistently failing. Once threshold attempts in a row have
+// failed, the breaker trips & no attempts are allowed until the cooldown has elapsed. After that, a single attempt is allowed through; if
+// it succeeds the breaker is reset, otherwise it waits another cooldown
+type circuitBreaker struct {
+	mutex               sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	maxOpenFor          time.Duration // The longest openFor can trip the breaker for, so a bogus Retry-After can't stop every attempt indefinitely
+	consecutiveFailures int
+	tripped             bool
+	openUntil           time.Time     // Whilst tripped, no attempts are allowed until this time
+	probing             bool          // Whether an attempt is currently being allowed through after the cooldown
+	changed             chan struct{} // Closed & replaced whenever a probe finishes, to wake any waiting attempts
+}
+
+func newCircuitBreaker(threshold int, cooldown, maxOpenFor time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		maxOpenFor: maxOpenFor,
+		changed:    make(chan struct{}),
+	}
+}
+
+// allow blocks until the circuitBreaker will allow an attempt to be made, returning false if abandon is closed first
+func (b *circuitBreaker) allow(abandon <-chan struct{}) bool {
+	for {
+		b.mutex.Lock()
+		if !b.tripped {
+			b.mutex.Unlock()
+			return true
+		}
+		wait := time.Until(b.openUntil)
+		if wait <= 0 && !b.probing {
+			b.probing = true
+			b.mutex.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.mutex.Unlock()
+
+		// If there's a probe in progress, we just wait for it to finish
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		abandoned := false
+		select {
+		case <-timeout:
+		case <-changed:
+		case <-abandon:
+			abandoned = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if abandoned {
+			return false
+		}
+	}
+}
+
+// recordSuccess resets the circuitBreaker
+func (b *circuitBreaker) recordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures = 0
+	b.tripped = false
+	b.finishProbe()
+}
+
+// recordFailure trips the circuitBreaker if the threshold of consecutive failures has been reached
+func (b *circuitBreaker) recordFailure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= b.threshold {
+		b.trip(b.cooldown)
+	}
+	b.finishProbe()
+}
+
+// openFor trips the circuitBreaker for at least the duration given, up to its maxOpenFor, regardless of the number of consecutive failures
+func (b *circuitBreaker) openFor(duration time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures++
+	if duration > b.maxOpenFor {
+		duration = b.maxOpenFor
+	}
+	b.trip(duration)
+	b.finishProbe()
+}
+
+// trip must be called with the mutex held
+func (b *circuitBreaker) trip(duration time.Duration) {
+	b.tripped = true
+	if openUntil := time.Now().Add(duration); openUntil.After(b.openUntil) {
+		b.openUntil = openUntil
+	}
+}
+
+// finishProbe must be called with the mutex held
+func (b *circuitBreaker) finishProbe() {
+	if !b.probing {
+		return
+	}
+	b.probing = false
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// sleep waits for the duration given, returning false if abandon is closed first
+func sleep(duration time.Duration, abandon <-chan struct{}) bool {
+	if duration <= 0 {
+		return true
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-abandon:
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffIsExponentialWithJitter(t *testing.T) {
+	backoff := newBackoff(100*time.Millisecond, time.Second)
+
+	for i := 0; i < 100; i++ {
+		for attempt, expectedMax := range map[int]time.Duration{
+			1: 100 * time.Millisecond,
+			2: 200 * time.Millisecond,
+			3: 400 * time.Millisecond,
+			4: 800 * time.Millisecond,
+			5: time.Second,
+			9: time.Second,
+		} {
+			delay := backoff.delay(attempt)
+			assert.LessOrEqual(t, delay, expectedMax)
+			assert.GreaterOrEqual(t, delay, expectedMax/2)
+		}
+	}
+}
+
+func TestCircuitBreakerTripsAfterThreshold(t *testing.T) {
+	breaker := newCircuitBreaker(2, 50*time.Millisecond, time.Minute)
+	abandon := make(chan struct{})
+
+	breaker.recordFailure()
+	require.True(t, breaker.allow(abandon))
+	breaker.recordFailure()
+
+	// The breaker has tripped, so the next attempt should wait for the cooldown
+	startTime := time.Now()
+	require.True(t, breaker.allow(abandon))
+	assert.GreaterOrEqual(t, time.Since(startTime), 50*time.Millisecond)
+
+	// Whilst that attempt is probing, no others should be allowed until it finishes
+	allowed := make(chan bool, 1)
+	go func() {
+		allowed <- breaker.allow(abandon)
+	}()
+	select {
+	case <-allowed:
+		t.Fatal("attempt was allowed whilst the circuit breaker was probing")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the probe succeeds, the waiting attempt should be allowed straight away
+	breaker.recordSuccess()
+	select {
+	case isAllowed := <-allowed:
+		assert.True(t, isAllowed)
+	case <-time.After(time.Second):
+		t.Fatal("attempt was not allowed after the circuit breaker was reset")
+	}
+}
+
+func TestCircuitBreakerCanBeAbandoned(t *testing.T) {
+	breaker := newCircuitBreaker(1, time.Minute, time.Minute)
+	abandon := make(chan struct{})
+
+	breaker.recordFailure()
+	close(abandon)
+	assert.False(t, breaker.allow(abandon))
+}
+
+func TestNotRetryableBatchIsNotRetried(t *testing.T) {
+	attempts := make(chan int, 3)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		RetryBackoff: time.Millisecond,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			attempts <- m.Attempt
+			return ErrorBatchNotRetryable{errors.New("test error")}
+		},
+	})
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Failed)
+	assert.Equal(t, 1, len(attempts))
+}
+
+func TestBatchIsRetriedAfterRetryAfter(t *testing.T) {
+	attemptTimes := make(chan time.Time, 2)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		RetryBackoff: time.Millisecond,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			attemptTimes <- time.Now()
+			if m.Attempt == 1 {
+				return ErrorBatchRetryAfter{errors.New("test error"), 200 * time.Millisecond}
+			}
+			return nil
+		},
+	})
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Close(ctx))
+
+	require.Equal(t, 2, len(attemptTimes))
+	firstAttempt, secondAttempt := <-attemptTimes, <-attemptTimes
+	assert.GreaterOrEqual(t, secondAttempt.Sub(firstAttempt), 200*time.Millisecond)
+}
+
+func TestCircuitBreakerPausesBatches(t *testing.T) {
+	calls := make(chan struct{}, 16)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:            1024 * 512,
+		MaxBatchCount:           1,
+		MaxLogAge:               time.Minute,
+		MaxBatchAttempts:        1,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  time.Minute,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			calls <- struct{}{}
+			return errors.New("test error")
+		},
+	})
+
+	// The first two batches should fail & trip the circuit breaker
+	for i := 0; i < 2; i++ {
+		batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+		<-calls
+		require.Nil(t, batchLogger.Flush(context.Background()))
+	}
+
+	// The third shouldn't be passed to the callback until the cooldown has elapsed, so it's abandoned when Close's context is done
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Unsent)
+	assert.Equal(t, int64(2), err.(ErrorLogEntriesDropped).Failed)
+
+	// Once abandoned, the batch should be counted as failed without ever reaching the callback
+	require.Eventually(t, func() bool {
+		return batchLogger.Stats().FailedEntries == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, len(calls))
+}
@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy determines what happens when a log entry is enqueued while the batch logger's queue is full, e.g. because the Firetail
+// logging API is slow or unreachable & batches can't be sent as fast as log entries are being created. It only applies once the queue has
+// reached its capacity; until then every log entry is enqueued
+type OverflowPolicy int
+
+const (
+	// If the overflow policy is unset, DropOldestOnOverflow is used
+	UnsetOverflowPolicy OverflowPolicy = iota
+
+	// Enqueueing a log entry blocks until there is space for it in the queue
+	BlockOnOverflow
+
+	// The log entry being enqueued is dropped
+	DropNewestOnOverflow
+
+	// The oldest log entry in the queue is dropped to make space for the log entry being enqueued
+	DropOldestOnOverflow
+
+	// The queue holds a uniformly random sample of the log entries enqueued since it became full; each log entry being enqueued either
+	// replaces a randomly chosen log entry in the queue, or is dropped
+	SampleOnOverflow
+)
+
+// ringBuffer is a fixed capacity, concurrency safe FIFO queue of log entries which applies an OverflowPolicy when it's full
+type ringBuffer struct {
+	mutex        sync.Mutex
+	notFull      *sync.Cond    // Signalled whenever an entry is popped or the ringBuffer is closed, for pushes blocked by BlockOnOverflow
+	ready        chan struct{} // Has a value sent to it (without blocking) whenever an entry is pushed
+	entries      []*LogEntry
+	head         int // The index of the oldest entry in entries
+	length       int // The number of entries currently held
+	policy       OverflowPolicy
+	closed       bool  // Once closed, all pushes are dropped
+	overflowSeen int64 // The number of entries pushed since the ringBuffer became full, used by SampleOnOverflow
+	random       *rand.Rand
+	stats        ringBufferStats
+}
+
+type ringBufferStats struct {
+	enqueued        int64 // The number of entries accepted into the ringBuffer
+	droppedOverflow int64 // The number of entries dropped due to the overflow policy
+	droppedClosed   int64 // The number of entries dropped because they were pushed after the ringBuffer was closed
+}
+
+func newRingBuffer(capacity int, policy OverflowPolicy) *ringBuffer {
+	if policy == UnsetOverflowPolicy {
+		policy = DropOldestOnOverflow
+	}
+	buffer := &ringBuffer{
+		ready:   make(chan struct{}, 1),
+		entries: make([]*LogEntry, capacity),
+		policy:  policy,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	buffer.notFull = sync.NewCond(&buffer.mutex)
+	return buffer
+}
+
+// push adds an entry to the ringBuffer, applying its overflow policy if it's full. Returns false if the entry was dropped
+func (b *ringBuffer) push(entry *LogEntry) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.policy == BlockOnOverflow {
+		for !b.closed && b.length == len(b.entries) {
+			b.notFull.Wait()
+		}
+	}
+
+	if b.closed {
+		b.stats.droppedClosed++
+		return false
+	}
+
+	if b.length < len(b.entries) {
+		b.overflowSeen = 0
+		b.entries[(b.head+b.length)%len(b.entries)] = entry
+		b.length++
+		b.stats.enqueued++
+		b.signalReady()
+		return true
+	}
+
+	switch b.policy {
+	case DropOldestOnOverflow:
+		b.entries[b.head] = entry
+		b.head = (b.head + 1) % len(b.entries)
+		b.stats.droppedOverflow++
+		b.stats.enqueued++
+		return true
+
+	case SampleOnOverflow:
+		b.overflowSeen++
+		b.stats.droppedOverflow++
+		// Reservoir sampling; the queue was full with len(b.entries) entries, and we've now seen overflowSeen more
+		if i := b.random.Int63n(int64(len(b.entries)) + b.overflowSeen); i < int64(len(b.entries)) {
+			b.entries[(b.head+int(i))%len(b.entries)] = entry
+			b.stats.enqueued++
+			return true
+		}
+		return false
+
+	default:
+		b.stats.droppedOverflow++
+		return false
+	}
+}
+
+// pop removes & returns the oldest entry in the ringBuffer, or returns false if it's empty
+func (b *ringBuffer) pop() (*LogEntry, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.length == 0 {
+		return nil, false
+	}
+	entry := b.entries[b.head]
+	b.entries[b.head] = nil
+	b.head = (b.head + 1) % len(b.entries)
+	b.length--
+	b.notFull.Signal()
+	return entry, true
+}
+
+// close stops the ringBuffer from accepting any more entries & wakes any pushes blocked by BlockOnOverflow. Entries already in the
+// ringBuffer can still be popped
+func (b *ringBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.notFull.Broadcast()
+}
+
+// len returns the number of entries currently in the ringBuffer
+func (b *ringBuffer) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.length
+}
+
+// getStats returns a copy of the ringBuffer's counters
+func (b *ringBuffer) getStats() ringBufferStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.stats
+}
+
+// signalReady lets the consumer know there's an entry ready to pop, without blocking if it's already been told
+func (b *ringBuffer) signalReady() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fillRingBuffer(t *testing.T, buffer *ringBuffer, count int) []*LogEntry {
+	entries := []*LogEntry{}
+	for i := 0; i < count; i++ {
+		entry := &LogEntry{DateCreated: int64(i)}
+		entries = append(entries, entry)
+		require.True(t, buffer.push(entry))
+	}
+	return entries
+}
+
+func drainRingBuffer(buffer *ringBuffer) []*LogEntry {
+	entries := []*LogEntry{}
+	for {
+		entry, ok := buffer.pop()
+		if !ok {
+			return entries
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func TestRingBufferIsFIFO(t *testing.T) {
+	buffer := newRingBuffer(4, DropNewestOnOverflow)
+
+	// Push & pop a couple first so the head isn't at the start of the underlying slice
+	fillRingBuffer(t, buffer, 2)
+	drainRingBuffer(buffer)
+
+	entries := fillRingBuffer(t, buffer, 4)
+	assert.Equal(t, 4, buffer.len())
+	assert.Equal(t, entries, drainRingBuffer(buffer))
+	assert.Equal(t, 0, buffer.len())
+}
+
+func TestRingBufferDropNewest(t *testing.T) {
+	buffer := newRingBuffer(2, DropNewestOnOverflow)
+	entries := fillRingBuffer(t, buffer, 2)
+
+	assert.False(t, buffer.push(&LogEntry{DateCreated: 2}))
+
+	assert.Equal(t, entries, drainRingBuffer(buffer))
+	assert.Equal(t, ringBufferStats{enqueued: 2, droppedOverflow: 1}, buffer.getStats())
+}
+
+func TestRingBufferDropOldest(t *testing.T) {
+	buffer := newRingBuffer(2, DropOldestOnOverflow)
+	entries := fillRingBuffer(t, buffer, 2)
+
+	newestEntry := &LogEntry{DateCreated: 2}
+	assert.True(t, buffer.push(newestEntry))
+
+	assert.Equal(t, []*LogEntry{entries[1], newestEntry}, drainRingBuffer(buffer))
+	assert.Equal(t, ringBufferStats{enqueued: 3, droppedOverflow: 1}, buffer.getStats())
+}
+
+func TestRingBufferDefaultsToDropOldest(t *testing.T) {
+	buffer := newRingBuffer(2, UnsetOverflowPolicy)
+	assert.Equal(t, DropOldestOnOverflow, buffer.policy)
+}
+
+func TestRingBufferSample(t *testing.T) {
+	const Capacity = 10
+	const OverflowCount = 1000
+
+	buffer := newRingBuffer(Capacity, SampleOnOverflow)
+	fillRingBuffer(t, buffer, Capacity)
+
+	for i := Capacity; i < Capacity+OverflowCount; i++ {
+		buffer.push(&LogEntry{DateCreated: int64(i)})
+	}
+
+	// The buffer should still be full, and every entry pushed after it became full should've been counted as dropped
+	assert.Equal(t, Capacity, buffer.len())
+	stats := buffer.getStats()
+	assert.Equal(t, int64(OverflowCount), stats.droppedOverflow)
+
+	// With 1000 entries competing for 10 spaces, it's vanishingly unlikely that none of the original entries were replaced
+	replacedCount := 0
+	for _, entry := range drainRingBuffer(buffer) {
+		if entry.DateCreated >= Capacity {
+			replacedCount++
+		}
+	}
+	assert.Greater(t, replacedCount, 0)
+	assert.GreaterOrEqual(t, stats.enqueued, int64(Capacity+replacedCount))
+}
+
+func TestRingBufferBlock(t *testing.T) {
+	buffer := newRingBuffer(1, BlockOnOverflow)
+	fillRingBuffer(t, buffer, 1)
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- buffer.push(&LogEntry{DateCreated: 1})
+	}()
+
+	// The push should be blocked until there's space in the buffer
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	entry, ok := buffer.pop()
+	require.True(t, ok)
+	assert.Equal(t, int64(0), entry.DateCreated)
+	assert.True(t, <-pushed)
+}
+
+func TestRingBufferCloseUnblocksPush(t *testing.T) {
+	buffer := newRingBuffer(1, BlockOnOverflow)
+	fillRingBuffer(t, buffer, 1)
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- buffer.push(&LogEntry{DateCreated: 1})
+	}()
+
+	buffer.close()
+	assert.False(t, <-pushed)
+	assert.Equal(t, int64(1), buffer.getStats().droppedClosed)
+
+	// Entries already in the buffer can still be popped
+	assert.Len(t, drainRingBuffer(buffer), 1)
+}
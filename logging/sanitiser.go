@@ -1,5 +1,10 @@
 package logging
 
+import (
+	"fmt"
+	"regexp"
+)
+
 // DefaultSanitiserOptions is an options struct for the default sanitiser provided with Firetail.
 type SanitiserOptions struct {
 	// RequestHeadersMask is a map of header names (lower cased) to HeaderMask values, which can be used to control the request headers reported to Firetail
@@ -14,6 +19,74 @@ type SanitiserOptions struct {
 	// ResponseHeadersMaskStrict is an optional flag which, if set to true, will configure the Firetail middleware to only report response headers explicitly described in the ResponseHeadersMask
 	ResponseHeadersMaskStrict bool
 
+	// RequestCookiesMask is a map of cookie names (case sensitive) to HeaderMask values, which can be used to control each of the cookies in
+	// the Cookie request headers reported to Firetail. PreserveHeader preserves the cookie, RemoveHeader removes it, RemoveHeaderValues
+	// removes its value, HashHeaderValues hashes its value, and HashHeader hashes its name & value. They're applied before the
+	// RequestHeadersMask, so the Cookie header must be preserved by the RequestHeadersMask for them to be visible. Any Set-Cookie request
+	// headers are masked in the same way
+	RequestCookiesMask map[string]HeaderMask
+
+	// RequestCookiesMaskDefault is an optional HeaderMask applied to the cookies which aren't in the RequestCookiesMask, e.g. RemoveHeader to
+	// only report the cookies explicitly described in the RequestCookiesMask, or HashHeaderValues to hash every other cookie's value.
+	// Defaults to preserving them
+	RequestCookiesMaskDefault HeaderMask
+
+	// ResponseCookiesMask is a map of cookie names (case sensitive) to HeaderMask values, which can be used to control the cookies in the
+	// Set-Cookie response headers reported to Firetail, in the same way as the RequestCookiesMask. The attributes of each Set-Cookie header,
+	// such as Secure, HttpOnly & SameSite, are left visible. They're applied before the ResponseHeadersMask. Any Cookie response headers are
+	// masked in the same way
+	ResponseCookiesMask map[string]HeaderMask
+
+	// ResponseCookiesMaskDefault is an optional HeaderMask applied to the cookies which aren't in the ResponseCookiesMask. Defaults to
+	// preserving them
+	ResponseCookiesMaskDefault HeaderMask
+
+	// QueryParamsMask is a map of query parameter names (lower cased) to HeaderMask values, which can be used to control the query parameters
+	// in the request URIs reported to Firetail. RemoveHeader removes the parameter, RemoveHeaderValues removes its value, HashHeaderValues
+	// hashes its value, HashHeader hashes its name & value, and RedactJWTSignature removes the signature from its value if it's a JWT. Query
+	// parameter names are case insensitive, as they are for a ParameterRule, so Token=abc is masked by the mask for token
+	QueryParamsMask map[string]HeaderMask
+
+	// QueryParamsMaskStrict is an optional flag which, if set to true, will configure the Firetail middleware to only report query parameters
+	// explicitly described in the QueryParamsMask
+	QueryParamsMaskStrict bool
+
+	// PathParamsMask is a map of the names (lower cased) of the parameters in the resources of your OpenAPI spec, e.g. token in
+	// /reset/{token}, to HeaderMask values, which can be used to control the path segments in the request URIs reported to Firetail. Path
+	// segments can't be removed, so RemoveHeader & RemoveHeaderValues replace them with the parameter's name, e.g. {token}. HashHeaderValues &
+	// HashHeader hash them. Path parameters can only be masked if the request matched a resource in the OpenAPI spec
+	PathParamsMask map[string]HeaderMask
+
+	// PathParamsMaskStrict is an optional flag which, if set to true, replaces every path parameter not explicitly described in the
+	// PathParamsMask with its name, e.g. {token}
+	PathParamsMaskStrict bool
+
+	// PathSegmentPatterns is an optional list of patterns. Any segment of a request URI's path which matches one of them is hashed, which can
+	// be used to mask secrets embedded in paths when the request didn't match a resource in the OpenAPI spec
+	PathSegmentPatterns []*regexp.Regexp
+
+	// RequestBodyRules are optional rules describing values to mask in JSON request bodies, such as passwords or card numbers, before they
+	// are logged to Firetail. Each request body is only parsed once, no matter how many rules apply to it. Masked bodies are re-encoded, so
+	// their whitespace & the order of their objects' members aren't preserved
+	RequestBodyRules []BodyRule
+
+	// ResponseBodyRules are optional rules describing values to mask in JSON response bodies before they are logged to Firetail
+	ResponseBodyRules []BodyRule
+
+	// ParameterRules are optional rules describing request headers, response headers & query parameters to mask before they are logged to
+	// Firetail. Unlike the header masks, they may be restricted to the requests made to a particular resource. They are applied after the
+	// header masks
+	ParameterRules []ParameterRule
+
+	// RemoveUnparseableBodies is an optional flag which, if set to true, removes any bodies which body rules apply to but which can't be
+	// parsed as JSON, rather than logging them as they are
+	RemoveUnparseableBodies bool
+
+	// HashOptions optionally configures a secret key with which values masked with HashHeaderValues, HashHeader & HashBodyValue are hashed,
+	// using HMAC-SHA256. If nil, they're hashed with an unkeyed SHA-1, which is vulnerable to low entropy values such as short API keys
+	// being brute-forced from the logs
+	HashOptions *HashOptions
+
 	// RequestSanitisationCallback is an optional callback which is given the request body as bytes & returns a stringified request body which
 	// is then logged to Firetail. This is useful for writing custom logic to redact any sensitive data from your request bodies before it is logged
 	// in Firetail.
@@ -26,21 +99,65 @@ type SanitiserOptions struct {
 }
 
 func DefaultSanitiser() func(LogEntry) LogEntry {
+	return GetSanitiser(DefaultSanitiserOptions())
+}
+
+// DefaultSanitiserOptions returns the options used by the DefaultSanitiser, which can be extended & passed to GetSanitiser
+func DefaultSanitiserOptions() SanitiserOptions {
 	// TODO: Create sensible defaults here.
-	return GetSanitiser(SanitiserOptions{
+	return SanitiserOptions{
+		RequestCookiesMaskDefault:  HashHeaderValues,
+		ResponseCookiesMaskDefault: HashHeaderValues,
 		RequestHeadersMask: map[string]HeaderMask{
-			"set-cookie":    HashHeaderValues,
-			"cookie":        HashHeaderValues,
 			"authorization": HashHeaderValues,
 			"x-api-key":     HashHeaderValues,
 			"token":         HashHeaderValues,
 			"api-token":     HashHeaderValues,
 			"api-key":       HashHeaderValues,
 		},
-	})
+		QueryParamsMask: map[string]HeaderMask{
+			"api_key":      HashHeaderValues,
+			"token":        HashHeaderValues,
+			"access_token": HashHeaderValues,
+		},
+	}
 }
 
+// GetSanitiser returns a func which sanitises log entries according to the options provided. It panics if the options are invalid, so
+// NewSanitiser should be used instead if they come from your application's configuration
 func GetSanitiser(options SanitiserOptions) func(LogEntry) LogEntry {
+	sanitiser, err := NewSanitiser(options)
+	if err != nil {
+		panic(err)
+	}
+	return sanitiser
+}
+
+// NewSanitiser returns a func which sanitises log entries according to the options provided. Errs if any of the selectors of the
+// RequestBodyRules or ResponseBodyRules are invalid, if any of the body or parameter rules have a negative TruncateLength, or if the
+// HashOptions are invalid
+func NewSanitiser(options SanitiserOptions) (func(LogEntry) LogEntry, error) {
+	requestBodyRules, err := newBodyRuleSet(options.RequestBodyRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request body rules: %w", err)
+	}
+	responseBodyRules, err := newBodyRuleSet(options.ResponseBodyRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response body rules: %w", err)
+	}
+	parameterRules, err := validateParameterRules(options.ParameterRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter rules: %w", err)
+	}
+	hasher := &Hasher{}
+	if options.HashOptions != nil {
+		hasher, err = NewHasher(*options.HashOptions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash options: %w", err)
+		}
+	}
+	hash := hasher.Hash
+
 	// Fill in zero values for nil options
 	if options.RequestHeadersMask == nil {
 		options.ResponseHeadersMask = map[string]HeaderMask{}
@@ -56,22 +173,43 @@ func GetSanitiser(options SanitiserOptions) func(LogEntry) LogEntry {
 	}
 
 	return func(logEntry LogEntry) LogEntry {
+		// Mask the cookies in the Cookie & Set-Cookie headers before the header masks, which may hash or remove the headers entirely
+		if len(options.RequestCookiesMask) > 0 || options.RequestCookiesMaskDefault != UnsetHeader {
+			logEntry.Request.Headers = maskCookies(
+				logEntry.Request.Headers, options.RequestCookiesMask, options.RequestCookiesMaskDefault, hash,
+			)
+		}
+		if len(options.ResponseCookiesMask) > 0 || options.ResponseCookiesMaskDefault != UnsetHeader {
+			logEntry.Response.Headers = maskCookies(
+				logEntry.Response.Headers, options.ResponseCookiesMask, options.ResponseCookiesMaskDefault, hash,
+			)
+		}
+
 		// If there's a request headers or response headers mask, apply them...
 		if options.RequestHeadersMask != nil {
-			logEntry.Request.Headers = MaskHeaders(
+			logEntry.Request.Headers = maskHeaders(
 				logEntry.Request.Headers,
 				options.RequestHeadersMask,
 				options.RequestHeadersMaskStrict,
+				hash,
 			)
 		}
 		if options.ResponseHeadersMask != nil {
-			logEntry.Response.Headers = MaskHeaders(
+			logEntry.Response.Headers = maskHeaders(
 				logEntry.Response.Headers,
 				options.ResponseHeadersMask,
 				options.ResponseHeadersMaskStrict,
+				hash,
 			)
 		}
 
+		maskURI(&logEntry, &options, hash)
+		applyParameterRules(&logEntry, parameterRules, hash)
+
+		// Apply any body rules before the callbacks, so the callbacks are given the masked bodies
+		logEntry.Request.Body = requestBodyRules.apply(&logEntry, logEntry.Request.Body, options.RemoveUnparseableBodies, hash)
+		logEntry.Response.Body = responseBodyRules.apply(&logEntry, logEntry.Response.Body, options.RemoveUnparseableBodies, hash)
+
 		// If theres a request or response sanitisation callback, apply them...
 		if options.RequestSanitisationCallback != nil {
 			logEntry.Request.Body = options.RequestSanitisationCallback(logEntry.Request.Body)
@@ -81,5 +219,5 @@ func GetSanitiser(options SanitiserOptions) func(LogEntry) LogEntry {
 		}
 
 		return logEntry
-	}
+	}, nil
 }
@@ -11,8 +11,8 @@ func TestDefaultSanitiserHashesRequestHeaders(t *testing.T) {
 	logEntry := LogEntry{
 		Request: Request{
 			Headers: map[string][]string{
-				"set-cookie":    {"set-cookie"},
-				"cookie":        {"cookie"},
+				"set-cookie":    {"session=set-cookie; Path=/"},
+				"cookie":        {"session=cookie; theme=dark"},
 				"authorization": {"authorization"},
 				"x-api-key":     {"x-api-key"},
 				"token":         {"token"},
@@ -23,7 +23,13 @@ func TestDefaultSanitiserHashesRequestHeaders(t *testing.T) {
 	}
 	sanitisedLogEntry := sanitiser(logEntry)
 
+	// The names of the cookies should still be readable, with each of their values hashed separately
+	assert.Equal(t, []string{"session=" + hashString("set-cookie") + "; Path=/"}, sanitisedLogEntry.Request.Headers["set-cookie"])
+	assert.Equal(t, []string{"session=" + hashString("cookie") + "; theme=" + hashString("dark")}, sanitisedLogEntry.Request.Headers["cookie"])
 	for headerName, headerValues := range sanitisedLogEntry.Request.Headers {
+		if headerName == "set-cookie" || headerName == "cookie" {
+			continue
+		}
 		assert.Len(t, headerValues, 1)
 		assert.Equal(t, hashString(headerName), headerValues[0])
 	}
@@ -84,3 +90,76 @@ func TestCustomSanitiserWithNoRequestHeadersMask(t *testing.T) {
 		assert.Equal(t, headerName, headerValues[0])
 	}
 }
+
+func TestSanitiserPreservesCorrelationFields(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{
+		RequestHeadersMask: map[string]HeaderMask{
+			"traceparent":  RemoveHeader,
+			"tracestate":   RemoveHeader,
+			"x-request-id": HashHeaderValues,
+		},
+		RequestHeadersMaskStrict: true,
+	})
+	logEntry := LogEntry{
+		Request: Request{
+			Headers: map[string][]string{
+				"traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				"tracestate":   {"congo=t61rcWkgMzE"},
+				"x-request-id": {"test-request-id"},
+			},
+		},
+		LogEntryExtensions: LogEntryExtensions{
+			TraceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:     "00f067aa0ba902b7",
+			TraceState: "congo=t61rcWkgMzE",
+			RequestID:  "test-request-id",
+		},
+	}
+	sanitisedLogEntry := sanitiser(logEntry)
+
+	assert.Equal(t, map[string][]string{"x-request-id": {hashString("test-request-id")}}, sanitisedLogEntry.Request.Headers)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sanitisedLogEntry.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", sanitisedLogEntry.SpanID)
+	assert.Equal(t, "congo=t61rcWkgMzE", sanitisedLogEntry.TraceState)
+	assert.Equal(t, "test-request-id", sanitisedLogEntry.RequestID)
+}
+
+func TestSanitiserAppliesBodyRulesBeforeCallbacks(t *testing.T) {
+	var callbackRequestBody string
+	sanitiser := GetSanitiser(SanitiserOptions{
+		RequestBodyRules:  []BodyRule{{Selector: "$.password", Mask: ReplaceBodyValue}},
+		ResponseBodyRules: []BodyRule{{Selector: "/token", Resource: "/sessions"}},
+		RequestSanitisationCallback: func(body string) string {
+			callbackRequestBody = body
+			return body
+		},
+	})
+	sanitisedLogEntry := sanitiser(LogEntry{
+		Request:  Request{Body: `{"username":"alice","password":"hunter2"}`, Resource: "/sessions", Method: Post},
+		Response: Response{Body: `{"token":"abc","expires":3600}`},
+	})
+
+	assert.Equal(t, `{"password":"[REDACTED]","username":"alice"}`, callbackRequestBody)
+	assert.Equal(t, `{"password":"[REDACTED]","username":"alice"}`, sanitisedLogEntry.Request.Body)
+	assert.Equal(t, `{"expires":3600}`, sanitisedLogEntry.Response.Body)
+}
+
+func TestNewSanitiserErrsWithInvalidOptions(t *testing.T) {
+	for _, options := range []SanitiserOptions{
+		{RequestBodyRules: []BodyRule{{Selector: "password"}}},
+		{ResponseBodyRules: []BodyRule{{Selector: "$.password[", Mask: TruncateBodyValue}}},
+		{RequestBodyRules: []BodyRule{{Selector: "/password", Mask: TruncateBodyValue, TruncateLength: -1}}},
+		{ParameterRules: []ParameterRule{{Name: "token", Mask: TruncateBodyValue, TruncateLength: -1}}},
+		{HashOptions: &HashOptions{}},
+	} {
+		sanitiser, err := NewSanitiser(options)
+		assert.NotNil(t, err)
+		assert.Nil(t, sanitiser)
+	}
+}
+
+func TestSanitiserPanicsWithInvalidBodyRules(t *testing.T) {
+	assert.Panics(t, func() {
+		GetSanitiser(SanitiserOptions{RequestBodyRules: []BodyRule{{Selector: "password"}}})
+	})
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// A Sink is a destination to which a batchLogger can write batches of log entries, each of which is a marshalled LogEntry. Write may
+// return an ErrorBatchNotRetryable or ErrorBatchRetryAfter in the same way as a BatchCallback. Implementations must be safe for concurrent
+// use, as a batchLogger may write several batches at once, and Write should return promptly once ctx is done
+type Sink interface {
+	Write(ctx context.Context, batch [][]byte) error
+	Close(ctx context.Context) error
+}
+
+// writerSink is a Sink which writes batches as newline-delimited JSON to an io.Writer
+type writerSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterSink creates a Sink which writes batches of log entries to w as newline-delimited JSON, in the same format they're sent to the
+// Firetail logging API. Closing the Sink does not close w
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{writer: w}
+}
+
+// NewStdoutSink creates a Sink which writes batches of log entries to stdout as newline-delimited JSON
+func NewStdoutSink() Sink {
+	return NewWriterSink(os.Stdout)
+}
+
+// Write implements Sink. The batch is written to the underlying io.Writer in a single call, so batches written concurrently aren't interleaved
+func (s *writerSink) Write(ctx context.Context, batch [][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.writer.Write(joinBatch(batch))
+	return err
+}
+
+// Close implements Sink
+func (s *writerSink) Close(ctx context.Context) error {
+	return nil
+}
+
+// joinBatch joins the log entries in a batch into newline-delimited JSON
+func joinBatch(batch [][]byte) []byte {
+	size := 0
+	for _, entry := range batch {
+		size += len(entry) + 1
+	}
+	joined := make([]byte, 0, size)
+	for _, entry := range batch {
+		joined = append(joined, entry...)
+		joined = append(joined, '\n')
+	}
+	return joined
+}
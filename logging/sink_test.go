@@ -0,0 +1,169 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSink(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	sink := NewWriterSink(buffer)
+
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"id":1}`), []byte(`{"id":2}`)}))
+	require.Nil(t, sink.Write(context.Background(), [][]byte{[]byte(`{"id":3}`)}))
+	require.Nil(t, sink.Close(context.Background()))
+
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n", buffer.String())
+}
+
+func TestWriterSinkBatchesAreNotInterleaved(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	sink := NewWriterSink(buffer)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.Write(context.Background(), [][]byte{[]byte(`{"first":true}`), []byte(`{"first":false}`)})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, bytes.Repeat([]byte("{\"first\":true}\n{\"first\":false}\n"), 10), buffer.Bytes())
+}
+
+func TestSinkIsUsedByBatchLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.jsonl")
+	sink, err := NewFileSink(FileSinkOptions{Path: path})
+	require.Nil(t, err)
+
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		Sink:         sink,
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: 1})
+	batchLogger.Enqueue(&LogEntry{DateCreated: 2})
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	// The batchLogger should have closed the sink
+	assert.IsType(t, ErrorBatchNotRetryable{}, sink.Write(context.Background(), [][]byte{[]byte("{}")}))
+
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := bytes.Split(bytes.TrimSuffix(contents, []byte{'\n'}), []byte{'\n'})
+	require.Equal(t, 2, len(lines))
+	for i, line := range lines {
+		logEntry, err := UnmarshalLogEntry(line)
+		require.Nil(t, err)
+		assert.Equal(t, int64(i+1), logEntry.DateCreated)
+	}
+}
+
+func TestCloseCancelsSinkWritesBeforeClosingSink(t *testing.T) {
+	var mutex sync.Mutex
+	writing, writeCancelled, closedWhilstWriting := false, false, false
+	sink := &testSink{write: func(ctx context.Context, attempt int) error {
+		mutex.Lock()
+		writing = true
+		mutex.Unlock()
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		writing, writeCancelled = false, true
+		return ctx.Err()
+	}}
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:     1024 * 512,
+		MaxLogAge:        time.Minute,
+		MaxBatchAttempts: 1,
+		Sink: &closeCheckingSink{testSink: sink, onClose: func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			closedWhilstWriting = writing
+		}},
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := batchLogger.Close(ctx)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The write should have been cancelled, but the sink can't be closed until it's returned, so it's closed by the next call to Close
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return writeCancelled
+	}, time.Second, time.Millisecond)
+	err = batchLogger.Close(context.Background())
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Failed)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.False(t, closedWhilstWriting)
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	assert.True(t, sink.closed)
+}
+
+func TestCloseDoesntWaitForSinkWritesPastItsContext(t *testing.T) {
+	release := make(chan struct{})
+	sink := &testSink{write: func(ctx context.Context, attempt int) error {
+		// This write ignores its context being cancelled, like a write to a slow disk
+		<-release
+		return nil
+	}}
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:     1024 * 512,
+		MaxLogAge:        time.Minute,
+		MaxBatchAttempts: 1,
+		Sink:             sink,
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closeStarted := time.Now()
+	err := batchLogger.Close(ctx)
+	assert.Less(t, time.Since(closeStarted), time.Second)
+	require.IsType(t, ErrorLogEntriesDropped{}, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int64(1), err.(ErrorLogEntriesDropped).Unsent)
+
+	// The sink shouldn't have been closed underneath the running write
+	sink.mutex.Lock()
+	assert.False(t, sink.closed)
+	sink.mutex.Unlock()
+
+	// Once the write has returned, Close can be called again to close the sink
+	close(release)
+	require.Nil(t, batchLogger.Close(context.Background()))
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	assert.True(t, sink.closed)
+	assert.Len(t, sink.batches, 1)
+}
+
+// closeCheckingSink wraps a testSink, calling onClose before the testSink is closed
+type closeCheckingSink struct {
+	*testSink
+	onClose func()
+}
+
+func (s *closeCheckingSink) Close(ctx context.Context) error {
+	s.onClose()
+	return s.testSink.Close(ctx)
+}
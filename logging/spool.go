@@ -0,0 +1,475 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolSegmentExtension = ".spool"
+
+// spoolCheckpointName is the name of the file in the spool directory which records how far through the oldest segment the acknowledged
+// batches go, so they aren't replayed again when the spool is reopened
+const spoolCheckpointName = "checkpoint"
+
+// ErrSpoolClosed is returned when a batch is appended to a Spool after the batchLogger using it has been closed
+var ErrSpoolClosed = errors.New("spool closed")
+
+// ErrorSpoolUnavailable is returned by NewSpool if the spool directory can't be created or the segments already in it can't be read
+type ErrorSpoolUnavailable struct {
+	Directory string
+	Err       error
+}
+
+func (e ErrorSpoolUnavailable) Error() string {
+	return fmt.Sprintf("spool directory %s unavailable: %s", e.Directory, e.Err.Error())
+}
+
+func (e ErrorSpoolUnavailable) Unwrap() error {
+	return e.Err
+}
+
+// SpoolOptions is an options struct used by the NewSpool constructor
+type SpoolOptions struct {
+	Directory      string        // The directory in which the spool's segment files are kept; it's created if it doesn't exist
+	MaxSegmentSize int64         // The size in bytes at which a segment file stops being appended to & a new one is started; defaults to 4MiB
+	MaxBytes       int64         // The maximum total size in bytes of the spool's segment files, beyond which the oldest are deleted; defaults to 256MiB
+	MaxAge         time.Duration // The maximum time since a segment file was last appended to, beyond which it's deleted; defaults to 7 days
+}
+
+// A Spool is a durable, on-disk FIFO queue of batches of log entries which a batchLogger uses to hold onto batches it couldn't send so they
+// can be replayed later, including after the process restarts. Batches are appended to the newest of a series of size-capped segment files
+// & read from the oldest, which is deleted once every batch in it has been replayed. The offset of the first unacknowledged batch in the
+// oldest segment is checkpointed to disk whenever a batch is acknowledged. Batches are replayed at least once; if the process exits whilst a
+// batch is being replayed, it will be replayed again when the spool is next opened. A spool directory must not be shared between processes.
+type Spool struct {
+	mutex          sync.Mutex
+	directory      string
+	maxSegmentSize int64
+	maxBytes       int64
+	maxAge         time.Duration
+	segments       []*spoolSegment // Ordered oldest first
+	writer         *os.File        // The last segment's file, open for appending, or nil if the next batch should start a new segment
+	readFile       *os.File        // The first segment's file, open for reading, or nil if it hasn't been opened yet
+	readOffset     int64           // The offset in readFile of the next batch to read
+	peeked         *spooledBatch   // The batch at readOffset, if it's been read but not yet acknowledged
+	closed         bool            // Once closed, appends fail & nothing more is read
+	ready          chan struct{}   // Has a value sent to it (without blocking) whenever a batch is appended
+	stats          spoolStats
+}
+
+type spoolStats struct {
+	spooledBatches int64 // The number of batches appended to the spool
+	spooledEntries int64 // The number of log entries in batches appended to the spool
+	prunedEntries  int64 // The number of log entries deleted from the spool because of its MaxBytes or MaxAge
+	corruptRecords int64 // The number of records in segment files which couldn't be decoded & were skipped
+}
+
+type spoolSegment struct {
+	sequence    uint64
+	path        string
+	size        int64
+	entryCount  int64 // The number of log entries in the segment which haven't yet been acknowledged
+	modTime     time.Time
+	ackedOffset int64 // The offset of the first batch in the segment which hadn't been acknowledged when the spool was opened
+}
+
+// spoolCheckpoint is the format in which the checkpoint file records the offset of the first unacknowledged batch in the oldest segment
+type spoolCheckpoint struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   int64  `json:"offset"`
+}
+
+// spoolRecord is the format in which each batch is written to a segment file, as a single line of JSON
+type spoolRecord struct {
+	OldestEntryCreatedAt int64             `json:"oldestEntryCreatedAt"`
+	Entries              []json.RawMessage `json:"entries"`
+}
+
+// spooledBatch is a batch read back from a segment file
+type spooledBatch struct {
+	batch                [][]byte
+	batchSize            int
+	oldestEntryCreatedAt time.Time
+	recordSize           int64 // The size of the batch's record in the segment file, including its newline
+}
+
+// NewSpool opens the spool in the directory given by the options, creating it if it doesn't exist. Any segment files already in the directory
+// are kept, so the batches in them can be replayed.
+func NewSpool(options SpoolOptions) (*Spool, error) {
+	if options.MaxSegmentSize <= 0 {
+		options.MaxSegmentSize = 4 * 1024 * 1024
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = 256 * 1024 * 1024
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = 7 * 24 * time.Hour
+	}
+
+	spool := &Spool{
+		directory:      options.Directory,
+		maxSegmentSize: options.MaxSegmentSize,
+		maxBytes:       options.MaxBytes,
+		maxAge:         options.MaxAge,
+		ready:          make(chan struct{}, 1),
+	}
+
+	if err := os.MkdirAll(options.Directory, 0700); err != nil {
+		return nil, ErrorSpoolUnavailable{options.Directory, err}
+	}
+	dirEntries, err := os.ReadDir(options.Directory)
+	if err != nil {
+		return nil, ErrorSpoolUnavailable{options.Directory, err}
+	}
+	checkpoint, err := spool.loadCheckpoint()
+	if err != nil {
+		return nil, ErrorSpoolUnavailable{options.Directory, err}
+	}
+	for _, dirEntry := range dirEntries {
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(dirEntry.Name(), spoolSegmentExtension), 10, 64)
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), spoolSegmentExtension) || err != nil {
+			continue
+		}
+		// Segments older than the checkpointed one were read to the end, but the process exited before they could be deleted
+		if sequence < checkpoint.Sequence {
+			os.Remove(filepath.Join(options.Directory, dirEntry.Name()))
+			continue
+		}
+		ackedOffset := int64(0)
+		if sequence == checkpoint.Sequence {
+			ackedOffset = checkpoint.Offset
+		}
+		segment, err := spool.loadSegment(sequence, ackedOffset)
+		if err != nil {
+			return nil, ErrorSpoolUnavailable{options.Directory, err}
+		}
+		spool.segments = append(spool.segments, segment)
+	}
+	sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i].sequence < spool.segments[j].sequence })
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	spool.prune()
+	if len(spool.segments) > 0 {
+		spool.signalReady()
+	}
+
+	return spool, nil
+}
+
+// loadCheckpoint reads the checkpoint file, if there is one
+func (s *Spool) loadCheckpoint() (spoolCheckpoint, error) {
+	var checkpoint spoolCheckpoint
+	checkpointBytes, err := os.ReadFile(filepath.Join(s.directory, spoolCheckpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	} else if err != nil {
+		return checkpoint, err
+	}
+	// The checkpoint is replaced atomically so it shouldn't be corrupt, but if it is, the worst that can happen is batches are replayed again
+	if json.Unmarshal(checkpointBytes, &checkpoint) != nil || checkpoint.Offset < 0 {
+		return spoolCheckpoint{}, nil
+	}
+	return checkpoint, nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint file with the offset of the first unacknowledged batch in the oldest segment. It must be
+// called with the mutex held
+func (s *Spool) saveCheckpoint() error {
+	checkpointBytes, err := json.Marshal(spoolCheckpoint{Sequence: s.segments[0].sequence, Offset: s.readOffset})
+	if err != nil {
+		return err
+	}
+	checkpointPath := filepath.Join(s.directory, spoolCheckpointName)
+	file, err := os.OpenFile(checkpointPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(checkpointBytes)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(checkpointPath+".tmp", checkpointPath)
+}
+
+// loadSegment reads an existing segment file to find out how many log entries are in it after ackedOffset, the offset of the first batch in
+// it which hasn't been acknowledged
+func (s *Spool) loadSegment(sequence uint64, ackedOffset int64) (*spoolSegment, error) {
+	segment := &spoolSegment{
+		sequence:    sequence,
+		path:        filepath.Join(s.directory, fmt.Sprintf("%020d%s", sequence, spoolSegmentExtension)),
+		ackedOffset: ackedOffset,
+	}
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	segment.size = fileInfo.Size()
+	segment.modTime = fileInfo.ModTime()
+
+	if segment.ackedOffset > segment.size {
+		segment.ackedOffset = segment.size
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, segment.ackedOffset, segment.size-segment.ackedOffset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A trailing partial record is left behind if the process exited whilst it was being written, & is skipped when it's read
+			return segment, nil
+		}
+		var record spoolRecord
+		if json.Unmarshal(line, &record) == nil {
+			segment.entryCount += int64(len(record.Entries))
+		}
+	}
+}
+
+// append writes a batch to the newest segment file & syncs it to disk, starting a new segment if the newest is full
+func (s *Spool) append(batch [][]byte, oldestEntryCreatedAt time.Time) error {
+	record := spoolRecord{
+		OldestEntryCreatedAt: oldestEntryCreatedAt.UnixMilli(),
+		Entries:              make([]json.RawMessage, len(batch)),
+	}
+	for i, entry := range batch {
+		record.Entries[i] = entry
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	recordBytes = append(recordBytes, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+	if s.writer == nil {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+	segment := s.segments[len(s.segments)-1]
+	n, err := s.writer.Write(recordBytes)
+	segment.size += int64(n)
+	segment.modTime = time.Now()
+	if err == nil {
+		err = s.writer.Sync()
+	}
+	if err != nil {
+		// The segment may now end with a partial record, so nothing more should be appended to it
+		s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	segment.entryCount += int64(len(batch))
+	s.stats.spooledBatches++
+	s.stats.spooledEntries += int64(len(batch))
+
+	if segment.size >= s.maxSegmentSize {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	s.prune()
+	s.signalReady()
+	return nil
+}
+
+// startSegment creates a new segment file after the last one & opens it for appending. It must be called with the mutex held
+func (s *Spool) startSegment() error {
+	segment := &spoolSegment{sequence: 1}
+	if len(s.segments) > 0 {
+		segment.sequence = s.segments[len(s.segments)-1].sequence + 1
+	}
+	segment.path = filepath.Join(s.directory, fmt.Sprintf("%020d%s", segment.sequence, spoolSegmentExtension))
+	file, err := os.OpenFile(segment.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	segment.modTime = time.Now()
+	s.segments = append(s.segments, segment)
+	s.writer = file
+	return nil
+}
+
+// peek returns the oldest batch in the spool without removing it, or false if the spool is empty. Segments which have been read to the
+// end are deleted, & records which can't be decoded are skipped
+func (s *Spool) peek() (*spooledBatch, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+	s.prune()
+	for s.peeked == nil {
+		if len(s.segments) == 0 {
+			return nil, false
+		}
+		segment := s.segments[0]
+		isBeingAppended := s.writer != nil && len(s.segments) == 1
+
+		if s.readFile == nil {
+			file, err := os.Open(segment.path)
+			if err != nil {
+				// If the segment can't be read it's no use keeping it
+				s.removeFirstSegment()
+				continue
+			}
+			s.readFile = file
+			s.readOffset = segment.ackedOffset
+		}
+
+		reader := bufio.NewReader(io.NewSectionReader(s.readFile, s.readOffset, segment.size-s.readOffset))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if isBeingAppended {
+				return nil, false
+			}
+			s.removeFirstSegment()
+			continue
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			s.stats.corruptRecords++
+			s.readOffset += int64(len(line))
+			continue
+		}
+		peeked := &spooledBatch{
+			batch:                make([][]byte, len(record.Entries)),
+			oldestEntryCreatedAt: time.UnixMilli(record.OldestEntryCreatedAt),
+			recordSize:           int64(len(line)),
+		}
+		for i, entry := range record.Entries {
+			peeked.batch[i] = entry
+			peeked.batchSize += len(entry)
+		}
+		s.peeked = peeked
+	}
+
+	return s.peeked, true
+}
+
+// ack removes the batch last returned by peek from the spool, if it hasn't since been pruned
+func (s *Spool) ack(batch *spooledBatch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.peeked == nil || s.peeked != batch {
+		return
+	}
+	s.readOffset += batch.recordSize
+	s.segments[0].entryCount -= int64(len(batch.batch))
+	s.peeked = nil
+	// If the checkpoint can't be saved, the batch will just be replayed again if the spool is reopened before the next ack
+	s.saveCheckpoint()
+}
+
+// prune deletes the oldest segments until the spool is within its maxBytes, & any segments which haven't been appended to within its maxAge.
+// It must be called with the mutex held
+func (s *Spool) prune() {
+	totalSize := int64(0)
+	for _, segment := range s.segments {
+		totalSize += segment.size
+	}
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+		isTooOld := time.Since(segment.modTime) > s.maxAge
+		// The segment being appended to is never deleted to make space, so the spool can always hold at least the most recent batch
+		isOverQuota := totalSize > s.maxBytes && !(s.writer != nil && len(s.segments) == 1)
+		if !isTooOld && !isOverQuota {
+			return
+		}
+		totalSize -= segment.size
+		s.stats.prunedEntries += segment.entryCount
+		s.removeFirstSegment()
+	}
+}
+
+// removeFirstSegment closes & deletes the oldest segment. It must be called with the mutex held
+func (s *Spool) removeFirstSegment() {
+	if s.readFile != nil {
+		s.readFile.Close()
+		s.readFile = nil
+	}
+	if s.writer != nil && len(s.segments) == 1 {
+		s.writer.Close()
+		s.writer = nil
+	}
+	// The checkpoint always refers to the oldest segment, so it's removed first; otherwise, if the process exited in between, it could be
+	// applied to a new segment with the same sequence number. If it's removed but the segment isn't, the segment is just replayed again
+	os.Remove(filepath.Join(s.directory, spoolCheckpointName))
+	os.Remove(s.segments[0].path)
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.peeked = nil
+}
+
+// len returns the number of log entries in the spool which haven't been acknowledged
+func (s *Spool) len() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	length := int64(0)
+	for _, segment := range s.segments {
+		length += segment.entryCount
+	}
+	return length
+}
+
+// getStats returns a copy of the spool's counters
+func (s *Spool) getStats() spoolStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+// close closes the spool's open files. The segment files are left in the spool directory so they can be replayed when it's next opened
+func (s *Spool) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.readFile != nil {
+		s.readFile.Close()
+		s.readFile = nil
+	}
+	s.peeked = nil
+	if s.writer != nil {
+		err := s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	return nil
+}
+
+// signalReady lets the replayer know there's a batch ready to peek, without blocking if it's already been told
+func (s *Spool) signalReady() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,321 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBatch(id int) [][]byte {
+	return [][]byte{[]byte(fmt.Sprintf(`{"id":%d}`, id)), []byte(fmt.Sprintf(`{"id":%d}`, id+1))}
+}
+
+func drainSpool(t *testing.T, spool *Spool) [][][]byte {
+	batches := [][][]byte{}
+	for {
+		spooledBatch, ok := spool.peek()
+		if !ok {
+			return batches
+		}
+		batches = append(batches, spooledBatch.batch)
+		spool.ack(spooledBatch)
+	}
+}
+
+func TestSpoolIsFIFOAcrossSegments(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := NewSpool(SpoolOptions{Directory: directory, MaxSegmentSize: 64})
+	require.Nil(t, err)
+
+	oldestEntryCreatedAt := time.UnixMilli(time.Now().UnixMilli())
+	for i := 0; i < 10; i += 2 {
+		require.Nil(t, spool.append(testBatch(i), oldestEntryCreatedAt))
+	}
+	assert.Equal(t, int64(10), spool.len())
+
+	// Each batch is bigger than the max segment size, so each should be in its own segment
+	segmentFiles, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	require.Nil(t, err)
+	assert.Equal(t, 5, len(segmentFiles))
+
+	spooledBatch, ok := spool.peek()
+	require.True(t, ok)
+	assert.Equal(t, oldestEntryCreatedAt, spooledBatch.oldestEntryCreatedAt)
+	assert.Equal(t, len(testBatch(0)[0])+len(testBatch(0)[1]), spooledBatch.batchSize)
+
+	batches := drainSpool(t, spool)
+	require.Equal(t, 5, len(batches))
+	for i, batch := range batches {
+		assert.Equal(t, testBatch(i*2), batch)
+	}
+	assert.Equal(t, int64(0), spool.len())
+
+	// Segments which have been read to the end should be deleted
+	segmentFiles, err = filepath.Glob(filepath.Join(directory, "*.spool"))
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(segmentFiles))
+}
+
+func TestSpoolSurvivesReopening(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	require.Nil(t, spool.append(testBatch(0), time.Now()))
+	require.Nil(t, spool.append(testBatch(2), time.Now()))
+
+	// Acknowledge the first batch, but peek the second without acknowledging it before closing the spool
+	spooledBatch, ok := spool.peek()
+	require.True(t, ok)
+	spool.ack(spooledBatch)
+	_, ok = spool.peek()
+	require.True(t, ok)
+	require.Nil(t, spool.close())
+	assert.Equal(t, ErrSpoolClosed, spool.append(testBatch(4), time.Now()))
+
+	// Simulate the process exiting part way through writing a batch
+	segmentFiles, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(segmentFiles))
+	segmentFile, err := os.OpenFile(segmentFiles[0], os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = segmentFile.Write([]byte(`{"oldestEntryCreatedAt":0,"entr`))
+	require.Nil(t, err)
+	require.Nil(t, segmentFile.Close())
+
+	reopenedSpool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), reopenedSpool.len())
+	require.Nil(t, reopenedSpool.append(testBatch(6), time.Now()))
+
+	// The first batch was acknowledged, so only the second, which was in progress, should be replayed; the partial batch should be skipped,
+	// and new batches should go in a new segment after the old ones
+	assert.Equal(t, [][][]byte{testBatch(2), testBatch(6)}, drainSpool(t, reopenedSpool))
+	require.Nil(t, reopenedSpool.close())
+
+	// Everything has been acknowledged, so nothing should be replayed if the spool is opened again
+	reopenedSpool, err = NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), reopenedSpool.len())
+	assert.Equal(t, [][][]byte{}, drainSpool(t, reopenedSpool))
+}
+
+func TestSpoolCheckpointIsNotAppliedToNewSegments(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	require.Nil(t, spool.append(testBatch(0), time.Now()))
+	assert.Equal(t, [][][]byte{testBatch(0)}, drainSpool(t, spool))
+
+	// The drained segment was deleted, so the next segment may reuse its sequence number, but it mustn't inherit its checkpoint
+	require.Nil(t, spool.append(testBatch(2), time.Now()))
+	require.Nil(t, spool.close())
+
+	reopenedSpool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	assert.Equal(t, [][][]byte{testBatch(2)}, drainSpool(t, reopenedSpool))
+}
+
+func TestSpoolDeletesSegmentsBeforeCheckpoint(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := NewSpool(SpoolOptions{Directory: directory, MaxSegmentSize: 1})
+	require.Nil(t, err)
+	require.Nil(t, spool.append(testBatch(0), time.Now()))
+	require.Nil(t, spool.append(testBatch(2), time.Now()))
+	require.Nil(t, spool.append(testBatch(4), time.Now()))
+
+	// Acknowledge the first two batches, then put the first segment back as if the process exited before it could be deleted
+	segmentFiles, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(segmentFiles))
+	firstSegment, err := os.ReadFile(segmentFiles[0])
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		spooledBatch, ok := spool.peek()
+		require.True(t, ok)
+		spool.ack(spooledBatch)
+	}
+	require.Nil(t, spool.close())
+	require.Nil(t, os.WriteFile(segmentFiles[0], firstSegment, 0600))
+
+	reopenedSpool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	assert.Equal(t, [][][]byte{testBatch(4)}, drainSpool(t, reopenedSpool))
+	_, err = os.Stat(segmentFiles[0])
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestSpoolIsPrunedToMaxBytes(t *testing.T) {
+	createdAt := time.Now()
+	recordBytes, err := json.Marshal(spoolRecord{
+		OldestEntryCreatedAt: createdAt.UnixMilli(),
+		Entries:              []json.RawMessage{testBatch(0)[0], testBatch(0)[1]},
+	})
+	require.Nil(t, err)
+	recordSize := int64(len(recordBytes) + 1)
+
+	// Each record gets its own segment, and only 3 fit within the max bytes
+	spool, err := NewSpool(SpoolOptions{Directory: t.TempDir(), MaxSegmentSize: 1, MaxBytes: recordSize*4 - 1})
+	require.Nil(t, err)
+
+	for i := 0; i < 10; i += 2 {
+		require.Nil(t, spool.append(testBatch(i), createdAt))
+	}
+
+	assert.Equal(t, int64(4), spool.getStats().prunedEntries)
+	assert.Equal(t, [][][]byte{testBatch(4), testBatch(6), testBatch(8)}, drainSpool(t, spool))
+}
+
+func TestSpoolIsPrunedToMaxAge(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := NewSpool(SpoolOptions{Directory: directory, MaxSegmentSize: 64})
+	require.Nil(t, err)
+	require.Nil(t, spool.append(testBatch(0), time.Now()))
+	require.Nil(t, spool.append(testBatch(2), time.Now()))
+	require.Nil(t, spool.close())
+
+	// Make the first segment look like it was last written to an hour ago
+	segmentFiles, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(segmentFiles))
+	anHourAgo := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(segmentFiles[0], anHourAgo, anHourAgo))
+
+	reopenedSpool, err := NewSpool(SpoolOptions{Directory: directory, MaxAge: time.Minute})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), reopenedSpool.getStats().prunedEntries)
+	assert.Equal(t, [][][]byte{testBatch(2)}, drainSpool(t, reopenedSpool))
+}
+
+func TestNewSpoolErrsIfDirectoryUnavailable(t *testing.T) {
+	notADirectory := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, os.WriteFile(notADirectory, []byte{}, 0600))
+	_, err := NewSpool(SpoolOptions{Directory: notADirectory})
+	assert.IsType(t, ErrorSpoolUnavailable{}, err)
+}
+
+func TestFailedBatchesAreSpooledAndReplayed(t *testing.T) {
+	spool, err := NewSpool(SpoolOptions{Directory: t.TempDir()})
+	require.Nil(t, err)
+
+	var apiIsUp int32
+	replayed := make(chan [][]byte, 1)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:     1024 * 512,
+		MaxLogAge:        time.Minute,
+		MaxBatchAttempts: 1,
+		RetryBackoff:     10 * time.Millisecond,
+		MaxRetryBackoff:  10 * time.Millisecond,
+		Spool:            spool,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			if atomic.LoadInt32(&apiIsUp) == 0 {
+				return errors.New("test error")
+			}
+			replayed <- b
+			return nil
+		},
+	})
+
+	testLogEntry := &LogEntry{DateCreated: time.Now().UnixMilli()}
+	batchLogger.Enqueue(testLogEntry)
+	require.Nil(t, batchLogger.Flush(context.Background()))
+
+	// The batch should have failed & been spooled rather than counted as failed
+	stats := batchLogger.Stats()
+	assert.Equal(t, int64(1), stats.SpooledBatches)
+	assert.Equal(t, int64(1), stats.SpoolLength)
+	assert.Equal(t, int64(0), stats.FailedBatches)
+
+	// Once the callback starts succeeding, the spooled batch should be replayed
+	atomic.StoreInt32(&apiIsUp, 1)
+	select {
+	case batch := <-replayed:
+		require.Equal(t, 1, len(batch))
+		assert.Contains(t, string(batch[0]), fmt.Sprintf(`"dateCreated":%d`, testLogEntry.DateCreated))
+	case <-time.After(time.Second):
+		t.Fatal("spooled batch was not replayed")
+	}
+
+	require.Nil(t, batchLogger.Close(context.Background()))
+	stats = batchLogger.Stats()
+	assert.Equal(t, int64(1), stats.ReplayedBatches)
+	assert.Equal(t, int64(1), stats.ReplayedEntries)
+	assert.Equal(t, int64(0), stats.SpoolLength)
+}
+
+func TestSpooledBatchesAreReplayedAfterRestart(t *testing.T) {
+	directory := t.TempDir()
+
+	// The first logger can't send anything, so its batch is left in the spool when it's closed
+	spool, err := NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:     1024 * 512,
+		MaxLogAge:        time.Minute,
+		MaxBatchAttempts: 1,
+		Spool:            spool,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			return errors.New("test error")
+		},
+	})
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	// The second logger should replay it, even though it's never given any log entries of its own
+	spool, err = NewSpool(SpoolOptions{Directory: directory})
+	require.Nil(t, err)
+	replayed := make(chan [][]byte, 1)
+	batchLogger = NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:    1024 * 512,
+		MaxLogAge:       time.Minute,
+		Spool:           spool,
+		SpoolAllBatches: true,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			replayed <- b
+			return nil
+		},
+	})
+	require.Nil(t, batchLogger.Close(context.Background()))
+	assert.Equal(t, 1, len(replayed))
+}
+
+func TestAllBatchesAreSpooled(t *testing.T) {
+	spool, err := NewSpool(SpoolOptions{Directory: t.TempDir()})
+	require.Nil(t, err)
+
+	batchChannel := make(chan [][]byte, 2)
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:    1024 * 512,
+		MaxBatchCount:   1,
+		MaxLogAge:       time.Minute,
+		Spool:           spool,
+		SpoolAllBatches: true,
+		BatchCallback: func(b [][]byte, m BatchMetadata) error {
+			batchChannel <- b
+			return nil
+		},
+	})
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: 1})
+	batchLogger.Enqueue(&LogEntry{DateCreated: 2})
+
+	// Flush should wait for both batches to be written to the spool & replayed from it
+	require.Nil(t, batchLogger.Flush(context.Background()))
+	require.Equal(t, 2, len(batchChannel))
+	assert.Contains(t, string((<-batchChannel)[0]), `"dateCreated":1`)
+	assert.Contains(t, string((<-batchChannel)[0]), `"dateCreated":2`)
+
+	require.Nil(t, batchLogger.Close(context.Background()))
+	stats := batchLogger.Stats()
+	assert.Equal(t, int64(2), stats.SpooledBatches)
+	assert.Equal(t, int64(2), stats.ReplayedBatches)
+	assert.Equal(t, int64(0), stats.SentBatches)
+}
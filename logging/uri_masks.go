@@ -0,0 +1,184 @@
+package logging
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maskURI applies a query parameters mask, path parameters mask & path segment patterns to a log entry's URI
+func maskURI(logEntry *LogEntry, options *SanitiserOptions, hash func(string) string) {
+	if len(options.QueryParamsMask) > 0 || options.QueryParamsMaskStrict {
+		logEntry.Request.URI = maskQueryParameters(logEntry.Request.URI, func(name string, value string) (string, string, bool) {
+			return maskQueryParameter(name, value, options.QueryParamsMask[strings.ToLower(name)], options.QueryParamsMaskStrict, hash)
+		})
+	}
+
+	if len(options.PathParamsMask) > 0 || options.PathParamsMaskStrict {
+		logEntry.Request.URI = maskPathParameters(logEntry.Request.URI, logEntry.Request.Resource, func(name string, value string) string {
+			return maskPathParameter(name, value, options.PathParamsMask[strings.ToLower(name)], options.PathParamsMaskStrict, hash)
+		})
+	}
+
+	if len(options.PathSegmentPatterns) > 0 {
+		logEntry.Request.URI = maskPathSegments(logEntry.Request.URI, options.PathSegmentPatterns, hash)
+	}
+}
+
+// maskQueryParameter applies a HeaderMask to a query parameter, returning its masked name & value, or false if it should be removed
+func maskQueryParameter(name string, value string, mask HeaderMask, isStrict bool, hash func(string) string) (string, string, bool) {
+	switch mask {
+	case UnsetHeader:
+		return name, value, !isStrict
+	case RemoveHeader:
+		return "", "", false
+	case RemoveHeaderValues:
+		return name, "", true
+	case HashHeaderValues:
+		return name, hash(value), true
+	case HashHeader:
+		return hash(name), hash(value), true
+	case RedactJWTSignature:
+		return name, redactJWTSignature(value), true
+	default:
+		return name, value, true
+	}
+}
+
+// maskPathParameter applies a HeaderMask to a path parameter, returning its masked value. Path segments can't be removed, so RemoveHeader
+// & RemoveHeaderValues replace it with the parameter's name from the resource, e.g. {token}, as does UnsetHeader if the mask is strict
+func maskPathParameter(name string, value string, mask HeaderMask, isStrict bool, hash func(string) string) string {
+	switch mask {
+	case UnsetHeader:
+		if isStrict {
+			return "{" + name + "}"
+		}
+		return value
+	case RemoveHeader, RemoveHeaderValues:
+		return "{" + name + "}"
+	case HashHeaderValues, HashHeader:
+		return hash(value)
+	case RedactJWTSignature:
+		return redactJWTSignature(value)
+	default:
+		return value
+	}
+}
+
+var jwtPattern = regexp.MustCompile("^[A-Za-z0-9-_]+\\.[A-Za-z0-9-_]+\\.[A-Za-z0-9-_]+$")
+
+// redactJWTSignature removes the signature from a value if it's a JWT
+func redactJWTSignature(value string) string {
+	if !jwtPattern.MatchString(value) {
+		return value
+	}
+	return strings.Join(strings.Split(value, ".")[:2], ".")
+}
+
+// splitURI splits a URI into the part before its path (its scheme & host), its path, and the part after its path (its query string)
+func splitURI(uri string) (string, string, string) {
+	pathEnd := strings.Index(uri, "?")
+	if pathEnd == -1 {
+		pathEnd = len(uri)
+	}
+	pathStart := 0
+	if schemeEnd := strings.Index(uri[:pathEnd], "://"); schemeEnd != -1 {
+		pathStart = pathEnd
+		if hostEnd := strings.Index(uri[schemeEnd+3:pathEnd], "/"); hostEnd != -1 {
+			pathStart = schemeEnd + 3 + hostEnd
+		}
+	}
+	return uri[:pathStart], uri[pathStart:pathEnd], uri[pathEnd:]
+}
+
+// maskQueryParameters passes the name & value of each parameter in the query string of a URI to mask, which returns the name & value to
+// replace them with, or false if the parameter should be removed. The other parameters are left exactly as they were, in the same order
+func maskQueryParameters(uri string, mask func(name string, value string) (string, string, bool)) string {
+	queryStart := strings.Index(uri, "?")
+	if queryStart == -1 {
+		return uri
+	}
+	maskedParameters := []string{}
+	for _, parameter := range strings.Split(uri[queryStart+1:], "&") {
+		rawName, rawValue, hasValue := strings.Cut(parameter, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			value = rawValue
+		}
+		maskedName, maskedValue, keep := mask(name, value)
+		if !keep {
+			continue
+		}
+		if maskedName != name {
+			rawName = url.QueryEscape(maskedName)
+		}
+		if maskedName == name && maskedValue == value {
+			maskedParameters = append(maskedParameters, parameter)
+		} else if hasValue || maskedValue != "" {
+			maskedParameters = append(maskedParameters, rawName+"="+url.QueryEscape(maskedValue))
+		} else {
+			maskedParameters = append(maskedParameters, rawName)
+		}
+	}
+	if len(maskedParameters) == 0 {
+		return uri[:queryStart]
+	}
+	return uri[:queryStart+1] + strings.Join(maskedParameters, "&")
+}
+
+// maskPathParameters passes the name & value of each of the parameters in the path of a URI, according to the resource it matched, e.g.
+// /pets/{id}, to mask, which returns the value to replace it with. If the URI's path has more segments than the resource, e.g. because the
+// API is served under a base path, the resource is matched against the end of the path. If the path doesn't match the resource, it's
+// left as it is
+func maskPathParameters(uri string, resource string, mask func(name string, value string) string) string {
+	if resource == "" {
+		return uri
+	}
+	prefix, path, suffix := splitURI(uri)
+	segments := strings.Split(path, "/")
+	resourceSegments := strings.Split(resource, "/")
+	offset := len(segments) - len(resourceSegments)
+	if offset < 0 {
+		return uri
+	}
+	for i, resourceSegment := range resourceSegments {
+		if len(resourceSegment) < 2 || resourceSegment[0] != '{' || resourceSegment[len(resourceSegment)-1] != '}' {
+			continue
+		}
+		value, err := url.PathUnescape(segments[offset+i])
+		if err != nil {
+			value = segments[offset+i]
+		}
+		maskedValue := mask(resourceSegment[1:len(resourceSegment)-1], value)
+		if maskedValue == resourceSegment {
+			// Placeholders are left unescaped so the path reads like the resource
+			segments[offset+i] = maskedValue
+		} else if maskedValue != value {
+			segments[offset+i] = url.PathEscape(maskedValue)
+		}
+	}
+	return prefix + strings.Join(segments, "/") + suffix
+}
+
+// maskPathSegments hashes each of the segments of the path of a URI which match any of the patterns
+func maskPathSegments(uri string, patterns []*regexp.Regexp, hash func(string) string) string {
+	prefix, path, suffix := splitURI(uri)
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		value, err := url.PathUnescape(segment)
+		if err != nil {
+			value = segment
+		}
+		for _, pattern := range patterns {
+			if pattern.MatchString(value) {
+				segments[i] = url.PathEscape(hash(value))
+				break
+			}
+		}
+	}
+	return prefix + strings.Join(segments, "/") + suffix
+}
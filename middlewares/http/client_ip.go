@@ -0,0 +1,141 @@
+package firetail
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a list of IP addresses & CIDR ranges into a list of IPNets. Single IP addresses are treated as ranges containing
+// only that address
+func parseTrustedProxies(trustedProxies []string) ([]*net.IPNet, error) {
+	ipNets := []*net.IPNet{}
+	for _, trustedProxy := range trustedProxies {
+		trustedProxy = strings.TrimSpace(trustedProxy)
+		if _, ipNet, err := net.ParseCIDR(trustedProxy); err == nil {
+			ipNets = append(ipNets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(trustedProxy)
+		if ip == nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", trustedProxy)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return ipNets, nil
+}
+
+// clientIPResolver resolves the IP address of the client that made a request. The request's RemoteAddr is used unless it belongs to a
+// trusted proxy, in which case the addresses the proxies have appended to the Forwarded, X-Forwarded-For or X-Real-IP headers are followed
+// back until one is found that doesn't belong to a trusted proxy
+type clientIPResolver struct {
+	trustedProxies []*net.IPNet
+}
+
+// resolve returns the IP address of the client that made a request
+func (c *clientIPResolver) resolve(r *http.Request) string {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !c.isTrusted(ip) {
+		return ip.String()
+	}
+
+	// Only one of the headers is used, so a client can't sneak an address past us in a header our proxies don't set
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = parseForwarded(strings.Join(forwarded, ","))
+	} else if xForwardedFor := r.Header.Values("X-Forwarded-For"); len(xForwardedFor) > 0 {
+		hops = strings.Split(strings.Join(xForwardedFor, ","), ",")
+	} else if xRealIP := r.Header.Values("X-Real-IP"); len(xRealIP) == 1 {
+		hops = []string{xRealIP[0]}
+	}
+
+	// Each proxy appends the address it received the request from, so we work back from the last hop, which was appended by the proxy that
+	// connected to us. If a hop isn't an IP address, e.g. because it's been obfuscated, we can't follow the chain any further & stop at the
+	// last proxy we know of
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := parseIP(strings.TrimSpace(hops[i]))
+		if hopIP == nil {
+			break
+		}
+		ip = hopIP
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// isTrusted returns true if an IP address belongs to one of the trusted proxies
+func (c *clientIPResolver) isTrusted(ip net.IP) bool {
+	for _, trustedProxy := range c.trustedProxies {
+		if trustedProxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded returns the values of the for parameters in a Forwarded header, as defined in RFC 7239, in the order they appear
+func parseForwarded(value string) []string {
+	hops := []string{}
+	for _, element := range splitQuoted(value, ',') {
+		for _, pair := range splitQuoted(element, ';') {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(name), "for") {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = strings.ReplaceAll(value[1:len(value)-1], "\\", "")
+			}
+			hops = append(hops, value)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s around each instance of sep which isn't within a quoted string
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseIP parses an IP address which may have a port & may be enclosed in square brackets if it's an IPv6 address, as found in a request's
+// RemoteAddr or the Forwarded & X-Forwarded-For headers. IPv4-mapped IPv6 addresses are converted to IPv4. Returns nil if it's not valid
+func parseIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	} else if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		address = address[1 : len(address)-1]
+	}
+	// IPv6 addresses may have a zone, e.g. fe80::1%eth0, which net.ParseIP doesn't accept
+	if zoneIndex := strings.LastIndex(address, "%"); zoneIndex != -1 {
+		address = address[:zoneIndex]
+	}
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,69 @@
+package firetail
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.1"})
+	require.Nil(t, err)
+	resolver := &clientIPResolver{trustedProxies}
+
+	for _, testCase := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expectedIP string
+	}{
+		{"IPv4 RemoteAddr", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"IPv6 RemoteAddr", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"IPv6 RemoteAddr with zone", "[fe80::1%eth0]:1234", nil, "fe80::1"},
+		{"IPv4-mapped IPv6 RemoteAddr", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+		{"RemoteAddr without port", "203.0.113.7", nil, "203.0.113.7"},
+		{"Invalid RemoteAddr", "pipe", nil, "pipe"},
+		{"Untrusted RemoteAddr ignores headers", "203.0.113.7:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"Trusted RemoteAddr without headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"Single trusted IP", "192.0.2.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"X-Forwarded-For", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"X-Forwarded-For skips trusted proxies", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"X-Forwarded-For ignores spoofed hops", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"Multiple X-Forwarded-For headers", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"X-Forwarded-For with IPv6", "[2001:db8:ffff::1]:1234", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"X-Forwarded-For with only trusted proxies", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"X-Forwarded-For with invalid hop", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"X-Real-IP", "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Multiple X-Real-IP headers are ignored", "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"198.51.100.1", "198.51.100.2"}}, "10.0.0.1"},
+		{"X-Forwarded-For takes precedence over X-Real-IP", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}}, "198.51.100.1"},
+		{"Forwarded", "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https"}}, "198.51.100.1"},
+		{"Forwarded with quoted IPv6 & port", "10.0.0.1:1234", map[string][]string{"Forwarded": {"For=\"[2001:db8::1]:4711\""}}, "2001:db8::1"},
+		{"Forwarded with multiple elements", "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=1.1.1.1, for=198.51.100.1;by=10.0.0.2", "for=10.0.0.2"}}, "198.51.100.1"},
+		{"Forwarded with quoted separators", "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.1;host=\"a,b;c\", for=10.0.0.2"}}, "198.51.100.1"},
+		{"Forwarded with obfuscated identifier", "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"Forwarded takes precedence over X-Forwarded-For", "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}, "198.51.100.1"},
+	} {
+		request := httptest.NewRequest("GET", "/health", nil)
+		request.RemoteAddr = testCase.remoteAddr
+		for name, values := range testCase.headers {
+			request.Header[name] = values
+		}
+		assert.Equal(t, testCase.expectedIP, resolver.resolve(request), testCase.name)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::1"})
+	require.Nil(t, err)
+	require.Len(t, trustedProxies, 3)
+	assert.Equal(t, "10.0.0.0/8", trustedProxies[0].String())
+	assert.Equal(t, "192.0.2.1/32", trustedProxies[1].String())
+	assert.Equal(t, "2001:db8::1/128", trustedProxies[2].String())
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+	_, err = parseTrustedProxies([]string{"load-balancer"})
+	assert.NotNil(t, err)
+}
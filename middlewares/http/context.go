@@ -0,0 +1,118 @@
+package firetail
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+type contextKey int
+
+const (
+	routeContextKey contextKey = iota
+	pathParamsContextKey
+	metadataContextKey
+)
+
+// RouteFromContext returns the route in the OpenAPI spec that a request matched, from the request's context. The route's Operation can be
+// used to get the operation's ID, security requirements & extensions. Returns false if the request wasn't matched to a route, which is
+// only done if a spec was provided & request or response validation is enabled
+func RouteFromContext(ctx context.Context) (*routers.Route, bool) {
+	route, ok := ctx.Value(routeContextKey).(*routers.Route)
+	return route, ok
+}
+
+// PathParamsFromContext returns the path parameters of a request, decoded according to the route in the OpenAPI spec that it matched,
+// from the request's context. Returns false if the request wasn't matched to a route
+func PathParamsFromContext(ctx context.Context) (map[string]string, bool) {
+	pathParams, ok := ctx.Value(pathParamsContextKey).(map[string]string)
+	return pathParams, ok
+}
+
+// contextWithRoute returns a copy of ctx carrying the route a request matched & its path parameters
+func contextWithRoute(ctx context.Context, route *routers.Route, pathParams map[string]string) context.Context {
+	ctx = context.WithValue(ctx, routeContextKey, route)
+	return context.WithValue(ctx, pathParamsContextKey, pathParams)
+}
+
+// SetPrincipal sets the ID of the user or client that made a request in the metadata of its log entry. ctx must be the context of a request
+// being handled by a Middleware, or a context derived from it, such as the one passed to your AuthCallbacks. Otherwise, it does nothing
+func SetPrincipal(ctx context.Context, principal string) {
+	metadata, ok := ctx.Value(metadataContextKey).(*logMetadata)
+	if !ok {
+		return
+	}
+	metadata.mutex.Lock()
+	defer metadata.mutex.Unlock()
+	metadata.principal = principal
+}
+
+// AddLogTags adds tags, e.g. the feature flags enabled for a request, to the metadata of its log entry. ctx must be the context of a
+// request being handled by a Middleware, or a context derived from it. Otherwise, it does nothing
+func AddLogTags(ctx context.Context, tags ...string) {
+	metadata, ok := ctx.Value(metadataContextKey).(*logMetadata)
+	if !ok {
+		return
+	}
+	metadata.mutex.Lock()
+	defer metadata.mutex.Unlock()
+	metadata.tags = append(metadata.tags, tags...)
+}
+
+// AddLogField adds a custom field, such as a customer ID or the outcome of a request, to the metadata of its log entry. The value is
+// marshalled to JSON immediately, so later changes to it aren't logged, & any err marshalling it is returned. If a field with the same key
+// has already been added, it's replaced. ctx must be the context of a request being handled by a Middleware, or a context derived from it.
+// Otherwise, it does nothing
+func AddLogField(ctx context.Context, key string, value interface{}) error {
+	metadata, ok := ctx.Value(metadataContextKey).(*logMetadata)
+	if !ok {
+		return nil
+	}
+	marshalledValue, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	metadata.mutex.Lock()
+	defer metadata.mutex.Unlock()
+	if metadata.fields == nil {
+		metadata.fields = map[string]json.RawMessage{}
+	}
+	metadata.fields[key] = marshalledValue
+	return nil
+}
+
+// logMetadata collects the metadata added to a request's log entry by your application whilst it's being handled
+type logMetadata struct {
+	mutex     sync.Mutex
+	principal string
+	tags      []string
+	fields    map[string]json.RawMessage
+}
+
+// contextWithLogMetadata returns a copy of ctx carrying a logMetadata, to which the metadata of a request's log entry can be added
+func contextWithLogMetadata(ctx context.Context, metadata *logMetadata) context.Context {
+	return context.WithValue(ctx, metadataContextKey, metadata)
+}
+
+// get returns a copy of the metadata added so far, or nil if none has been added
+func (m *logMetadata) get() *logging.Metadata {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.principal == "" && len(m.tags) == 0 && len(m.fields) == 0 {
+		return nil
+	}
+	metadata := &logging.Metadata{Principal: m.principal}
+	if len(m.tags) > 0 {
+		metadata.Tags = append([]string{}, m.tags...)
+	}
+	if len(m.fields) > 0 {
+		metadata.Fields = make(map[string]json.RawMessage, len(m.fields))
+		for key, value := range m.fields {
+			metadata.Fields[key] = value
+		}
+	}
+	return metadata
+}
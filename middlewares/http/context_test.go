@@ -0,0 +1,176 @@
+package firetail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteAndPathParamsAreInContext(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiBytes: []byte(`
+openapi: 3.0.1
+info:
+  title: Test spec
+  version: 1.0.0
+paths:
+  /pets/{petId}:
+    get:
+      operationId: getPet
+      x-rate-limit: 10
+      parameters:
+        - name: petId
+          in: path
+          required: true
+          schema:
+            type: string
+      responses:
+        "200":
+          description: A pet
+`),
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+
+	var route *routers.Route
+	var pathParams map[string]string
+	var hasRoute, hasPathParams bool
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, hasRoute = RouteFromContext(r.Context())
+		pathParams, hasPathParams = PathParamsFromContext(r.Context())
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/pets/fido", nil))
+
+	require.Equal(t, 200, responseRecorder.Code)
+	require.True(t, hasRoute)
+	assert.Equal(t, "/pets/{petId}", route.Path)
+	assert.Equal(t, "GET", route.Method)
+	assert.Equal(t, "getPet", route.Operation.OperationID)
+	assert.Equal(t, json.RawMessage("10"), route.Operation.Extensions["x-rate-limit"])
+	require.True(t, hasPathParams)
+	assert.Equal(t, map[string]string{"petId": "fido"}, pathParams)
+}
+
+func TestRouteIsNotInContextWithoutValidation(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{OpenapiSpecPath: "./test-spec.yaml"})
+	require.Nil(t, err)
+
+	hasRoute, hasPathParams := true, true
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasRoute = RouteFromContext(r.Context())
+		_, hasPathParams = PathParamsFromContext(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/implemented/1", nil))
+
+	assert.False(t, hasRoute)
+	assert.False(t, hasPathParams)
+}
+
+func TestRouteFromEmptyContext(t *testing.T) {
+	route, ok := RouteFromContext(context.Background())
+	assert.Nil(t, route)
+	assert.False(t, ok)
+
+	pathParams, ok := PathParamsFromContext(context.Background())
+	assert.Nil(t, pathParams)
+	assert.False(t, ok)
+}
+
+func TestMetadataIsLogged(t *testing.T) {
+	var sanitisedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				SetPrincipal(ctx, "test-principal")
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			sanitisedEntry = logEntry
+			delete(logEntry.Metadata.Fields, "email")
+			return logEntry
+		},
+		LogBatchCallback: func(batch [][]byte, metadata logging.BatchMetadata) error { return nil },
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddLogTags(r.Context(), "new-checkout")
+		AddLogTags(r.Context(), "beta", "eu")
+		assert.Nil(t, AddLogField(r.Context(), "customerId", 123))
+		assert.Nil(t, AddLogField(r.Context(), "outcome", map[string]string{"result": "created"}))
+		assert.Nil(t, AddLogField(r.Context(), "email", "test@example.com"))
+		healthHandler.ServeHTTP(w, r)
+	}))
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	// The metadata should be passed to the sanitiser
+	require.NotNil(t, sanitisedEntry.Metadata)
+	assert.Equal(t, &logging.Metadata{
+		Principal: "test-principal",
+		Tags:      []string{"new-checkout", "beta", "eu"},
+		Fields: map[string]json.RawMessage{
+			"customerId": json.RawMessage("123"),
+			"outcome":    json.RawMessage("{\"result\":\"created\"}"),
+		},
+	}, sanitisedEntry.Metadata)
+
+	marshalledEntry, err := sanitisedEntry.Marshal()
+	require.Nil(t, err)
+	assert.Contains(t, string(marshalledEntry), "\"metadata\":{\"principal\":\"test-principal\",\"tags\":[\"new-checkout\",\"beta\",\"eu\"],\"fields\":{\"customerId\":123,\"outcome\":{\"result\":\"created\"}}}")
+}
+
+func TestMetadataIsOmittedIfNoneIsAdded(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	middleware(healthHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	assert.Nil(t, loggedEntry.Metadata)
+}
+
+func TestAddLogFieldWithInvalidValue(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotNil(t, AddLogField(r.Context(), "channel", make(chan int)))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	assert.Nil(t, loggedEntry.Metadata)
+}
+
+func TestMetadataOutsideMiddleware(t *testing.T) {
+	// These should all be no-ops, so handlers can be used without the middleware, e.g. in their own tests
+	SetPrincipal(context.Background(), "test-principal")
+	AddLogTags(context.Background(), "test-tag")
+	assert.Nil(t, AddLogField(context.Background(), "test-field", make(chan int)))
+}
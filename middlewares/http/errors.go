@@ -1,6 +1,8 @@
 package firetail
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/getkin/kin-openapi/openapi3filter"
@@ -262,3 +264,32 @@ func (e ErrorResponseStatusCodeInvalid) Title() string {
 func (e ErrorResponseStatusCodeInvalid) Error() string {
 	return fmt.Sprintf("the response's status code did not match your appspec: %d", e.RespondedStatusCode)
 }
+
+// ErrorRequestCancelled is used when a request's context is done before its validation completes, e.g. because the client disconnected or
+// the request's deadline passed. Validation is abandoned, and any response to the request is discarded
+type ErrorRequestCancelled struct {
+	Err error // The err from the request's context, context.Canceled or context.DeadlineExceeded
+}
+
+func (e ErrorRequestCancelled) StatusCode() int {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return 503
+	}
+	// There's no standard status code for a request the client has abandoned, so we use the non-standard 499 popularised by nginx
+	return 499
+}
+
+func (e ErrorRequestCancelled) Title() string {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return "the request timed out"
+	}
+	return "the request was cancelled"
+}
+
+func (e ErrorRequestCancelled) Error() string {
+	return fmt.Sprintf("the request was cancelled during validation: %s", e.Err.Error())
+}
+
+func (e ErrorRequestCancelled) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,79 @@
+package firetail
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// eventStream is used by a responseWriter when the response is a stream of Server-Sent Events. It holds onto any partially written
+// event until it's complete, then optionally validates it & passes it through to the client, flushing after every event
+type eventStream struct {
+	pending       bytes.Buffer            // Bytes written by the handler which don't yet make up a complete event
+	eventCount    int64                   // The number of events with a data payload which have been passed through to the client
+	validateEvent func(data string) error // An optional func used to validate each event's data payload before it's sent to the client
+	err           error                   // Set if an event failed to validate, after which the stream accepts no more writes
+}
+
+// isEventStream returns true if the Content-Type in the headers provided is text/event-stream
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// nextEvent removes the first complete event from the pending bytes & returns it, including the blank line that terminated it
+func (es *eventStream) nextEvent() ([]byte, bool) {
+	pending := es.pending.Bytes()
+	end := -1
+	for _, terminator := range [][]byte{[]byte("\n\n"), []byte("\r\n\r\n")} {
+		if i := bytes.Index(pending, terminator); i != -1 && (end == -1 || i+len(terminator) < end) {
+			end = i + len(terminator)
+		}
+	}
+	if end == -1 {
+		return nil, false
+	}
+	event := make([]byte, end)
+	copy(event, es.pending.Next(end))
+	return event, true
+}
+
+// eventData returns the data payload of an event, which is the value of each of its data fields joined by newlines. If the event has
+// no data fields (e.g. it's a comment used as a keep-alive), false is returned
+func eventData(event []byte) (string, bool) {
+	dataLines := []string{}
+	for _, line := range strings.FieldsFunc(string(event), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		field, value, _ := strings.Cut(line, ":")
+		if field != "data" {
+			continue
+		}
+		dataLines = append(dataLines, strings.TrimPrefix(value, " "))
+	}
+	return strings.Join(dataLines, "\n"), len(dataLines) > 0
+}
+
+// validateEventData validates the data payload of an event against the text/event-stream schema declared for the status code of the
+// response in the route's operation. If the data payload is valid JSON it is decoded before validation, otherwise it is validated as a
+// string. If no such schema is declared, the event is considered valid
+func validateEventData(route *routers.Route, statusCode int, data string) error {
+	responseRef := route.Operation.Responses.Get(statusCode)
+	if responseRef == nil {
+		responseRef = route.Operation.Responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil {
+		return nil
+	}
+	mediaType := responseRef.Value.Content.Get("text/event-stream")
+	if mediaType == nil || mediaType.Schema == nil || mediaType.Schema.Value == nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		value = data
+	}
+	return mediaType.Schema.Value.VisitJSON(value)
+}
@@ -0,0 +1,103 @@
+package firetail
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hijackedConn wraps a net.Conn which has been hijacked from a http.ResponseWriter, counting the bytes read & written through it so
+// that the session can be logged to Firetail once the connection is closed
+type hijackedConn struct {
+	bytesReceived int64 // The number of bytes read from the connection; must be accessed atomically & kept 64-bit aligned
+	bytesSent     int64 // The number of bytes written to the connection; must be accessed atomically & kept 64-bit aligned
+	net.Conn
+	readWriter *bufio.ReadWriter // A bufio.ReadWriter which reads & writes through the hijackedConn, to be given to the hijacker
+	hijackedAt time.Time         // The time at which the connection was hijacked
+	closed     chan struct{}     // Closed when the connection is closed
+	closeOnce  sync.Once
+	closedAt   time.Time // The time at which the connection was closed; only safe to read after closed is closed
+}
+
+// newHijackedConn wraps conn & replaces the bufio.ReadWriter returned alongside it by http.Hijacker so that bytes read & written through
+// either of them are counted. Any bytes already buffered by brw's Reader are preserved
+func newHijackedConn(conn net.Conn, brw *bufio.ReadWriter) *hijackedConn {
+	hc := &hijackedConn{
+		Conn:       conn,
+		hijackedAt: time.Now(),
+		closed:     make(chan struct{}),
+	}
+	// Anything already written to brw's Writer needs to reach the client before we replace it
+	brw.Writer.Flush()
+	hc.readWriter = bufio.NewReadWriter(
+		bufio.NewReaderSize(&countingReader{brw.Reader, &hc.bytesReceived}, brw.Reader.Size()),
+		bufio.NewWriterSize(hc, brw.Writer.Size()),
+	)
+	return hc
+}
+
+// Read implements net.Conn
+func (hc *hijackedConn) Read(b []byte) (int, error) {
+	n, err := hc.Conn.Read(b)
+	atomic.AddInt64(&hc.bytesReceived, int64(n))
+	return n, err
+}
+
+// Write implements net.Conn
+func (hc *hijackedConn) Write(b []byte) (int, error) {
+	n, err := hc.Conn.Write(b)
+	atomic.AddInt64(&hc.bytesSent, int64(n))
+	return n, err
+}
+
+// Close implements net.Conn
+func (hc *hijackedConn) Close() error {
+	err := hc.Conn.Close()
+	hc.closeOnce.Do(func() {
+		hc.closedAt = time.Now()
+		close(hc.closed)
+	})
+	return err
+}
+
+// BytesReceived returns the number of bytes that have been read from the connection so far
+func (hc *hijackedConn) BytesReceived() int64 {
+	return atomic.LoadInt64(&hc.bytesReceived)
+}
+
+// BytesSent returns the number of bytes that have been written to the connection so far
+func (hc *hijackedConn) BytesSent() int64 {
+	return atomic.LoadInt64(&hc.bytesSent)
+}
+
+// countingReader wraps an io.Reader, atomically adding the number of bytes read through it to count
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
+
+// isUpgradeRequest returns true if the request is asking for the connection to be upgraded to another protocol, e.g. a WebSocket
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, connectionHeader := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(connectionHeader, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
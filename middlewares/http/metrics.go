@@ -0,0 +1,213 @@
+package firetail
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors a Middleware records the requests it handles in, if Options.MetricsRegisterer is set. Its methods
+// do nothing if it's nil
+type metrics struct {
+	registerer         prometheus.Registerer
+	requestDuration    *prometheus.HistogramVec
+	validationDuration *prometheus.HistogramVec
+	errors             *prometheus.CounterVec
+	logger             *loggerCollector
+}
+
+// newMetrics creates the Middleware's collectors & registers them on the MetricsRegisterer from the options. If the MetricsRegisterer is nil,
+// it returns nil. If any of the collectors can't be registered, none of them are
+func newMetrics(options *Options) (*metrics, error) {
+	if options.MetricsRegisterer == nil {
+		return nil, nil
+	}
+	m := &metrics{
+		registerer: options.MetricsRegisterer,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.MetricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "The time taken to handle each request, including validating it & its response, by method & the resource it matched in the OpenAPI spec.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "resource"}),
+		validationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.MetricsNamespace,
+			Name:      "validation_duration_seconds",
+			Help:      "The time taken to validate each request or response against the OpenAPI spec, by method, resource & stage (request or response).",
+			Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+		}, []string{"method", "resource", "stage"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.MetricsNamespace,
+			Name:      "errors_total",
+			Help:      "The number of requests which failed, e.g. because they or their response failed validation, by method, resource & the type of ErrorAtRequest.",
+		}, []string{"method", "resource", "error"}),
+		logger: newLoggerCollector(options.MetricsNamespace),
+	}
+
+	registered := []prometheus.Collector{}
+	for _, collector := range []prometheus.Collector{m.requestDuration, m.validationDuration, m.errors, m.logger} {
+		if err := m.registerer.Register(collector); err != nil {
+			for _, registeredCollector := range registered {
+				m.registerer.Unregister(registeredCollector)
+			}
+			return nil, err
+		}
+		registered = append(registered, collector)
+	}
+	return m, nil
+}
+
+// unregister unregisters all of the collectors, e.g. when the Middleware is closed or couldn't be created after they were registered
+func (m *metrics) unregister() {
+	if m == nil {
+		return
+	}
+	for _, collector := range []prometheus.Collector{m.requestDuration, m.validationDuration, m.errors, m.logger} {
+		m.registerer.Unregister(collector)
+	}
+}
+
+// setLogger sets the logger whose stats are collected
+func (m *metrics) setLogger(logger logger) {
+	if m == nil {
+		return
+	}
+	m.logger.mutex.Lock()
+	defer m.logger.mutex.Unlock()
+	m.logger.logger = logger
+}
+
+// observeRequest records the time taken to handle a request
+func (m *metrics) observeRequest(logEntry *logging.LogEntry, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.WithLabelValues(getMethodLabel(logEntry), logEntry.Request.Resource).Observe(duration.Seconds())
+}
+
+// observeValidation records the time taken to validate a request or response, depending upon the stage given
+func (m *metrics) observeValidation(logEntry *logging.LogEntry, stage string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.validationDuration.WithLabelValues(getMethodLabel(logEntry), logEntry.Request.Resource, stage).Observe(duration.Seconds())
+}
+
+// observeErr records an err that was passed to the ErrCallback, or that occurred whilst validating a stream of Server-Sent Events
+func (m *metrics) observeErr(logEntry *logging.LogEntry, err error) {
+	if m == nil {
+		return
+	}
+	errType := reflect.TypeOf(err)
+	if errType.Kind() == reflect.Ptr {
+		errType = errType.Elem()
+	}
+	m.errors.WithLabelValues(getMethodLabel(logEntry), logEntry.Request.Resource, errType.Name()).Inc()
+}
+
+// getMethodLabel returns the method label for a log entry's request. Non-standard methods are all labelled _OTHER, so a client can't create
+// an unbounded number of time series
+func getMethodLabel(logEntry *logging.LogEntry) string {
+	switch method := string(logEntry.Request.Method); method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "_OTHER"
+	}
+}
+
+// loggerCollector is a Prometheus collector which reports the stats of a Middleware's logger each time it's collected
+type loggerCollector struct {
+	mutex  sync.Mutex
+	logger logger
+
+	queueLength     *prometheus.Desc
+	inFlight        *prometheus.Desc
+	spoolLength     *prometheus.Desc
+	enqueued        *prometheus.Desc
+	dropped         *prometheus.Desc
+	batches         *prometheus.Desc
+	batchedEntries  *prometheus.Desc
+	sentBatches     *prometheus.Desc
+	sentEntries     *prometheus.Desc
+	failedBatches   *prometheus.Desc
+	failedEntries   *prometheus.Desc
+	spooledBatches  *prometheus.Desc
+	spooledEntries  *prometheus.Desc
+	replayedBatches *prometheus.Desc
+	replayedEntries *prometheus.Desc
+}
+
+func newLoggerCollector(namespace string) *loggerCollector {
+	newDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "log", name), help, labels, nil)
+	}
+	return &loggerCollector{
+		queueLength:     newDesc("queue_length", "The number of log entries waiting in the queue to be batched."),
+		inFlight:        newDesc("in_flight_entries", "The number of log entries in batches currently being sent."),
+		spoolLength:     newDesc("spool_length", "The number of log entries waiting in the spool to be replayed."),
+		enqueued:        newDesc("entries_enqueued_total", "The number of log entries accepted into the queue."),
+		dropped:         newDesc("entries_dropped_total", "The number of log entries dropped, by reason (overflow, closed, invalid or spool).", "reason"),
+		batches:         newDesc("batches_total", "The number of batches the log entries accepted into the queue have been arranged into."),
+		batchedEntries:  newDesc("entries_batched_total", "The number of log entries accepted into the queue that have been arranged into batches."),
+		sentBatches:     newDesc("batches_sent_total", "The number of batches sent successfully."),
+		sentEntries:     newDesc("entries_sent_total", "The number of log entries in batches sent successfully."),
+		failedBatches:   newDesc("batches_failed_total", "The number of batches which couldn't be sent."),
+		failedEntries:   newDesc("entries_failed_total", "The number of log entries in batches which couldn't be sent."),
+		spooledBatches:  newDesc("batches_spooled_total", "The number of batches written to the spool."),
+		spooledEntries:  newDesc("entries_spooled_total", "The number of log entries in batches written to the spool."),
+		replayedBatches: newDesc("batches_replayed_total", "The number of batches replayed successfully from the spool."),
+		replayedEntries: newDesc("entries_replayed_total", "The number of log entries in batches replayed successfully from the spool."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *loggerCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.queueLength, c.inFlight, c.spoolLength, c.enqueued, c.dropped, c.batches, c.batchedEntries, c.sentBatches, c.sentEntries,
+		c.failedBatches, c.failedEntries, c.spooledBatches, c.spooledEntries, c.replayedBatches, c.replayedEntries,
+	} {
+		descs <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *loggerCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	logger := c.logger
+	c.mutex.Unlock()
+	if logger == nil {
+		return
+	}
+	stats := logger.Stats()
+
+	gauge := func(desc *prometheus.Desc, value int64) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	counter := func(desc *prometheus.Desc, value int64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	gauge(c.queueLength, int64(stats.QueueLength))
+	gauge(c.inFlight, stats.InFlight)
+	gauge(c.spoolLength, stats.SpoolLength)
+	counter(c.enqueued, stats.Enqueued)
+	counter(c.dropped, stats.DroppedOverflow, "overflow")
+	counter(c.dropped, stats.DroppedClosed, "closed")
+	counter(c.dropped, stats.DroppedInvalid, "invalid")
+	counter(c.dropped, stats.DroppedSpool, "spool")
+	counter(c.batches, stats.Batches)
+	counter(c.batchedEntries, stats.BatchedEntries)
+	counter(c.sentBatches, stats.SentBatches)
+	counter(c.sentEntries, stats.SentEntries)
+	counter(c.failedBatches, stats.FailedBatches)
+	counter(c.failedEntries, stats.FailedEntries)
+	counter(c.spooledBatches, stats.SpooledBatches)
+	counter(c.spooledEntries, stats.SpooledEntries)
+	counter(c.replayedBatches, stats.ReplayedBatches)
+	counter(c.replayedEntries, stats.ReplayedEntries)
+}
@@ -0,0 +1,175 @@
+package firetail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsAreRecorded(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableRequestValidation:  true,
+		EnableResponseValidation: true,
+		MetricsRegisterer:        registry,
+		LogBatchCallback:         func(batch [][]byte, metadata logging.BatchMetadata) error { return nil },
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+
+	for _, body := range []string{"{\"description\":\"test description\"}", "{\"description\":\"test description\"}", "{}"} {
+		request := httptest.NewRequest("POST", "/implemented/1", io.NopCloser(bytes.NewBuffer([]byte(body))))
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("X-Api-Key", "valid-api-key")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/not-implemented", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/not-implemented", nil))
+	require.Nil(t, middleware.Flush(context.Background()))
+
+	assert.Equal(t, 3, testutil.CollectAndCount(middleware.metrics.requestDuration))
+	assert.Equal(t, uint64(3), getHistogramCount(t, middleware.metrics.requestDuration, "POST", "/implemented/{testparam}"))
+	assert.Equal(t, uint64(1), getHistogramCount(t, middleware.metrics.requestDuration, "GET", ""))
+
+	// Only the valid requests should have got as far as their response being validated
+	assert.Equal(t, uint64(3), getHistogramCount(t, middleware.metrics.validationDuration, "POST", "/implemented/{testparam}", "request"))
+	assert.Equal(t, uint64(2), getHistogramCount(t, middleware.metrics.validationDuration, "POST", "/implemented/{testparam}", "response"))
+
+	// Requests which don't match a route should be labelled with an empty resource, and methods that aren't standard with _OTHER
+	assert.Equal(t, float64(1), testutil.ToFloat64(middleware.metrics.errors.WithLabelValues("POST", "/implemented/{testparam}", "ErrorRequestBodyInvalid")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(middleware.metrics.errors.WithLabelValues("GET", "", "ErrorRouteNotFound")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(middleware.metrics.errors.WithLabelValues("_OTHER", "", "ErrorRouteNotFound")))
+
+	expectedLoggerMetrics := `
+		# HELP firetail_log_entries_enqueued_total The number of log entries accepted into the queue.
+		# TYPE firetail_log_entries_enqueued_total counter
+		firetail_log_entries_enqueued_total 5
+		# HELP firetail_log_entries_sent_total The number of log entries in batches sent successfully.
+		# TYPE firetail_log_entries_sent_total counter
+		firetail_log_entries_sent_total 5
+		# HELP firetail_log_entries_dropped_total The number of log entries dropped, by reason (overflow, closed, invalid or spool).
+		# TYPE firetail_log_entries_dropped_total counter
+		firetail_log_entries_dropped_total{reason="closed"} 0
+		firetail_log_entries_dropped_total{reason="invalid"} 0
+		firetail_log_entries_dropped_total{reason="overflow"} 0
+		firetail_log_entries_dropped_total{reason="spool"} 0
+		# HELP firetail_log_queue_length The number of log entries waiting in the queue to be batched.
+		# TYPE firetail_log_queue_length gauge
+		firetail_log_queue_length 0
+	`
+	assert.Nil(t, testutil.GatherAndCompare(
+		registry, strings.NewReader(expectedLoggerMetrics),
+		"firetail_log_entries_enqueued_total", "firetail_log_entries_sent_total", "firetail_log_entries_dropped_total", "firetail_log_queue_length",
+	))
+
+	// The logger's collector should report every one of its metrics
+	assert.Equal(t, 18, testutil.CollectAndCount(middleware.metrics.logger))
+	assert.Nil(t, middleware.Close(context.Background()))
+}
+
+// getHistogramCount returns the number of observations made by the histogram with the label values given
+func getHistogramCount(t *testing.T, histogramVec *prometheus.HistogramVec, labelValues ...string) uint64 {
+	histogram, err := histogramVec.GetMetricWithLabelValues(labelValues...)
+	require.Nil(t, err)
+	registry := prometheus.NewPedanticRegistry()
+	require.Nil(t, registry.Register(histogram.(prometheus.Collector)))
+	metricFamilies, err := registry.Gather()
+	require.Nil(t, err)
+	require.Len(t, metricFamilies, 1)
+	require.Len(t, metricFamilies[0].Metric, 1)
+	return metricFamilies[0].Metric[0].Histogram.GetSampleCount()
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware, err := NewMiddleware(&Options{
+		MetricsRegisterer: registry,
+		MetricsNamespace:  "api",
+	})
+	require.Nil(t, err)
+	middleware.Handler(healthHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+
+	metricFamilies, err := registry.Gather()
+	require.Nil(t, err)
+	names := []string{}
+	for _, metricFamily := range metricFamilies {
+		names = append(names, metricFamily.GetName())
+	}
+	assert.Contains(t, names, "api_request_duration_seconds")
+	assert.Contains(t, names, "api_log_entries_enqueued_total")
+	for _, name := range names {
+		assert.True(t, strings.HasPrefix(name, "api_"), name)
+	}
+}
+
+func TestMetricsRegistrationConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := NewMiddleware(&Options{MetricsRegisterer: registry})
+	require.Nil(t, err)
+
+	_, err = NewMiddleware(&Options{MetricsRegisterer: registry})
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+
+	// Giving each middleware its own labels should avoid the conflict
+	registry = prometheus.NewRegistry()
+	for _, name := range []string{"first", "second"} {
+		_, err = NewMiddleware(&Options{MetricsRegisterer: prometheus.WrapRegistererWith(prometheus.Labels{"middleware": name}, registry)})
+		assert.Nil(t, err)
+	}
+}
+
+func TestMetricsAreUnregisteredIfMiddlewareCantBeCreated(t *testing.T) {
+	directory := t.TempDir()
+	blockingFile := filepath.Join(directory, "file")
+	require.Nil(t, os.WriteFile(blockingFile, []byte{}, 0600))
+
+	registry := prometheus.NewRegistry()
+	_, err := NewMiddleware(&Options{
+		MetricsRegisterer: registry,
+		LogSpoolOptions:   &logging.SpoolOptions{Directory: filepath.Join(blockingFile, "spool")},
+	})
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+
+	_, err = NewMiddleware(&Options{MetricsRegisterer: registry})
+	assert.Nil(t, err)
+}
+
+func TestMetricsAreUnregisteredWhenMiddlewareIsClosed(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware, err := NewMiddleware(&Options{MetricsRegisterer: registry})
+	require.Nil(t, err)
+	require.Nil(t, middleware.Close(context.Background()))
+
+	metricFamilies, err := registry.Gather()
+	require.Nil(t, err)
+	assert.Empty(t, metricFamilies)
+
+	middleware, err = NewMiddleware(&Options{MetricsRegisterer: registry})
+	require.Nil(t, err)
+	assert.Nil(t, middleware.Close(context.Background()))
+}
+
+func TestMetricsMethodLabels(t *testing.T) {
+	for method, expectedLabel := range map[string]string{
+		http.MethodGet:     "GET",
+		http.MethodOptions: "OPTIONS",
+		"BREW":             "_OTHER",
+		"get":              "_OTHER",
+	} {
+		assert.Equal(t, expectedLabel, getMethodLabel(&logging.LogEntry{Request: logging.Request{Method: logging.Method(method)}}))
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httptest"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/FireTail-io/firetail-go-lib/logging"
@@ -18,223 +18,490 @@ import (
 	"github.com/getkin/kin-openapi/routers/gorillamux"
 )
 
+// logger is used by a Middleware to batch & send its log entries
+type logger interface {
+	Enqueue(*logging.LogEntry)
+	Flush(context.Context) error
+	Close(context.Context) error
+	Stats() logging.BatchLoggerStats
+}
+
+// Middleware is a firetail middleware, created by NewMiddleware. Its Handler method wraps a http.Handler, and its Flush & Close methods can be
+// used to make sure all of the log entries it has created have been sent before your application exits
+type Middleware struct {
+	options       *Options
+	router        routers.Router
+	logger        logger
+	metrics       *metrics
+	clientIP      func(*http.Request) string
+	upgradesMutex sync.Mutex
+	upgrades      sync.WaitGroup // Tracks the hijacked connections whose log entries are waiting for them to be closed
+	isClosing     bool           // Set by Close, after which hijacked connections are logged straight away; guarded by upgradesMutex
+	closing       chan struct{}  // Closed by Close, to tell the log entries waiting for hijacked connections to be closed to stop waiting
+}
+
 // GetMiddleware creates & returns a firetail middleware. Errs if the openapi spec can't be found, validated, or loaded into a gorillamux router.
 func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, error) {
+	middleware, err := NewMiddleware(options)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.Handler, nil
+}
+
+// NewMiddleware creates & returns a firetail Middleware. Errs if the openapi spec can't be found, validated, or loaded into a gorillamux router.
+func NewMiddleware(options *Options) (*Middleware, error) {
 	options.setDefaults() // Fill in any defaults where apropriate
 
 	// Load in our appspec, validate it & create a router from it if we have an appspec to load
-	router, err := getRouter(options)
+	doc, router, err := getRouter(options)
 	if err != nil {
 		return nil, err
 	}
 
+	// If a LogEntrySanitiser hasn't been provided, create one from the LogEntrySanitiserOptions, extended to mask the values the appspec
+	// marks as sensitive
+	if options.LogEntrySanitiser == nil {
+		sanitiserOptions := logging.DefaultSanitiserOptions()
+		if options.LogEntrySanitiserOptions != nil {
+			sanitiserOptions = *options.LogEntrySanitiserOptions
+		}
+		if doc != nil && !options.DisableSpecRedaction {
+			specRules, err := getSpecRedactionRules(doc)
+			if err != nil {
+				return nil, ErrorAppspecInvalid{err}
+			}
+			// The rules are copied so the slices in the LogEntrySanitiserOptions aren't modified
+			sanitiserOptions.RequestBodyRules = append(append([]logging.BodyRule{}, sanitiserOptions.RequestBodyRules...), specRules.requestBodyRules...)
+			sanitiserOptions.ResponseBodyRules = append(append([]logging.BodyRule{}, sanitiserOptions.ResponseBodyRules...), specRules.responseBodyRules...)
+			sanitiserOptions.ParameterRules = append(append([]logging.ParameterRule{}, sanitiserOptions.ParameterRules...), specRules.parameterRules...)
+			// Bodies which can't be parsed, such as response bodies truncated at MaxLoggedResponseBodySize, can't have their sensitive values
+			// masked, so they're removed instead
+			sanitiserOptions.RemoveUnparseableBodies = true
+		}
+		options.LogEntrySanitiser, err = logging.NewSanitiser(sanitiserOptions)
+		if err != nil {
+			return nil, ErrorInvalidConfiguration{err}
+		}
+	}
+
 	// Register any custom body decoders
 	for contentType, bodyDecoder := range options.CustomBodyDecoders {
 		openapi3filter.RegisterBodyDecoder(contentType, bodyDecoder)
 	}
 
+	// Resolve clients' IPs with the ClientIPResolver if one has been provided, otherwise trust the proxies in TrustedProxies
+	clientIP := options.ClientIPResolver
+	if clientIP == nil {
+		trustedProxies, err := parseTrustedProxies(options.TrustedProxies)
+		if err != nil {
+			return nil, ErrorInvalidConfiguration{err}
+		}
+		clientIP = (&clientIPResolver{trustedProxies}).resolve
+	}
+
+	// Register our metrics, if a registerer has been provided
+	metrics, err := newMetrics(options)
+	if err != nil {
+		return nil, ErrorInvalidConfiguration{err}
+	}
+
+	// Open the spool, if there is one, so that any batches left in it can be replayed
+	var spool *logging.Spool
+	if options.LogSpoolOptions != nil {
+		spool, err = logging.NewSpool(*options.LogSpoolOptions)
+		if err != nil {
+			metrics.unregister()
+			return nil, ErrorInvalidConfiguration{err}
+		}
+	}
+
 	// Create a batchLogger to pass all our log entries to
 	batchLogger := logging.NewBatchLogger(logging.BatchLoggerOptions{
-		MaxBatchSize:  1024 * 512,
-		MaxLogAge:     time.Minute,
-		BatchCallback: options.LogBatchCallback,
-		LogApiKey:     options.LogsApiToken,
-		LogApiUrl:     options.LogsApiUrl,
+		MaxBatchSize:             1024 * 512,
+		MaxLogAge:                time.Minute,
+		QueueCapacity:            options.LogQueueCapacity,
+		OverflowPolicy:           options.LogQueueOverflowPolicy,
+		BatchCallback:            options.LogBatchCallback,
+		Sink:                     options.LogSink,
+		LogApiKey:                options.LogsApiToken,
+		LogApiUrl:                options.LogsApiUrl,
+		Compression:              options.LogCompression,
+		HTTPClient:               options.LogsApiHTTPClient,
+		Transport:                options.LogsApiTransport,
+		TLSClientConfig:          options.LogsApiTLSConfig,
+		RequestTimeout:           options.LogsApiTimeout,
+		ExtraHeaders:             options.LogsApiHeaders,
+		MaxBatchSizeIsCompressed: options.LogMaxBatchSizeIsCompressed,
+		Spool:                    spool,
+		SpoolAllBatches:          options.LogSpoolAllBatches,
 	})
 
-	middleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Create a LogEntry populated with everything we know right now
-			logEntry := logging.LogEntry{
-				Version:     logging.The100Alpha,
-				DateCreated: time.Now().UnixMilli(),
-				Request: logging.Request{
-					HTTPProtocol: logging.HTTPProtocol(r.Proto),
-					Headers:      r.Header,
-					Method:       logging.Method(r.Method),
-					IP:           strings.Split(r.RemoteAddr, ":")[0],
-				},
+	metrics.setLogger(batchLogger)
+
+	return &Middleware{
+		options:  options,
+		router:   router,
+		logger:   batchLogger,
+		metrics:  metrics,
+		clientIP: clientIP,
+		closing:  make(chan struct{}),
+	}, nil
+}
+
+// Handler wraps next in the firetail middleware
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAt := time.Now()
+
+		// Create a LogEntry populated with everything we know right now
+		logEntry := logging.LogEntry{
+			Version:     logging.The100Alpha,
+			DateCreated: time.Now().UnixMilli(),
+			Request: logging.Request{
+				HTTPProtocol: logging.HTTPProtocol(r.Proto),
+				Headers:      r.Header,
+				Method:       logging.Method(r.Method),
+				IP:           m.clientIP(r),
+			},
+		}
+
+		if m.router != nil && (m.options.EnableRequestValidation || m.options.EnableResponseValidation) {
+			logEntry.Validation = &logging.Validation{Passed: true}
+		}
+		if r.TLS != nil {
+			logEntry.Request.URI = "https://" + r.Host + r.URL.RequestURI()
+		} else {
+			logEntry.Request.URI = "http://" + r.Host + r.URL.RequestURI()
+		}
+
+		// Correlate the log entry with the request's trace & ID, generating an ID for the request if it doesn't have one
+		if traceContext, hasTraceContext := getTraceContext(r); hasTraceContext {
+			logEntry.TraceID = traceContext.traceID
+			logEntry.SpanID = traceContext.parentID
+			logEntry.TraceState = traceContext.traceState
+		}
+		logEntry.RequestID = r.Header.Get(m.options.RequestIDHeader)
+		if logEntry.RequestID == "" {
+			logEntry.RequestID = m.options.RequestIDGenerator()
+			// The generated ID is set on a copy of the request's headers so the caller's request isn't modified, & the logged headers are
+			// only those the client sent
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			r.Header.Set(m.options.RequestIDHeader, logEntry.RequestID)
+		}
+		w.Header().Set(m.options.RequestIDHeader, logEntry.RequestID)
+
+		// Your AuthCallbacks & handler can add metadata to the log entry through the request's context
+		metadata := &logMetadata{}
+		r = r.WithContext(contextWithLogMetadata(r.Context(), metadata))
+
+		// Wrap the ResponseWriter so the response is streamed through to the client whilst we keep a copy for logging
+		localResponseWriter := newResponseWriter(w, m.options.MaxLoggedResponseBodySize)
+
+		// Any errs are recorded in the log entry's validation outcome & our metrics before they're passed to the ErrCallback
+		errCallback := func(err ErrorAtRequest) {
+			recordValidationErr(&logEntry, err)
+			m.metrics.observeErr(&logEntry, err)
+			m.options.ErrCallback(err, localResponseWriter, r)
+		}
+
+		// No matter what happens, make sure the response has been passed through to the client, then read the response from the
+		// local response writer & enqueue the log entry
+		defer func() {
+			localResponseWriter.finish()
+
+			logEntry.Response = logging.Response{
+				StatusCode: int64(localResponseWriter.StatusCode()),
+				Body:       string(localResponseWriter.LoggedBody()),
+				Headers:    localResponseWriter.Header().Clone(),
 			}
-			if r.TLS != nil {
-				logEntry.Request.URI = "https://" + r.Host + r.URL.RequestURI()
-			} else {
-				logEntry.Request.URI = "http://" + r.Host + r.URL.RequestURI()
+
+			// If the response was an event stream, we also log the number of events that were sent
+			if es := localResponseWriter.eventStream; es != nil {
+				logEntry.EventStream = &logging.EventStream{
+					EventCount: es.eventCount,
+					Truncated:  localResponseWriter.bytesWritten > int64(len(localResponseWriter.LoggedBody())),
+				}
+				if es.err != nil {
+					recordValidationErr(&logEntry, es.err)
+					m.metrics.observeErr(&logEntry, es.err)
+				}
 			}
 
-			// Create a Firetail ResponseWriter so we can access the response body, status code etc. for logging & validation later
-			localResponseWriter := httptest.NewRecorder()
+			m.metrics.observeRequest(&logEntry, time.Since(receivedAt))
 
-			// No matter what happens, read the response from the local response writer, enqueue the log entry & publish the response that was written to the ResponseWriter
-			defer func() {
-				logEntry.Response = logging.Response{
-					StatusCode: int64(localResponseWriter.Code),
-					Body:       string(localResponseWriter.Body.Bytes()),
-					Headers:    localResponseWriter.Result().Header,
+			// If the connection was hijacked, e.g. to upgrade it to a WebSocket, the log entry can't be completed until it's closed, or
+			// the middleware is closed, whichever happens first
+			if conn := localResponseWriter.conn; conn != nil {
+				upgrade := &logging.Upgrade{}
+				if isUpgradeRequest(r) {
+					logEntry.Response.StatusCode = http.StatusSwitchingProtocols
+					upgrade.Protocol = r.Header.Get("Upgrade")
 				}
+				m.upgradesMutex.Lock()
+				isClosing := m.isClosing
+				if !isClosing {
+					m.upgrades.Add(1)
+				}
+				m.upgradesMutex.Unlock()
+				go func() {
+					if !isClosing {
+						defer m.upgrades.Done()
+					}
+					select {
+					case <-conn.closed:
+						upgrade.Duration = float64(conn.closedAt.Sub(conn.hijackedAt)) / 1000000.0
+					case <-m.closing:
+						upgrade.Duration = float64(time.Since(conn.hijackedAt)) / 1000000.0
+						upgrade.Open = true
+					}
+					upgrade.BytesReceived = conn.BytesReceived()
+					upgrade.BytesSent = conn.BytesSent()
+					logEntry.Upgrade = upgrade
+					logEntry.Metadata = metadata.get()
+					logEntry = m.options.LogEntrySanitiser(logEntry)
+					m.logger.Enqueue(&logEntry)
+				}()
+				return
+			}
 
-				// Remember to sanitise the log entry before enqueueing it!
-				logEntry = options.LogEntrySanitiser(logEntry)
+			logEntry.Metadata = metadata.get()
 
-				batchLogger.Enqueue(&logEntry)
+			// Remember to sanitise the log entry before enqueueing it!
+			logEntry = m.options.LogEntrySanitiser(logEntry)
 
-				for key, vals := range localResponseWriter.HeaderMap {
-					for _, val := range vals {
-						w.Header().Add(key, val)
-					}
-				}
-				w.WriteHeader(localResponseWriter.Code)
-				w.Write(localResponseWriter.Body.Bytes())
-			}()
+			m.logger.Enqueue(&logEntry)
+		}()
 
-			// Read in the request body so we can log it & replace r.Body with a new copy for the next http.Handler to read from
-			requestBody, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
+		// Read in the request body so we can log it & replace r.Body with a new copy for the next http.Handler to read from
+		requestBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errCallback(ErrorAtRequestUnspecified{err})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+
+		// Now we have the request body, we can fill it into our log entry
+		logEntry.Request.Body = string(requestBody)
+
+		// Check there's a corresponding route for this request if we have a router
+		var route *routers.Route
+		var pathParams map[string]string
+		if m.router != nil && (m.options.EnableRequestValidation || m.options.EnableResponseValidation) {
+			route, pathParams, err = m.router.FindRoute(r)
+			if err == routers.ErrMethodNotAllowed {
+				errCallback(ErrorUnsupportedMethod{r.URL.Path, r.Method})
+				return
+			} else if err == routers.ErrPathNotFound {
+				errCallback(ErrorRouteNotFound{r.URL.Path})
+				return
+			} else if err != nil {
+				errCallback(ErrorAtRequestUnspecified{err})
 				return
 			}
-			r.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-
-			// Now we have the request body, we can fill it into our log entry
-			logEntry.Request.Body = string(requestBody)
-
-			// Check there's a corresponding route for this request if we have a router
-			var route *routers.Route
-			var pathParams map[string]string
-			if router != nil && (options.EnableRequestValidation || options.EnableResponseValidation) {
-				route, pathParams, err = router.FindRoute(r)
-				if err == routers.ErrMethodNotAllowed {
-					options.ErrCallback(ErrorUnsupportedMethod{r.URL.Path, r.Method}, localResponseWriter, r)
-					return
-				} else if err == routers.ErrPathNotFound {
-					options.ErrCallback(ErrorRouteNotFound{r.URL.Path}, localResponseWriter, r)
-					return
-				} else if err != nil {
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
-					return
-				}
-				// We now know the resource that was requested, so we can fill it into our log entry
-				logEntry.Request.Resource = route.Path
-			}
+			// We now know the resource that was requested, so we can fill it into our log entry
+			logEntry.Request.Resource = route.Path
+
+			// Downstream handlers can also get the route & path params from the request's context
+			r = r.WithContext(contextWithRoute(r.Context(), route, pathParams))
+		}
 
-			// If it has been enabled, and we were able to determine the route and path params, validate the request against the openapi spec
-			if options.EnableRequestValidation && route != nil && pathParams != nil {
-				requestValidationInput := &openapi3filter.RequestValidationInput{
-					Request:    r,
-					PathParams: pathParams,
-					Route:      route,
-					Options: &openapi3filter.Options{
-						AuthenticationFunc: func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
-							authCallback, hasAuthCallback := options.AuthCallbacks[ai.SecuritySchemeName]
-							if !hasAuthCallback {
-								return ErrorAuthSchemeNotImplemented{ai.SecuritySchemeName}
-							}
-							return authCallback(ctx, ai)
-						},
+		// If it has been enabled, and we were able to determine the route and path params, validate the request against the openapi spec
+		if m.options.EnableRequestValidation && route != nil && pathParams != nil {
+			requestValidationInput := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					AuthenticationFunc: func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+						authCallback, hasAuthCallback := m.options.AuthCallbacks[ai.SecuritySchemeName]
+						if !hasAuthCallback {
+							return ErrorAuthSchemeNotImplemented{ai.SecuritySchemeName}
+						}
+						return authCallback(ctx, ai)
 					},
+				},
+			}
+			// The request's context is passed through to the AuthCallbacks, so they can make use of its values, deadline & cancellation
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				errCallback(ErrorRequestCancelled{ctxErr})
+				return
+			}
+			validationStart := time.Now()
+			err = openapi3filter.ValidateRequest(r.Context(), requestValidationInput)
+			m.metrics.observeValidation(&logEntry, "request", time.Since(validationStart))
+			if err != nil {
+				// If the request's context is done, the err is most likely a consequence of it, e.g. an AuthCallback giving up
+				if ctxErr := r.Context().Err(); ctxErr != nil {
+					errCallback(ErrorRequestCancelled{ctxErr})
+					return
 				}
-				err = openapi3filter.ValidateRequest(context.Background(), requestValidationInput)
-				if err != nil {
-					// If the err is an openapi3filter RequestError, we can extract more information from the err...
-					if err, isRequestErr := err.(*openapi3filter.RequestError); isRequestErr {
-						// TODO: Using strings.Contains is janky here and may break - should replace with something more reliable
-						// See the following open issue on the kin-openapi repo: https://github.com/getkin/kin-openapi/issues/477
-						// TODO: Open source contribution to kin-openapi?
-						if strings.Contains(err.Reason, "header Content-Type has unexpected value") {
-							options.ErrCallback(ErrorRequestContentTypeInvalid{r.Header.Get("Content-Type"), route.Path}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "body has an error") {
-							options.ErrCallback(ErrorRequestBodyInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "header has an error") {
-							options.ErrCallback(ErrorRequestHeadersInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "query has an error") {
-							options.ErrCallback(ErrorRequestQueryParamsInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "path has an error") {
-							options.ErrCallback(ErrorRequestPathParamsInvalid{err}, localResponseWriter, r)
-							return
-						}
-					}
 
-					// If the validation fails due to a security requirement, we pass a SecurityRequirementsError to the ErrCallback
-					if err, isSecurityErr := err.(*openapi3filter.SecurityRequirementsError); isSecurityErr {
-						options.ErrCallback(ErrorAuthNoMatchingScheme{err}, localResponseWriter, r)
+				// If the err is an openapi3filter RequestError, we can extract more information from the err...
+				if err, isRequestErr := err.(*openapi3filter.RequestError); isRequestErr {
+					// TODO: Using strings.Contains is janky here and may break - should replace with something more reliable
+					// See the following open issue on the kin-openapi repo: https://github.com/getkin/kin-openapi/issues/477
+					// TODO: Open source contribution to kin-openapi?
+					if strings.Contains(err.Reason, "header Content-Type has unexpected value") {
+						errCallback(ErrorRequestContentTypeInvalid{r.Header.Get("Content-Type"), route.Path})
+						return
+					}
+					if strings.Contains(err.Error(), "body has an error") {
+						errCallback(ErrorRequestBodyInvalid{err})
 						return
 					}
+					if strings.Contains(err.Error(), "header has an error") {
+						errCallback(ErrorRequestHeadersInvalid{err})
+						return
+					}
+					if strings.Contains(err.Error(), "query has an error") {
+						errCallback(ErrorRequestQueryParamsInvalid{err})
+						return
+					}
+					if strings.Contains(err.Error(), "path has an error") {
+						errCallback(ErrorRequestPathParamsInvalid{err})
+						return
+					}
+				}
 
-					// Else, we just use a non-specific ValidationError error
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
+				// If the validation fails due to a security requirement, we pass a SecurityRequirementsError to the ErrCallback
+				if err, isSecurityErr := err.(*openapi3filter.SecurityRequirementsError); isSecurityErr {
+					errCallback(ErrorAuthNoMatchingScheme{err})
 					return
 				}
+
+				// Else, we just use a non-specific ValidationError error
+				errCallback(ErrorAtRequestUnspecified{err})
+				return
 			}
+		}
 
-			// Serve the next handler down the chain & take note of the execution time
-			chainResponseWriter := httptest.NewRecorder()
-			startTime := time.Now()
-			next.ServeHTTP(chainResponseWriter, r)
-			logEntry.ExecutionTime = float64(time.Since(startTime)) / 1000000.0
-
-			// If it has been enabled, and we were able to determine the route and path params, validate the response against the openapi spec
-			if options.EnableResponseValidation && route != nil && pathParams != nil {
-				responseValidationInput := &openapi3filter.ResponseValidationInput{
-					RequestValidationInput: &openapi3filter.RequestValidationInput{
-						Request:    r,
-						PathParams: pathParams,
-						Route:      route,
-					},
-					Status: chainResponseWriter.Result().StatusCode,
-					Header: chainResponseWriter.Header(),
-					Options: &openapi3filter.Options{
-						IncludeResponseStatus: true,
-					},
-				}
-				responseBytes, err := ioutil.ReadAll(chainResponseWriter.Result().Body)
-				if err != nil {
-					options.ErrCallback(ErrorResponseBodyInvalid{err}, localResponseWriter, r)
+		// If it has been enabled, and we were able to determine the route and path params, we'll need to validate the response against
+		// the openapi spec before it's sent to the client, so the response must be buffered. Otherwise, it's streamed straight through.
+		// Requests to upgrade the connection (e.g. WebSocket handshakes) are never buffered, as the handler will need to hijack it
+		validateResponse := m.options.EnableResponseValidation && route != nil && pathParams != nil && !isUpgradeRequest(r)
+		var chainResponseWriter *responseWriter
+		if validateResponse {
+			chainResponseWriter = newBufferedResponseWriter(localResponseWriter)
+			// If the response turns out to be a stream of Server-Sent Events, it can't be buffered, so each event is validated instead
+			localResponseWriter.validateEvent = func(data string) error {
+				return validateEventData(route, localResponseWriter.StatusCode(), data)
+			}
+		} else {
+			chainResponseWriter = localResponseWriter
+		}
+
+		// Serve the next handler down the chain & take note of the execution time
+		startTime := time.Now()
+		next.ServeHTTP(chainResponseWriter, r)
+		logEntry.ExecutionTime = float64(time.Since(startTime)) / 1000000.0
+
+		// If the handler hijacked the connection, there's no response for us to validate. Likewise, if the response turned out to be
+		// an event stream then it's already been passed through to the client, with each event validated as it was written
+		if !validateResponse || localResponseWriter.conn != nil || !chainResponseWriter.buffered {
+			return
+		}
+
+		responseValidationInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+			},
+			Status: chainResponseWriter.StatusCode(),
+			Header: chainResponseWriter.Header(),
+			Options: &openapi3filter.Options{
+				IncludeResponseStatus: true,
+			},
+		}
+		responseValidationInput.SetBodyBytes(chainResponseWriter.buffer.Bytes())
+		// If the request's context is done, e.g. because the client disconnected whilst the handler was serving it, there's no point
+		// validating the response as there's no one to send it to
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			errCallback(ErrorRequestCancelled{ctxErr})
+			return
+		}
+		validationStart := time.Now()
+		err = openapi3filter.ValidateResponse(r.Context(), responseValidationInput)
+		m.metrics.observeValidation(&logEntry, "response", time.Since(validationStart))
+		if err != nil {
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				errCallback(ErrorRequestCancelled{ctxErr})
+				return
+			}
+			if responseError, isResponseError := err.(*openapi3filter.ResponseError); isResponseError {
+				if responseError.Reason == "response body doesn't match the schema" {
+					errCallback(ErrorResponseBodyInvalid{responseError})
 					return
-				}
-				responseValidationInput.SetBodyBytes(responseBytes)
-				err = openapi3filter.ValidateResponse(context.Background(), responseValidationInput)
-				if err != nil {
-					if responseError, isResponseError := err.(*openapi3filter.ResponseError); isResponseError {
-						if responseError.Reason == "response body doesn't match the schema" {
-							options.ErrCallback(ErrorResponseBodyInvalid{responseError}, localResponseWriter, r)
-							return
-						} else if responseError.Reason == "status is not supported" {
-							options.ErrCallback(ErrorResponseStatusCodeInvalid{responseError.Input.Status}, localResponseWriter, r)
-							return
-						}
-					}
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
+				} else if responseError.Reason == "status is not supported" {
+					errCallback(ErrorResponseStatusCodeInvalid{responseError.Input.Status})
 					return
 				}
 			}
+			errCallback(ErrorAtRequestUnspecified{err})
+			return
+		}
 
-			// If the response written down the chain passed all of the enabled validation, we can now write it to our localResponseWriter
-			for key, vals := range chainResponseWriter.HeaderMap {
-				for _, val := range vals {
-					localResponseWriter.Header().Add(key, val)
-				}
-			}
-			localResponseWriter.WriteHeader(chainResponseWriter.Code)
-			localResponseWriter.Write(chainResponseWriter.Body.Bytes())
-		})
+		// If the response written down the chain passed all of the enabled validation, we can now write it to our localResponseWriter
+		chainResponseWriter.release()
+	})
+}
+
+// Flush passes any log entries the Middleware is holding onto to its batch callback, then waits until the callback has finished handling
+// them. If ctx is done first, ctx.Err() is returned
+func (m *Middleware) Flush(ctx context.Context) error {
+	return m.logger.Flush(ctx)
+}
+
+// Close stops the Middleware from logging any more requests, passes any log entries it is holding onto to its batch callback, then waits until
+// the callback has finished handling them. If any log entries were dropped, or ctx is done first, a logging.ErrorLogEntriesDropped is
+// returned. Close should be called when your server shuts down, for example by registering it with http.Server.RegisterOnShutdown. Any
+// hijacked connections which are still open, such as WebSockets, are logged as they are when Close is called rather than waiting for them
+// to be closed. Log entries for requests which finish after Close is called are dropped, & counted as such by the logger's stats & metrics.
+// If ctx is done before the Sink's writes have returned, they're cancelled & the Sink is left open until Close is called again. Close also
+// unregisters the Middleware's collectors from its MetricsRegisterer
+func (m *Middleware) Close(ctx context.Context) error {
+	m.upgradesMutex.Lock()
+	if !m.isClosing {
+		m.isClosing = true
+		close(m.closing)
 	}
+	m.upgradesMutex.Unlock()
 
-	return middleware, nil
+	// Wait for the log entries of any open hijacked connections to be enqueued before the logger stops accepting them
+	upgradesLogged := make(chan struct{})
+	go func() {
+		m.upgrades.Wait()
+		close(upgradesLogged)
+	}()
+	select {
+	case <-upgradesLogged:
+	case <-ctx.Done():
+	}
+	err := m.logger.Close(ctx)
+
+	// Unregister our metrics so another Middleware can register them on the same MetricsRegisterer
+	m.metrics.unregister()
+	return err
+}
+
+// recordValidationErr marks the log entry as having failed validation with err, if validation was enabled. Only a description of err
+// without any of the values that failed validation is recorded, as the sanitiser doesn't mask it
+func recordValidationErr(logEntry *logging.LogEntry, err error) {
+	if logEntry.Validation == nil {
+		return
+	}
+	logEntry.Validation.Passed = false
+	logEntry.Validation.Error = describeValidationErr(err)
 }
 
-func getRouter(options *Options) (routers.Router, error) {
+func getRouter(options *Options) (*openapi3.T, routers.Router, error) {
 	hasBytes := options.OpenapiBytes != nil && len(options.OpenapiBytes) > 0
 	hasSpecPath := options.OpenapiSpecPath != ""
 
 	if !hasBytes && !hasSpecPath {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	loader := &openapi3.Loader{Context: context.Background(), IsExternalRefsAllowed: true}
@@ -247,21 +514,21 @@ func getRouter(options *Options) (routers.Router, error) {
 		doc, err = loader.LoadFromFile(options.OpenapiSpecPath)
 	}
 	if err != nil {
-		return nil, ErrorInvalidConfiguration{err}
+		return nil, nil, ErrorInvalidConfiguration{err}
 	}
 	if doc == nil {
-		return nil, ErrorInvalidConfiguration{errors.New("OpenAPI doc was nil after loading from file or data")}
+		return nil, nil, ErrorInvalidConfiguration{errors.New("OpenAPI doc was nil after loading from file or data")}
 	}
 
 	err = doc.Validate(context.Background())
 	if err != nil {
-		return nil, ErrorAppspecInvalid{err}
+		return nil, nil, ErrorAppspecInvalid{err}
 	}
 
 	router, err := gorillamux.NewRouter(doc)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return router, nil
+	return doc, router, nil
 }
@@ -1,16 +1,22 @@
 package firetail
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	_ "embed"
 
+	"github.com/FireTail-io/firetail-go-lib/logging"
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/openapi3filter"
 	"github.com/sbabiv/xml2map"
@@ -121,6 +127,16 @@ func TestInvalidSpecPath(t *testing.T) {
 	require.Equal(t, "invalid configuration: open ./test-spec-not-here.yaml: no such file or directory", err.Error())
 }
 
+func TestInvalidLogEntrySanitiserOptions(t *testing.T) {
+	_, err := NewMiddleware(&Options{
+		LogEntrySanitiserOptions: &logging.SanitiserOptions{
+			RequestBodyRules: []logging.BodyRule{{Selector: "password"}},
+		},
+	})
+	require.IsType(t, ErrorInvalidConfiguration{}, err)
+	assert.Contains(t, err.Error(), "invalid request body rules")
+}
+
 func TestInvalidSpec(t *testing.T) {
 	_, err := GetMiddleware(&Options{
 		OpenapiSpecPath: "./test-spec-invalid.yaml",
@@ -557,6 +573,172 @@ func TestInvalidResponseCode(t *testing.T) {
 	)
 }
 
+func TestValidationOutcomeIsLogged(t *testing.T) {
+	for _, testCase := range []struct {
+		options            Options
+		handler            http.Handler
+		expectedValidation *logging.Validation
+	}{
+		{
+			Options{EnableRequestValidation: true, EnableResponseValidation: true},
+			healthHandler,
+			&logging.Validation{Passed: true},
+		},
+		{
+			Options{EnableResponseValidation: true},
+			healthHandlerWithWrongResponseCode,
+			&logging.Validation{Passed: false, Error: "the response's status code did not match your appspec: 201"},
+		},
+		{
+			Options{},
+			healthHandlerWithWrongResponseCode,
+			nil,
+		},
+	} {
+		var loggedEntry logging.LogEntry
+		testCase.options.OpenapiSpecPath = "./test-spec.yaml"
+		testCase.options.AuthCallbacks = authCallbacks
+		testCase.options.LogEntrySanitiser = func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		}
+		middleware, err := GetMiddleware(&testCase.options)
+		require.Nil(t, err)
+		handler := middleware(testCase.handler)
+
+		request := httptest.NewRequest(
+			"POST", "/implemented/1",
+			io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+		)
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("X-Api-Key", "valid-api-key")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		assert.Equal(t, testCase.expectedValidation, loggedEntry.Validation)
+	}
+}
+
+func TestTraceContextAndRequestIDAreLogged(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logging.DefaultSanitiser()(logEntry)
+			return loggedEntry
+		},
+	})
+	require.Nil(t, err)
+	var handlerRequestID string
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = r.Header.Get("X-Request-Id")
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	request.Header.Set("X-Request-Id", "test-request-id")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", loggedEntry.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", loggedEntry.SpanID)
+	assert.Equal(t, "congo=t61rcWkgMzE", loggedEntry.TraceState)
+	assert.Equal(t, "test-request-id", loggedEntry.RequestID)
+	assert.Equal(t, "test-request-id", handlerRequestID)
+	assert.Equal(t, []string{"test-request-id"}, responseRecorder.Header().Values("X-Request-Id"))
+}
+
+func TestInvalidTraceparentIsNotLogged(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	request.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Empty(t, loggedEntry.TraceID)
+	assert.Empty(t, loggedEntry.SpanID)
+	assert.Empty(t, loggedEntry.TraceState)
+}
+
+func TestRequestIDIsGenerated(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		RequestIDHeader:    "X-Correlation-Id",
+		RequestIDGenerator: func() string { return "generated-request-id" },
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	var handlerRequestID string
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = r.Header.Get("X-Correlation-Id")
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Set("X-Request-Id", "ignored-request-id")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "generated-request-id", loggedEntry.RequestID)
+	assert.Equal(t, "generated-request-id", handlerRequestID)
+	assert.Equal(t, "generated-request-id", responseRecorder.Header().Get("X-Correlation-Id"))
+	assert.Empty(t, responseRecorder.Header().Get("X-Request-Id"))
+}
+
+func TestGeneratedRequestIDIsNotLoggedAsARequestHeader(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		RequestIDGenerator: func() string { return "generated-request-id" },
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	var handlerRequestID string
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = r.Header.Get("X-Request-Id")
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "generated-request-id", loggedEntry.RequestID)
+	assert.Equal(t, "generated-request-id", handlerRequestID)
+	assert.NotContains(t, loggedEntry.Request.Headers, "X-Request-Id")
+	assert.Empty(t, request.Header.Get("X-Request-Id"))
+}
+
+func TestRequestIDIsSetOnErrResponse(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/not-implemented", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 404, responseRecorder.Code)
+	assert.NotEmpty(t, responseRecorder.Header().Get("X-Request-Id"))
+}
+
 func TestDisabledRequestValidation(t *testing.T) {
 	middleware, err := GetMiddleware(&Options{
 		OpenapiSpecPath: "./test-spec.yaml",
@@ -678,3 +860,670 @@ func TestCustomXMLDecoder(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, "{\"description\":\"test description\"}", string(respBody))
 }
+
+func TestResponseIsStreamed(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain")
+		w.Write([]byte("first chunk"))
+		flusher, isFlusher := w.(http.Flusher)
+		require.True(t, isFlusher)
+		flusher.Flush()
+
+		// The first chunk should've reached the client before the handler has returned
+		assert.True(t, responseRecorder.Flushed)
+		assert.Equal(t, "first chunk", responseRecorder.Body.String())
+
+		w.Write([]byte(", second chunk"))
+	}))
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "text/plain", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "first chunk, second chunk", responseRecorder.Body.String())
+}
+
+func TestLoggedResponseBodyIsTruncated(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		MaxLoggedResponseBodySize: 8,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "{\"description\":\"test description\"}", responseRecorder.Body.String())
+	assert.Equal(t, "{\"descri", loggedEntry.Response.Body)
+	assert.Equal(t, int64(200), loggedEntry.Response.StatusCode)
+}
+
+// readerFromRecorder is a httptest.ResponseRecorder which implements io.ReaderFrom, like the ResponseWriters of a http.Server
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFromCalled bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFromCalled = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	for _, underlyingIsReaderFrom := range []bool{true, false} {
+		var loggedEntry logging.LogEntry
+		middleware, err := GetMiddleware(&Options{
+			MaxLoggedResponseBodySize: 8,
+			LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+				loggedEntry = logEntry
+				return logEntry
+			},
+		})
+		require.Nil(t, err)
+		handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			readerFrom, isReaderFrom := w.(io.ReaderFrom)
+			require.True(t, isReaderFrom)
+			n, err := readerFrom.ReadFrom(bytes.NewBufferString("{\"description\":\"test description\"}"))
+			require.Nil(t, err)
+			assert.Equal(t, int64(34), n)
+		}))
+		responseRecorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		var responseWriter http.ResponseWriter = responseRecorder
+		if !underlyingIsReaderFrom {
+			responseWriter = responseRecorder.ResponseRecorder
+		}
+
+		request := httptest.NewRequest("GET", "/health", nil)
+		handler.ServeHTTP(responseWriter, request)
+
+		// The underlying ResponseWriter's ReadFrom should be used if it has one, whilst the logged body is still truncated
+		assert.Equal(t, underlyingIsReaderFrom, responseRecorder.readFromCalled)
+		assert.Equal(t, 200, responseRecorder.Code)
+		assert.Equal(t, "{\"description\":\"test description\"}", responseRecorder.Body.String())
+		assert.Equal(t, "{\"descri", loggedEntry.Response.Body)
+		assert.Equal(t, int64(200), loggedEntry.Response.StatusCode)
+	}
+}
+
+func TestResponseWriterUnwraps(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unwrapper, isUnwrapper := w.(interface{ Unwrap() http.ResponseWriter })
+		require.True(t, isUnwrapper)
+		assert.Equal(t, responseRecorder, unwrapper.Unwrap())
+
+		pusher, isPusher := w.(http.Pusher)
+		require.True(t, isPusher)
+		assert.Equal(t, http.ErrNotSupported, pusher.Push("/style.css", nil))
+	}))
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	loggedEntries := make(chan logging.LogEntry, 1)
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		EnableRequestValidation:  true,
+		EnableResponseValidation: true,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntries <- logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+
+	// A handler which completes the handshake, echoes one line back to the client & then closes the connection
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, isHijacker := w.(http.Hijacker)
+		require.True(t, isHijacker)
+		conn, brw, err := hijacker.Hijack()
+		require.Nil(t, err)
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		require.Nil(t, brw.Flush())
+
+		line, err := brw.ReadString('\n')
+		require.Nil(t, err)
+		brw.WriteString(line)
+		require.Nil(t, brw.Flush())
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /websocket HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	require.Nil(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 101, response.StatusCode)
+
+	_, err = conn.Write([]byte("ping\n"))
+	require.Nil(t, err)
+	echo, err := reader.ReadString('\n')
+	require.Nil(t, err)
+	assert.Equal(t, "ping\n", echo)
+
+	// The log entry should only be enqueued once the handler has closed the connection
+	select {
+	case loggedEntry := <-loggedEntries:
+		assert.Equal(t, int64(101), loggedEntry.Response.StatusCode)
+		assert.Equal(t, "/websocket", loggedEntry.Request.Resource)
+		require.NotNil(t, loggedEntry.Upgrade)
+		assert.Equal(t, "websocket", loggedEntry.Upgrade.Protocol)
+		assert.Equal(t, int64(len("ping\n")), loggedEntry.Upgrade.BytesReceived)
+		assert.Equal(t, int64(len("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nping\n")), loggedEntry.Upgrade.BytesSent)
+	case <-time.After(time.Second):
+		t.Fatal("the upgraded connection was never logged")
+	}
+}
+
+func TestOpenUpgradedConnectionIsLoggedOnClose(t *testing.T) {
+	loggedEntries := make(chan logging.LogEntry, 1)
+	middleware, err := NewMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntries <- logEntry
+			return logEntry
+		},
+		LogBatchCallback: func(batch [][]byte, metadata logging.BatchMetadata) error { return nil },
+	})
+	require.Nil(t, err)
+
+	// A handler which completes the handshake but never closes the connection itself
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		require.Nil(t, err)
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		require.Nil(t, brw.Flush())
+		go func() {
+			<-handlerDone
+			conn.Close()
+		}()
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /websocket HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	require.Nil(t, err)
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(t, err)
+	assert.Equal(t, 101, response.StatusCode)
+	assert.Equal(t, 0, len(loggedEntries))
+
+	// Closing the middleware should log the connection as it is, rather than waiting for it to be closed
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(loggedEntries))
+	loggedEntry := <-loggedEntries
+	require.NotNil(t, loggedEntry.Upgrade)
+	assert.True(t, loggedEntry.Upgrade.Open)
+	assert.Equal(t, "websocket", loggedEntry.Upgrade.Protocol)
+	assert.Equal(t, int64(1), middleware.logger.Stats().SentEntries)
+
+	// Requests which finish after the middleware has been closed should be counted as dropped
+	middleware.Handler(healthHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	<-loggedEntries
+	assert.Equal(t, int64(1), middleware.logger.Stats().DroppedClosed)
+}
+
+func TestHijackNotSupported(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, isHijacker := w.(http.Hijacker)
+		require.True(t, isHijacker)
+		_, _, err := hijacker.Hijack()
+		assert.Equal(t, http.ErrNotSupported, err)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/websocket", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+}
+
+func TestEventStreamIsFlushedPerEvent(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		// An incomplete event shouldn't be sent until it's finished
+		w.Write([]byte("data: first"))
+		assert.Equal(t, "", responseRecorder.Body.String())
+		w.Write([]byte(" event\n\n"))
+		assert.True(t, responseRecorder.Flushed)
+		assert.Equal(t, "data: first event\n\n", responseRecorder.Body.String())
+
+		// Comments don't count as events
+		w.Write([]byte(": keep-alive\n\ndata: second event\n\n"))
+		assert.Equal(t, "data: first event\n\n: keep-alive\n\ndata: second event\n\n", responseRecorder.Body.String())
+	}))
+
+	request := httptest.NewRequest("GET", "/events", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "data: first event\n\n: keep-alive\n\ndata: second event\n\n", loggedEntry.Response.Body)
+	require.NotNil(t, loggedEntry.EventStream)
+	assert.Equal(t, int64(2), loggedEntry.EventStream.EventCount)
+	assert.False(t, loggedEntry.EventStream.Truncated)
+}
+
+func TestEventStreamEventsAreValidated(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:           "./test-spec.yaml",
+		EnableResponseValidation:  true,
+		MaxLoggedResponseBodySize: 16,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+
+		// The headers should have been sent, even though response validation is enabled
+		assert.True(t, responseRecorder.Flushed)
+		assert.Equal(t, "text/event-stream", responseRecorder.Header().Get("Content-Type"))
+
+		_, err := w.Write([]byte("data: {\"description\":\"test description\"}\n\n"))
+		assert.Nil(t, err)
+
+		_, err = w.Write([]byte("data: {\"description\":\"another test description\"}\n\n"))
+		assert.IsType(t, ErrorResponseBodyInvalid{}, err)
+
+		// Once an event has failed to validate, nothing else can be written
+		_, err = w.Write([]byte("data: {\"description\":\"test description\"}\n\n"))
+		assert.IsType(t, ErrorResponseBodyInvalid{}, err)
+	}))
+
+	request := httptest.NewRequest("GET", "/events", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "data: {\"description\":\"test description\"}\n\n", responseRecorder.Body.String())
+	assert.Equal(t, "data: {\"descript", loggedEntry.Response.Body)
+	require.NotNil(t, loggedEntry.EventStream)
+	assert.Equal(t, int64(1), loggedEntry.EventStream.EventCount)
+	assert.True(t, loggedEntry.EventStream.Truncated)
+	require.NotNil(t, loggedEntry.Validation)
+	assert.False(t, loggedEntry.Validation.Passed)
+	assert.Contains(t, loggedEntry.Validation.Error, "the response's body did not match your appspec")
+}
+
+func TestMiddlewareClose(t *testing.T) {
+	middleware, err := NewMiddleware(&Options{})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Flush(ctx))
+	require.Nil(t, middleware.Close(ctx))
+
+	// Requests should still be served after the middleware is closed, but their log entries are dropped
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 200, responseRecorder.Code)
+
+	err = middleware.Close(ctx)
+	require.IsType(t, logging.ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, int64(1), err.(logging.ErrorLogEntriesDropped).Dropped)
+}
+
+func TestLogBatchCallbackIsUsed(t *testing.T) {
+	batchChannel := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		LogBatchCallback: func(batch [][]byte, metadata logging.BatchMetadata) error {
+			batchChannel <- batch
+			return nil
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Close(ctx))
+
+	require.Equal(t, 1, len(batchChannel))
+	batch := <-batchChannel
+	require.Equal(t, 1, len(batch))
+	logEntry, err := logging.UnmarshalLogEntry(batch[0])
+	require.Nil(t, err)
+	assert.Equal(t, int64(200), logEntry.Response.StatusCode)
+	assert.Equal(t, "{\"description\":\"test description\"}", logEntry.Response.Body)
+}
+
+func TestLogSpoolIsUsed(t *testing.T) {
+	spoolOptions := &logging.SpoolOptions{Directory: t.TempDir()}
+	middleware, err := NewMiddleware(&Options{
+		LogSpoolOptions:    spoolOptions,
+		LogSpoolAllBatches: true,
+		LogBatchCallback: func(batch [][]byte, metadata logging.BatchMetadata) error {
+			return errors.New("test error")
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	// The batch can't be sent, so Close should time out waiting for the spool to be replayed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = middleware.Close(ctx)
+	require.IsType(t, logging.ErrorLogEntriesDropped{}, err)
+	assert.Equal(t, context.DeadlineExceeded, err.(logging.ErrorLogEntriesDropped).Err)
+
+	// The log entry should have been left in the spool
+	spool, err := logging.NewSpool(*spoolOptions)
+	require.Nil(t, err)
+	batchChannel := make(chan [][]byte, 1)
+	batchLogger := logging.NewBatchLogger(logging.BatchLoggerOptions{
+		MaxBatchSize:    1024 * 512,
+		MaxLogAge:       time.Minute,
+		Spool:           spool,
+		SpoolAllBatches: true,
+		BatchCallback: func(batch [][]byte, metadata logging.BatchMetadata) error {
+			batchChannel <- batch
+			return nil
+		},
+	})
+	require.Nil(t, batchLogger.Close(context.Background()))
+	require.Equal(t, 1, len(batchChannel))
+}
+
+func TestInvalidLogSpoolDirectory(t *testing.T) {
+	notADirectory := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, os.WriteFile(notADirectory, []byte{}, 0600))
+	_, err := NewMiddleware(&Options{
+		LogSpoolOptions: &logging.SpoolOptions{Directory: notADirectory},
+	})
+	require.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestLogsApiTransportIsUsed(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	middleware, err := NewMiddleware(&Options{
+		LogsApiToken:   "test-api-key",
+		LogsApiHeaders: http.Header{"X-Test-Header": []string{"test-value"}},
+		LogsApiTransport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			requests <- r
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"message":"success"}`)),
+			}, nil
+		}),
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Close(ctx))
+
+	require.Equal(t, 1, len(requests))
+	request := <-requests
+	assert.Equal(t, "test-api-key", request.Header.Get("x-ft-api-key"))
+	assert.Equal(t, "test-value", request.Header.Get("X-Test-Header"))
+}
+
+func TestLogSinkIsUsed(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	middleware, err := NewMiddleware(&Options{
+		LogSink: logging.NewFanOutSink(logging.FanOutOutput{Sink: logging.NewWriterSink(buffer)}),
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Close(ctx))
+
+	logEntry, err := logging.UnmarshalLogEntry(bytes.TrimSuffix(buffer.Bytes(), []byte{'\n'}))
+	require.Nil(t, err)
+	assert.Equal(t, int64(200), logEntry.Response.StatusCode)
+}
+
+func TestClientIPIsLogged(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.RemoteAddr = "[2001:db8::1]:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal(t, "2001:db8::1", loggedEntry.Request.IP)
+
+	request = httptest.NewRequest("GET", "/health", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal(t, "198.51.100.1", loggedEntry.Request.IP)
+}
+
+func TestCustomClientIPResolver(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		TrustedProxies:   []string{"not an IP address"},
+		ClientIPResolver: func(r *http.Request) string { return r.Header.Get("CF-Connecting-IP") },
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Set("CF-Connecting-IP", "198.51.100.1")
+	middleware(healthHandler).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal(t, "198.51.100.1", loggedEntry.Request.IP)
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	_, err := GetMiddleware(&Options{TrustedProxies: []string{"10.0.0.0/33"}})
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestAuthCallbackReceivesRequestContext(t *testing.T) {
+	type tenantKey struct{}
+	var authCallbackTenant interface{}
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				authCallbackTenant = ctx.Value(tenantKey{})
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request = request.WithContext(context.WithValue(request.Context(), tenantKey{}, "test-tenant"))
+	middleware(healthHandler).ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "test-tenant", authCallbackTenant)
+}
+
+func TestRequestCancelledDuringRequestValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loggedEntry logging.LogEntry
+	var callbackErr ErrorAtRequest
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				// Simulate the client disconnecting whilst the auth callback is waiting on something
+				cancel()
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+		EnableRequestValidation: true,
+		ErrCallback: func(err ErrorAtRequest, w http.ResponseWriter, r *http.Request) {
+			callbackErr = err
+			w.WriteHeader(err.StatusCode())
+		},
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handlerCalled := false
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	).WithContext(ctx)
+	request.Header.Add("Content-Type", "application/json")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.False(t, handlerCalled)
+	require.IsType(t, ErrorRequestCancelled{}, callbackErr)
+	assert.ErrorIs(t, callbackErr, context.Canceled)
+	assert.Equal(t, 499, responseRecorder.Code)
+	assert.Equal(t, int64(499), loggedEntry.Response.StatusCode)
+	require.NotNil(t, loggedEntry.Validation)
+	assert.False(t, loggedEntry.Validation.Passed)
+	assert.Equal(t, "the request was cancelled during validation: context canceled", loggedEntry.Validation.Error)
+}
+
+func TestRequestDeadlineExceededBeforeValidation(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	authCallbackCalled := false
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				authCallbackCalled = true
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	).WithContext(ctx)
+	request.Header.Add("Content-Type", "application/json")
+	middleware(healthHandler).ServeHTTP(responseRecorder, request)
+
+	assert.False(t, authCallbackCalled)
+	assert.Equal(t, 503, responseRecorder.Code)
+	assert.Equal(t, "{\"code\":503,\"title\":\"the request timed out\"}", responseRecorder.Body.String())
+}
+
+func TestRequestCancelledBeforeResponseValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableResponseValidation: true,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate the client disconnecting whilst the handler is serving the request
+		cancel()
+		healthHandler.ServeHTTP(w, r)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	).WithContext(ctx)
+	request.Header.Add("Content-Type", "application/json")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 499, responseRecorder.Code)
+	assert.NotContains(t, responseRecorder.Body.String(), "test description")
+	require.NotNil(t, loggedEntry.Validation)
+	assert.False(t, loggedEntry.Validation.Passed)
+	assert.Contains(t, loggedEntry.Validation.Error, "context canceled")
+}
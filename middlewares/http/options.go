@@ -1,14 +1,20 @@
 package firetail
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/FireTail-io/firetail-go-lib/logging"
 	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Options is an options struct used when creating a Firetail middleware (GetMiddleware)
+// Options is an options struct used when creating a Firetail middleware (GetMiddleware). The log entry for a hijacked connection, such as a
+// WebSocket, is only passed to the LogEntrySanitiser & enqueued once the connection is closed, or when the Middleware is closed if that
+// happens first, in which case its Upgrade is marked as Open. Log entries enqueued after the Middleware is closed are dropped, & counted in
+// its stats & the firetail_log_entries_dropped_total metric with the reason "closed"
 type Options struct {
 	// SpecPath is the path at which your openapi spec can be found. Supplying an empty string disables any validation.
 	OpenapiSpecPath string
@@ -28,10 +34,60 @@ type Options struct {
 	// example, for us.firetail.app LogsApiUrl should normally be https://api.logging.us-east-2.prod.firetail.app/logs/bulk
 	LogsApiUrl string
 
-	// LogBatchCallback is an optional callback which is provided with a batch of Firetail log entries ready to be sent to Firetail. The
-	// default callback sends log entries to the Firetail logging API. It may be customised to, for example, additionally log the entries
-	// to a file on disk
-	LogBatchCallback func([][]byte)
+	// LogsApiHTTPClient is an optional client used by the default batch callback to send logs to the Firetail logging API. If set,
+	// LogsApiTransport & LogsApiTLSConfig are ignored
+	LogsApiHTTPClient *http.Client
+
+	// LogsApiTransport is an optional RoundTripper used by the default batch callback if LogsApiHTTPClient is unset, for example to route
+	// requests through your egress proxy. If unset, a clone of http.DefaultTransport is used, which respects the HTTPS_PROXY environment variable
+	LogsApiTransport http.RoundTripper
+
+	// LogsApiTLSConfig is an optional TLS config used by the default batch callback's transport if LogsApiHTTPClient & LogsApiTransport are
+	// unset, for example to trust a private CA or to present client certificates for mTLS
+	LogsApiTLSConfig *tls.Config
+
+	// LogsApiTimeout is the maximum time the default batch callback will wait for each request to the Firetail logging API. Defaults to 30s
+	LogsApiTimeout time.Duration
+
+	// LogsApiHeaders are additional headers which the default batch callback will send with every request to the Firetail logging API
+	LogsApiHeaders http.Header
+
+	// LogBatchCallback is an optional callback which is provided with a batch of Firetail log entries ready to be sent to Firetail, along
+	// with metadata describing the batch. The default callback sends log entries to the Firetail logging API. It may be customised to, for
+	// example, additionally log the entries to a file on disk. If it returns an error, the batch will be passed to it again after a backoff,
+	// up to three times in total
+	LogBatchCallback logging.BatchCallback
+
+	// LogSink is an optional logging.Sink to which batches of log entries are written if LogBatchCallback is unset, instead of the Firetail
+	// logging API. For example, a logging.FanOutSink can be used to send log entries to the Firetail logging API with logging.NewFiretailSink
+	// whilst also keeping a local copy in a file with logging.NewFileSink. The Sink is closed when the middleware is closed
+	LogSink logging.Sink
+
+	// LogQueueCapacity is the maximum number of log entries which can be waiting to be batched before the LogQueueOverflowPolicy is applied.
+	// Defaults to 1024
+	LogQueueCapacity int
+
+	// LogQueueOverflowPolicy determines what happens to a request's log entry if the queue of log entries waiting to be batched is full. The
+	// default, logging.DropOldestOnOverflow, never blocks the request. logging.BlockOnOverflow will hold up the request until there is space
+	// in the queue
+	LogQueueOverflowPolicy logging.OverflowPolicy
+
+	// LogCompression is the Content-Encoding the default batch callback uses to compress the batches of log entries it sends to the Firetail
+	// logging API. Defaults to logging.NoCompression
+	LogCompression logging.Compression
+
+	// LogMaxBatchSizeIsCompressed is an optional flag which, if set to true & LogCompression is set, applies the 512KB limit on the size of
+	// each batch of log entries to its size once compressed rather than its raw size, so more log entries can be sent in each request
+	LogMaxBatchSizeIsCompressed bool
+
+	// LogSpoolOptions optionally configures a durable on-disk spool, in which batches of log entries that can't be sent are kept so they can
+	// be replayed once the LogBatchCallback succeeds again, including after your application restarts. If nil, batches which can't be sent
+	// are dropped
+	LogSpoolOptions *logging.SpoolOptions
+
+	// LogSpoolAllBatches is an optional flag which, if set to true, causes every batch of log entries to be written to the spool configured by
+	// LogSpoolOptions before it's sent, rather than only those which can't be sent
+	LogSpoolAllBatches bool
 
 	// ErrCallback is an optional callback func which is given an error and a ResponseWriter to which an apropriate response can be written
 	// for the error. This allows you customise the responses given, when for example a request or response fails to validate against the
@@ -63,6 +119,51 @@ type Options struct {
 	// information, or anonymise identifiable information using a custom implementation of this callback for your application. A default
 	// implementation is provided in the firetail logging package
 	LogEntrySanitiser func(logging.LogEntry) logging.LogEntry
+
+	// LogEntrySanitiserOptions optionally configures the default LogEntrySanitiser, for example to mask more headers or to hash values with
+	// a secret key. They're validated when the middleware is created, which errs with an ErrorInvalidConfiguration if they're invalid. If
+	// LogEntrySanitiser is set, they're ignored. Defaults to logging.DefaultSanitiserOptions()
+	LogEntrySanitiserOptions *logging.SanitiserOptions
+
+	// DisableSpecRedaction is an optional flag which, if set to true, stops the default LogEntrySanitiser from masking the values your
+	// openapi spec marks as sensitive, which are masked in addition to any described by the LogEntrySanitiserOptions. Request & response body properties, headers & query parameters are marked as sensitive if their
+	// schema has format: password or writeOnly: true, or they have the extension x-firetail-sensitive: true, in which case they're replaced
+	// with "[REDACTED]". The extension x-firetail-redact can be set to remove, replace, hash or keep-last-4 to choose how they're masked, or
+	// to false to stop them being masked. If you provide your own LogEntrySanitiser, these values aren't masked
+	DisableSpecRedaction bool
+
+	// MaxLoggedResponseBodySize is the maximum number of bytes of each response body that will be kept in memory to be logged to Firetail.
+	// Responses are streamed through to the client as they are written, so this does not limit the size of the responses your handlers
+	// can write. Responses are only held in memory in their entirety when response validation is enabled for the operation being served.
+	// Defaults to 128KB
+	MaxLoggedResponseBodySize int
+
+	// RequestIDHeader is the header from which each request's ID is read & logged. If a request doesn't have one, an ID is generated & set
+	// on a copy of the request before it's passed to your handler, but isn't added to the logged request headers. Either way, the ID is also
+	// set on the response. Defaults to X-Request-Id
+	RequestIDHeader string
+
+	// RequestIDGenerator is an optional func used to generate the IDs of requests which don't have one. Defaults to generating a random UUID
+	RequestIDGenerator func() string
+
+	// TrustedProxies is a list of the IP addresses & CIDR ranges of the proxies in front of your application, e.g. your load balancers, which
+	// are trusted to report the address of the client they received each request from in the Forwarded, X-Forwarded-For or X-Real-IP header.
+	// Only the first of these headers present in a request is used, so your proxies should be configured to set it. If a request isn't from
+	// a trusted proxy, its RemoteAddr is logged as its IP & the headers are ignored. Defaults to trusting no proxies
+	TrustedProxies []string
+
+	// ClientIPResolver is an optional func used to resolve the IP address of the client that made each request, which is logged. If set,
+	// TrustedProxies is ignored
+	ClientIPResolver func(*http.Request) string
+
+	// MetricsRegisterer is an optional Prometheus registerer, e.g. a *prometheus.Registry, on which the middleware registers collectors
+	// describing the requests it handles, how long validating them takes, the errs they fail with, and the health of its logger. To register
+	// the collectors of several middlewares on the same registry, wrap it for each of them with prometheus.WrapRegistererWith to give each its
+	// own labels. If nil, no metrics are recorded
+	MetricsRegisterer prometheus.Registerer
+
+	// MetricsNamespace is the namespace of the metrics registered on the MetricsRegisterer. Defaults to firetail
+	MetricsNamespace string
 }
 
 func (o *Options) setDefaults() {
@@ -98,7 +199,19 @@ func (o *Options) setDefaults() {
 		}
 	}
 
-	if o.LogEntrySanitiser == nil {
-		o.LogEntrySanitiser = logging.DefaultSanitiser()
+	if o.MaxLoggedResponseBodySize == 0 {
+		o.MaxLoggedResponseBodySize = 1024 * 128
+	}
+
+	if o.RequestIDHeader == "" {
+		o.RequestIDHeader = "X-Request-Id"
+	}
+
+	if o.RequestIDGenerator == nil {
+		o.RequestIDGenerator = generateRequestID
+	}
+
+	if o.MetricsNamespace == "" {
+		o.MetricsNamespace = "firetail"
 	}
 }
@@ -0,0 +1,335 @@
+package firetail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps a http.ResponseWriter, passing the response through to the client as it is written whilst keeping a copy
+// of up to maxLoggedBodySize bytes of the body so it can be logged to Firetail. If the responseWriter is buffered, nothing is passed
+// through to the client until release is called, so that the response can first be validated against the openapi spec, unless the
+// response turns out to be a stream of Server-Sent Events, in which case it is passed straight through to the underlying ResponseWriter
+type responseWriter struct {
+	w                 http.ResponseWriter
+	header            http.Header        // Only used when buffered; otherwise the underlying ResponseWriter's headers are used directly
+	statusCode        int                // The status code given to WriteHeader, or 0 if WriteHeader has not yet been called
+	committed         bool               // Whether the status code & headers have been passed through to the underlying ResponseWriter
+	buffered          bool               // Whether the response should be held in memory until release is called
+	passthrough       bool               // Whether a buffered response turned out to be an event stream & is now passed straight through
+	buffer            bytes.Buffer       // The full response body, only used when buffered
+	loggedBody        bytes.Buffer       // A copy of the response body, truncated at maxLoggedBodySize bytes
+	maxLoggedBodySize int                // The maximum number of bytes of the response body to keep a copy of for logging
+	bytesWritten      int64              // The total number of bytes written to the response body
+	conn              *hijackedConn      // The connection, if it has been hijacked from the underlying ResponseWriter
+	eventStream       *eventStream       // Set once the response is found to be a stream of Server-Sent Events
+	validateEvent     func(string) error // An optional func used to validate the data payload of each Server-Sent Event
+}
+
+// newResponseWriter creates a responseWriter which streams the response through to w, keeping a copy of up to maxLoggedBodySize
+// bytes of the response body for logging
+func newResponseWriter(w http.ResponseWriter, maxLoggedBodySize int) *responseWriter {
+	return &responseWriter{
+		w:                 w,
+		maxLoggedBodySize: maxLoggedBodySize,
+	}
+}
+
+// newBufferedResponseWriter creates a responseWriter which holds the entire response in memory until release is called
+func newBufferedResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{
+		w:        w,
+		header:   http.Header{},
+		buffered: true,
+	}
+}
+
+// Header implements http.ResponseWriter
+func (rw *responseWriter) Header() http.Header {
+	if rw.buffered {
+		return rw.header
+	}
+	return rw.w.Header()
+}
+
+// WriteHeader implements http.ResponseWriter. The status code is not passed through to the underlying ResponseWriter until the first
+// call to Write or Flush, so headers added after WriteHeader is called are still sent to the client
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	// Informational responses (e.g. 103 Early Hints) may be sent any number of times before the final status code
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		if !rw.buffered {
+			rw.w.WriteHeader(statusCode)
+		}
+		return
+	}
+	if rw.statusCode != 0 {
+		return
+	}
+	rw.statusCode = statusCode
+}
+
+// Write implements http.ResponseWriter
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.conn != nil {
+		return 0, http.ErrHijacked
+	}
+
+	if rw.passthrough {
+		return rw.w.Write(b)
+	}
+
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	// A stream of events can't be held in memory until the handler returns, so it has to be passed straight through
+	if rw.buffered && isEventStream(rw.header) {
+		rw.unbuffer()
+		return rw.w.Write(b)
+	}
+
+	if rw.eventStream == nil && !rw.buffered && isEventStream(rw.w.Header()) {
+		rw.eventStream = &eventStream{validateEvent: rw.validateEvent}
+	}
+	if rw.eventStream != nil {
+		return rw.writeEvents(b)
+	}
+
+	return rw.write(b)
+}
+
+// write copies up to maxLoggedBodySize bytes of b for logging, then writes it to the buffer or through to the underlying ResponseWriter
+func (rw *responseWriter) write(b []byte) (int, error) {
+	rw.logBody(b)
+
+	if rw.buffered {
+		n, err := rw.buffer.Write(b)
+		rw.bytesWritten += int64(n)
+		return n, err
+	}
+
+	rw.commit()
+	n, err := rw.w.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// logBody copies as much of b as will fit within maxLoggedBodySize bytes into the copy of the response body kept for logging
+func (rw *responseWriter) logBody(b []byte) {
+	if remaining := rw.maxLoggedBodySize - rw.loggedBody.Len(); remaining > 0 {
+		if remaining > len(b) {
+			remaining = len(b)
+		}
+		rw.loggedBody.Write(b[:remaining])
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, so the underlying ResponseWriter can use its own ReadFrom, e.g. to send a file with sendfile, whilst
+// a copy of up to maxLoggedBodySize bytes of the body is kept for logging. Buffered responses & event streams are copied through Write
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rw.conn != nil {
+		return 0, http.ErrHijacked
+	}
+
+	readerFrom, isReaderFrom := rw.w.(io.ReaderFrom)
+	if rw.passthrough && isReaderFrom {
+		return readerFrom.ReadFrom(src)
+	}
+	if !isReaderFrom || rw.passthrough || rw.buffered || rw.eventStream != nil || isEventStream(rw.w.Header()) {
+		return io.Copy(writerOnly{rw}, src)
+	}
+
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.commit()
+	n, err := readerFrom.ReadFrom(io.TeeReader(src, loggedBodyWriter{rw}))
+	rw.bytesWritten += n
+	return n, err
+}
+
+// writerOnly hides the ReadFrom method of a responseWriter, so that io.Copy uses its Write method instead of calling ReadFrom again
+type writerOnly struct {
+	io.Writer
+}
+
+// loggedBodyWriter is an io.Writer which keeps a copy of up to maxLoggedBodySize bytes of what's written to it for a responseWriter
+type loggedBodyWriter struct {
+	rw *responseWriter
+}
+
+// Write implements io.Writer
+func (w loggedBodyWriter) Write(b []byte) (int, error) {
+	w.rw.logBody(b)
+	return len(b), nil
+}
+
+// writeEvents passes each complete event in b through to the underlying ResponseWriter & flushes it to the client. Any incomplete
+// event is held onto until the rest of it is written. If an event fails to validate, it is not sent & the stream accepts no more writes
+func (rw *responseWriter) writeEvents(b []byte) (int, error) {
+	es := rw.eventStream
+	if es.err != nil {
+		return 0, es.err
+	}
+	es.pending.Write(b)
+	for {
+		event, isComplete := es.nextEvent()
+		if !isComplete {
+			return len(b), nil
+		}
+		if data, hasData := eventData(event); hasData {
+			if es.validateEvent != nil {
+				if err := es.validateEvent(data); err != nil {
+					es.err = ErrorResponseBodyInvalid{err}
+					es.pending.Reset()
+					return 0, es.err
+				}
+			}
+			es.eventCount++
+		}
+		if _, err := rw.write(event); err != nil {
+			return 0, err
+		}
+		rw.Flush()
+	}
+}
+
+// Flush implements http.Flusher. If the responseWriter is buffered, Flush does nothing unless the response is an event stream
+func (rw *responseWriter) Flush() {
+	if rw.conn != nil {
+		return
+	}
+	if rw.buffered {
+		if !isEventStream(rw.header) {
+			return
+		}
+		rw.unbuffer()
+	}
+	if rw.passthrough {
+		if flusher, isFlusher := rw.w.(http.Flusher); isFlusher {
+			flusher.Flush()
+		}
+		return
+	}
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.commit()
+	if flusher, isFlusher := rw.w.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// Push implements http.Pusher, returning http.ErrNotSupported if the underlying ResponseWriter doesn't support server push
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, isPusher := rw.w.(http.Pusher); isPusher {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Hijack implements http.Hijacker, returning http.ErrNotSupported if the underlying ResponseWriter doesn't support hijacking. The
+// returned net.Conn counts the bytes read & written through it so the session can be logged once it's closed
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, isHijacker := rw.w.(http.Hijacker)
+	if !isHijacker {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	// If the response is buffered, the underlying ResponseWriter is itself a responseWriter which will keep track of the connection, so
+	// we just need to pass down any headers & status code the handler has written so far
+	if rw.passthrough {
+		return hijacker.Hijack()
+	}
+	if rw.buffered {
+		for key, vals := range rw.header {
+			for _, val := range vals {
+				rw.w.Header().Add(key, val)
+			}
+		}
+		if rw.statusCode != 0 {
+			rw.w.WriteHeader(rw.statusCode)
+		}
+		return hijacker.Hijack()
+	}
+
+	// Any status code the handler has already written (e.g. 101 Switching Protocols) needs to be sent before the connection is hijacked
+	if rw.statusCode != 0 {
+		rw.commit()
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.conn = newHijackedConn(conn, brw)
+	return rw.conn, rw.conn.readWriter, nil
+}
+
+// Unwrap returns the underlying ResponseWriter so that a http.ResponseController can access its methods
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// StatusCode returns the status code of the response, which defaults to 200 if WriteHeader was never called
+func (rw *responseWriter) StatusCode() int {
+	if rw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rw.statusCode
+}
+
+// LoggedBody returns the copy of the response body kept for logging
+func (rw *responseWriter) LoggedBody() []byte {
+	return rw.loggedBody.Bytes()
+}
+
+// commit passes the status code through to the underlying ResponseWriter if it hasn't been already
+func (rw *responseWriter) commit() {
+	if rw.committed {
+		return
+	}
+	rw.committed = true
+	rw.w.WriteHeader(rw.StatusCode())
+}
+
+// finish passes the status code & headers through to the underlying ResponseWriter if the handler never wrote a body. If the response
+// is an event stream and the handler left an incomplete event at the end of it, it's passed through as-is unless events are validated
+func (rw *responseWriter) finish() {
+	if rw.buffered || rw.conn != nil || rw.statusCode == 0 {
+		return
+	}
+	if es := rw.eventStream; es != nil && es.pending.Len() > 0 && es.validateEvent == nil {
+		rw.write(es.pending.Bytes())
+		es.pending.Reset()
+	}
+	rw.commit()
+}
+
+// unbuffer passes the headers & status code written to a buffered responseWriter so far through to the underlying ResponseWriter, after
+// which all writes are passed straight through to it
+func (rw *responseWriter) unbuffer() {
+	for key, vals := range rw.header {
+		for _, val := range vals {
+			rw.w.Header().Add(key, val)
+		}
+	}
+	if rw.statusCode != 0 {
+		rw.w.WriteHeader(rw.statusCode)
+	}
+	rw.buffered = false
+	rw.passthrough = true
+}
+
+// release writes a buffered response's headers, status code & body to the underlying ResponseWriter
+func (rw *responseWriter) release() {
+	for key, vals := range rw.header {
+		for _, val := range vals {
+			rw.w.Header().Add(key, val)
+		}
+	}
+	rw.w.WriteHeader(rw.StatusCode())
+	rw.w.Write(rw.buffer.Bytes())
+}
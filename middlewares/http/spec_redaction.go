@@ -0,0 +1,252 @@
+package firetail
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// specRedactionRules are the rules for masking the values which an OpenAPI spec marks as sensitive, in the log entries of the requests made
+// to each of its operations
+type specRedactionRules struct {
+	requestBodyRules  []logging.BodyRule
+	responseBodyRules []logging.BodyRule
+	parameterRules    []logging.ParameterRule
+	seen              map[string]bool
+}
+
+// getSpecRedactionRules finds the body properties, headers, query & path parameters marked as sensitive in each of the operations of an OpenAPI
+// spec. Properties & parameters are sensitive if their schema has format: password or writeOnly: true, or if they have the extension
+// x-firetail-sensitive: true. These are replaced with "[REDACTED]". The extension x-firetail-redact can be used to choose a different mask
+// (remove, replace, hash or keep-last-4), or set to false to stop a property or parameter from being masked
+func getSpecRedactionRules(doc *openapi3.T) (*specRedactionRules, error) {
+	rules := &specRedactionRules{seen: map[string]bool{}}
+
+	// The paths & operations are sorted so the rules are always in the same order
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		pathItem := doc.Paths[path]
+		operations := pathItem.Operations()
+		methods := make([]string, 0, len(operations))
+		for method := range operations {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
+		for _, method := range methods {
+			if err := rules.addOperation(path, logging.Method(method), pathItem, operations[method]); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (rules *specRedactionRules) addOperation(resource string, method logging.Method, pathItem *openapi3.PathItem, operation *openapi3.Operation) error {
+	for _, parameters := range []openapi3.Parameters{pathItem.Parameters, operation.Parameters} {
+		for _, parameterRef := range parameters {
+			if parameterRef.Value == nil {
+				continue
+			}
+			var in logging.ParameterLocation
+			switch parameterRef.Value.In {
+			case openapi3.ParameterInHeader:
+				in = logging.RequestHeaderParameter
+			case openapi3.ParameterInQuery:
+				in = logging.QueryParameter
+			case openapi3.ParameterInPath:
+				in = logging.PathParameter
+			default:
+				continue
+			}
+			if err := rules.addParameter(resource, method, in, parameterRef.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if operation.RequestBody != nil && operation.RequestBody.Value != nil {
+		for _, mediaType := range operation.RequestBody.Value.Content {
+			if err := rules.addSchema(false, resource, method, "$", mediaType.Schema, map[*openapi3.Schema]bool{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, responseRef := range operation.Responses {
+		if responseRef.Value == nil {
+			continue
+		}
+		for headerName, headerRef := range responseRef.Value.Headers {
+			if headerRef.Value == nil {
+				continue
+			}
+			// Response headers are named by their key in the headers map rather than their name field
+			header := headerRef.Value.Parameter
+			header.Name = headerName
+			if err := rules.addParameter(resource, method, logging.ResponseHeaderParameter, &header); err != nil {
+				return err
+			}
+		}
+		for _, mediaType := range responseRef.Value.Content {
+			if err := rules.addSchema(true, resource, method, "$", mediaType.Schema, map[*openapi3.Schema]bool{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addParameter adds a rule for a header, query or path parameter if it or its schema is marked as sensitive
+func (rules *specRedactionRules) addParameter(resource string, method logging.Method, in logging.ParameterLocation, parameter *openapi3.Parameter) error {
+	// The parameter's extensions take precedence over its schema's
+	extensions := map[string]interface{}{}
+	if parameter.Schema != nil && parameter.Schema.Value != nil {
+		for name, value := range parameter.Schema.Value.Extensions {
+			extensions[name] = value
+		}
+	}
+	for name, value := range parameter.Extensions {
+		extensions[name] = value
+	}
+	mask, isSensitive, err := getSpecMask(parameter.Schema, extensions)
+	if err != nil || !isSensitive {
+		return err
+	}
+	key := fmt.Sprintf("parameter %d %s %s %s", in, resource, method, parameter.Name)
+	if rules.seen[key] {
+		return nil
+	}
+	rules.seen[key] = true
+	rules.parameterRules = append(rules.parameterRules, logging.ParameterRule{
+		In:       in,
+		Name:     parameter.Name,
+		Mask:     mask,
+		Resource: resource,
+		Method:   method,
+	})
+	return nil
+}
+
+// addSchema adds rules for each of the properties within a schema that are marked as sensitive, selecting them with JSONPaths relative to
+// path. Recursive schemas are only followed until they repeat, so sensitive properties in their deeper levels aren't found
+func (rules *specRedactionRules) addSchema(
+	isResponse bool, resource string, method logging.Method, path string, schemaRef *openapi3.SchemaRef, ancestors map[*openapi3.Schema]bool,
+) error {
+	if schemaRef == nil || schemaRef.Value == nil || ancestors[schemaRef.Value] {
+		return nil
+	}
+	schema := schemaRef.Value
+
+	mask, isSensitive, err := getSpecMask(schemaRef, schema.Extensions)
+	if err != nil {
+		return err
+	}
+	if isSensitive {
+		key := fmt.Sprintf("body %t %s %s %s", isResponse, resource, method, path)
+		if rules.seen[key] {
+			return nil
+		}
+		rules.seen[key] = true
+		bodyRule := logging.BodyRule{Selector: path, Mask: mask, Resource: resource, Method: method}
+		if isResponse {
+			rules.responseBodyRules = append(rules.responseBodyRules, bodyRule)
+		} else {
+			rules.requestBodyRules = append(rules.requestBodyRules, bodyRule)
+		}
+		return nil
+	}
+
+	ancestors[schema] = true
+	defer delete(ancestors, schema)
+
+	propertyNames := make([]string, 0, len(schema.Properties))
+	for propertyName := range schema.Properties {
+		propertyNames = append(propertyNames, propertyName)
+	}
+	sort.Strings(propertyNames)
+	for _, propertyName := range propertyNames {
+		propertyPath := path + "['" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(propertyName) + "']"
+		if err := rules.addSchema(isResponse, resource, method, propertyPath, schema.Properties[propertyName], ancestors); err != nil {
+			return err
+		}
+	}
+	if err := rules.addSchema(isResponse, resource, method, path+".*", schema.AdditionalProperties, ancestors); err != nil {
+		return err
+	}
+	if err := rules.addSchema(isResponse, resource, method, path+"[*]", schema.Items, ancestors); err != nil {
+		return err
+	}
+	for _, schemaRefs := range []openapi3.SchemaRefs{schema.AllOf, schema.AnyOf, schema.OneOf} {
+		for _, subSchemaRef := range schemaRefs {
+			if err := rules.addSchema(isResponse, resource, method, path, subSchemaRef, ancestors); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getSpecMask returns the mask that should be applied to the values of a schema, or a parameter with that schema, given the extensions of
+// the schema or parameter, or false if they aren't sensitive
+func getSpecMask(schemaRef *openapi3.SchemaRef, extensions map[string]interface{}) (logging.BodyMask, bool, error) {
+	var redact interface{}
+	if err := getSpecExtension(extensions, "x-firetail-redact", &redact); err != nil {
+		return 0, false, err
+	}
+	switch redact := redact.(type) {
+	case bool:
+		return logging.ReplaceBodyValue, redact, nil
+	case string:
+		mask, isMask := map[string]logging.BodyMask{
+			"remove":      logging.RemoveBodyValue,
+			"replace":     logging.ReplaceBodyValue,
+			"hash":        logging.HashBodyValue,
+			"keep-last-4": logging.KeepLastFourOfBodyValue,
+		}[redact]
+		if !isMask {
+			return 0, false, fmt.Errorf("x-firetail-redact must be true, false, remove, replace, hash or keep-last-4, not %q", redact)
+		}
+		return mask, true, nil
+	case nil:
+	default:
+		return 0, false, fmt.Errorf("x-firetail-redact must be a boolean or string")
+	}
+
+	var sensitive bool
+	if err := getSpecExtension(extensions, "x-firetail-sensitive", &sensitive); err != nil {
+		return 0, false, err
+	}
+	if schemaRef != nil && schemaRef.Value != nil {
+		sensitive = sensitive || schemaRef.Value.Format == "password" || schemaRef.Value.WriteOnly
+	}
+	return logging.ReplaceBodyValue, sensitive, nil
+}
+
+// getSpecExtension unmarshals the value of an extension, if it's present, into value
+func getSpecExtension(extensions map[string]interface{}, name string, value interface{}) error {
+	extension, hasExtension := extensions[name]
+	if !hasExtension {
+		return nil
+	}
+	rawExtension, isRaw := extension.(json.RawMessage)
+	if !isRaw {
+		var err error
+		if rawExtension, err = json.Marshal(extension); err != nil {
+			return fmt.Errorf("%s is invalid: %w", name, err)
+		}
+	}
+	if err := json.Unmarshal(rawExtension, value); err != nil {
+		return fmt.Errorf("%s is invalid: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package firetail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRedactionSpec = `
+openapi: 3.0.1
+info:
+  title: Test spec
+  version: 1.0.0
+paths:
+  /reset/{token}:
+    get:
+      parameters:
+        - name: token
+          in: path
+          required: true
+          x-firetail-redact: hash
+          schema:
+            type: string
+      responses:
+        "204":
+          description: Reset
+  /users/{id}:
+    parameters:
+      - name: X-Session
+        in: header
+        x-firetail-sensitive: true
+        schema:
+          type: string
+    post:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: string
+        - name: token
+          in: query
+          schema:
+            type: string
+            format: password
+        - name: sig
+          in: query
+          x-firetail-redact: hash
+          schema:
+            type: string
+        - name: page
+          in: query
+          schema:
+            type: string
+      requestBody:
+        content:
+          application/json:
+            schema:
+              type: object
+              properties:
+                username:
+                  type: string
+                password:
+                  type: string
+                  format: password
+                pin:
+                  type: string
+                  writeOnly: true
+                  x-firetail-redact: false
+                card:
+                  type: object
+                  properties:
+                    number:
+                      type: string
+                      x-firetail-redact: keep-last-4
+                recoveryCodes:
+                  type: array
+                  items:
+                    type: string
+                    writeOnly: true
+                "it's":
+                  type: string
+                  x-firetail-redact: remove
+                settings:
+                  allOf:
+                    - type: object
+                      properties:
+                        apiKey:
+                          type: string
+                          x-firetail-sensitive: true
+      responses:
+        "200":
+          description: The user
+          headers:
+            X-Token:
+              schema:
+                type: string
+                format: password
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Node"
+components:
+  schemas:
+    Node:
+      type: object
+      properties:
+        name:
+          type: string
+        secret:
+          type: string
+          format: password
+        children:
+          type: array
+          items:
+            $ref: "#/components/schemas/Node"
+`
+
+func TestGetSpecRedactionRules(t *testing.T) {
+	doc, err := openapi3.NewLoader().LoadFromData([]byte(testRedactionSpec))
+	require.Nil(t, err)
+	rules, err := getSpecRedactionRules(doc)
+	require.Nil(t, err)
+
+	assert.ElementsMatch(t, []logging.BodyRule{
+		{Selector: "$['password']", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{Selector: "$['card']['number']", Mask: logging.KeepLastFourOfBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{Selector: "$['recoveryCodes'][*]", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{Selector: "$['it\\'s']", Mask: logging.RemoveBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{Selector: "$['settings']['apiKey']", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+	}, rules.requestBodyRules)
+
+	// Recursive schemas should only be followed until they repeat
+	assert.ElementsMatch(t, []logging.BodyRule{
+		{Selector: "$['secret']", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+	}, rules.responseBodyRules)
+
+	assert.ElementsMatch(t, []logging.ParameterRule{
+		{In: logging.RequestHeaderParameter, Name: "X-Session", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{In: logging.QueryParameter, Name: "token", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{In: logging.QueryParameter, Name: "sig", Mask: logging.HashBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{In: logging.ResponseHeaderParameter, Name: "X-Token", Mask: logging.ReplaceBodyValue, Resource: "/users/{id}", Method: logging.Post},
+		{In: logging.PathParameter, Name: "token", Mask: logging.HashBodyValue, Resource: "/reset/{token}", Method: logging.Get},
+	}, rules.parameterRules)
+}
+
+func TestInvalidSpecRedactionExtension(t *testing.T) {
+	for _, extension := range []string{"x-firetail-redact: obfuscate", "x-firetail-redact: 1", "x-firetail-sensitive: yes please"} {
+		_, err := NewMiddleware(&Options{
+			OpenapiBytes: []byte(`
+openapi: 3.0.1
+info:
+  title: Test spec
+  version: 1.0.0
+paths:
+  /health:
+    get:
+      parameters:
+        - name: token
+          in: query
+          ` + extension + `
+          schema:
+            type: string
+      responses:
+        "200":
+          description: OK
+`),
+		})
+		assert.IsType(t, ErrorAppspecInvalid{}, err, extension)
+	}
+}
+
+const testRedactionResponseBody = `{"name":"root","secret":"s3cret","children":[]}`
+
+// serveRedactionTestRequest makes a request to a middleware created with the options given & returns the log entry it sends
+func serveRedactionTestRequest(t *testing.T, options *Options, responseBody string) logging.LogEntry {
+	var batch [][]byte
+	options.OpenapiBytes = []byte(testRedactionSpec)
+	options.EnableRequestValidation = true
+	options.LogBatchCallback = func(b [][]byte, metadata logging.BatchMetadata) error {
+		batch = b
+		return nil
+	}
+	middleware, err := NewMiddleware(options)
+	require.Nil(t, err)
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Token", "response-token")
+		w.WriteHeader(200)
+		w.Write([]byte(responseBody))
+	}))
+
+	request := httptest.NewRequest(
+		"POST", "/users/1?page=2&token=reset-token&sig=abc",
+		io.NopCloser(bytes.NewBuffer([]byte(`{"username":"alice","password":"hunter2","pin":"1234","card":{"number":"4111111111111111"},"recoveryCodes":["a","b"],"it's":"gone","settings":{"apiKey":"key"}}`))),
+	)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Session", "session-id")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Len(t, batch, 1)
+	logEntry, err := logging.UnmarshalLogEntry(batch[0])
+	require.Nil(t, err)
+	return logEntry
+}
+
+func TestSpecRedaction(t *testing.T) {
+	logEntry := serveRedactionTestRequest(t, &Options{}, testRedactionResponseBody)
+
+	assert.Equal(t, "http://example.com/users/1?page=2&token=%5BREDACTED%5D&sig=a9993e364706816aba3e25717850c26c9cd0d89d", logEntry.Request.URI)
+	assert.Equal(t, []string{"[REDACTED]"}, logEntry.Request.Headers["X-Session"])
+	assert.Equal(
+		t,
+		`{"card":{"number":"************1111"},"password":"[REDACTED]","pin":"1234","recoveryCodes":["[REDACTED]","[REDACTED]"],"settings":{"apiKey":"[REDACTED]"},"username":"alice"}`,
+		logEntry.Request.Body,
+	)
+	assert.Equal(t, []string{"[REDACTED]"}, logEntry.Response.Headers["X-Token"])
+	assert.Equal(t, `{"children":[],"name":"root","secret":"[REDACTED]"}`, logEntry.Response.Body)
+}
+
+func TestSpecRedactionCanBeDisabled(t *testing.T) {
+	for _, testCase := range []struct {
+		options     *Options
+		expectedURI string
+	}{
+		// The default sanitiser still hashes the token query parameter
+		{&Options{DisableSpecRedaction: true}, "http://example.com/users/1?page=2&token=a373e2bd95d6646c048a6ce5b5e2939eb377f8cc&sig=abc"},
+		{&Options{LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry { return logEntry }}, "http://example.com/users/1?page=2&token=reset-token&sig=abc"},
+	} {
+		logEntry := serveRedactionTestRequest(t, testCase.options, testRedactionResponseBody)
+		assert.Equal(t, testCase.expectedURI, logEntry.Request.URI)
+		assert.Equal(t, []string{"session-id"}, logEntry.Request.Headers["X-Session"])
+		assert.Contains(t, logEntry.Request.Body, `"password":"hunter2"`)
+		assert.Equal(t, `{"name":"root","secret":"s3cret","children":[]}`, logEntry.Response.Body)
+	}
+}
+
+func TestSpecRedactionRemovesTruncatedResponseBodies(t *testing.T) {
+	responseBody := `{"secret":"s3cret","name":"` + strings.Repeat("a", 1024*128) + `","children":[]}`
+	logEntry := serveRedactionTestRequest(t, &Options{}, responseBody)
+
+	assert.Equal(t, `{"card":{"number":"************1111"},"password":"[REDACTED]","pin":"1234","recoveryCodes":["[REDACTED]","[REDACTED]"],"settings":{"apiKey":"[REDACTED]"},"username":"alice"}`, logEntry.Request.Body)
+	assert.Equal(t, "", logEntry.Response.Body)
+}
+
+func TestSpecRedactionExtendsLogEntrySanitiserOptions(t *testing.T) {
+	sanitiserOptions := &logging.SanitiserOptions{
+		RequestHeadersMask: map[string]logging.HeaderMask{"content-type": logging.RemoveHeader},
+		RequestBodyRules:   []logging.BodyRule{{Selector: "/username"}},
+	}
+	logEntry := serveRedactionTestRequest(t, &Options{LogEntrySanitiserOptions: sanitiserOptions}, testRedactionResponseBody)
+
+	assert.NotContains(t, logEntry.Request.Headers, "Content-Type")
+	assert.Equal(
+		t,
+		`{"card":{"number":"************1111"},"password":"[REDACTED]","pin":"1234","recoveryCodes":["[REDACTED]","[REDACTED]"],"settings":{"apiKey":"[REDACTED]"}}`,
+		logEntry.Request.Body,
+	)
+	assert.Equal(t, `{"children":[],"name":"root","secret":"[REDACTED]"}`, logEntry.Response.Body)
+
+	// The spec's rules shouldn't have been added to the options' own
+	assert.Len(t, sanitiserOptions.RequestBodyRules, 1)
+}
@@ -0,0 +1,78 @@
+package firetail
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// traceContext is the W3C trace context propagated with a request in its traceparent & tracestate headers. See
+// https://www.w3.org/TR/trace-context/
+type traceContext struct {
+	traceID    string // The ID of the whole trace, as 32 lowercase hex characters
+	parentID   string // The ID of the caller's span, as 16 lowercase hex characters
+	traceState string // The vendor-specific trace state, which is only used if the traceparent header is valid
+}
+
+// getTraceContext returns the trace context propagated with a request, or false if it doesn't have a valid traceparent header
+func getTraceContext(r *http.Request) (traceContext, bool) {
+	traceparent := r.Header.Values("traceparent")
+	if len(traceparent) != 1 {
+		return traceContext{}, false
+	}
+	traceID, parentID, ok := parseTraceparent(strings.TrimSpace(traceparent[0]))
+	if !ok {
+		return traceContext{}, false
+	}
+	// Multiple tracestate headers are combined as if they were one comma separated list
+	return traceContext{
+		traceID:    traceID,
+		parentID:   parentID,
+		traceState: strings.Join(r.Header.Values("tracestate"), ","),
+	}, true
+}
+
+// parseTraceparent parses the value of a traceparent header, returning its trace ID & parent ID
+func parseTraceparent(value string) (string, string, bool) {
+	// The header is made up of a version, trace ID, parent ID & flags, separated by dashes. Versions after 00 may append more fields,
+	// which we have to ignore
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return "", "", false
+	}
+	version, traceID, parentID, flags := value[0:2], value[3:35], value[36:52], value[53:55]
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return "", "", false
+	}
+	if !isLowerHex(version) || version == "ff" || (version == "00" && len(value) != 55) {
+		return "", "", false
+	}
+	if !isLowerHex(traceID) || traceID == strings.Repeat("0", 32) {
+		return "", "", false
+	}
+	if !isLowerHex(parentID) || parentID == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	if !isLowerHex(flags) {
+		return "", "", false
+	}
+	return traceID, parentID, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// generateRequestID returns a random version 4 UUID
+func generateRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,75 @@
+package firetail
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, testCase := range []struct {
+		value            string
+		expectedTraceID  string
+		expectedParentID string
+		expectedOk       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		// Future versions may have more fields, which should be ignored
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01extra", "", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-600f067aa0ba902b7-01", "", "", false},
+		{"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "", "", false},
+		{"", "", "", false},
+	} {
+		traceID, parentID, ok := parseTraceparent(testCase.value)
+		assert.Equal(t, testCase.expectedTraceID, traceID, testCase.value)
+		assert.Equal(t, testCase.expectedParentID, parentID, testCase.value)
+		assert.Equal(t, testCase.expectedOk, ok, testCase.value)
+	}
+}
+
+func TestGetTraceContext(t *testing.T) {
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Set("traceparent", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ")
+	request.Header.Add("tracestate", "congo=t61rcWkgMzE")
+	request.Header.Add("tracestate", "rojo=00f067aa0ba902b7")
+
+	requestTraceContext, ok := getTraceContext(request)
+	assert.True(t, ok)
+	assert.Equal(t, traceContext{
+		traceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		parentID:   "00f067aa0ba902b7",
+		traceState: "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7",
+	}, requestTraceContext)
+}
+
+func TestGetTraceContextWithMultipleTraceparents(t *testing.T) {
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Add("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Add("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Add("tracestate", "congo=t61rcWkgMzE")
+
+	_, ok := getTraceContext(request)
+	assert.False(t, ok)
+}
+
+func TestGenerateRequestID(t *testing.T) {
+	uuidPattern := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	requestIDs := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		requestID := generateRequestID()
+		assert.Regexp(t, uuidPattern, requestID)
+		requestIDs[requestID] = true
+	}
+	assert.Len(t, requestIDs, 100)
+}
@@ -0,0 +1,89 @@
+package firetail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// describeValidationErr returns a description of an err for the log entry's validation outcome which doesn't include any of the values from
+// the request or response. The errs returned by kin-openapi include the values that failed validation, which may be sensitive & would
+// otherwise bypass the sanitiser, so only the names of the parameters & the locations & schema fields of the values that failed are kept
+func describeValidationErr(err error) string {
+	switch e := err.(type) {
+	case ErrorRequestHeadersInvalid:
+		return "the request's headers did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorRequestQueryParamsInvalid:
+		return "the request's query parameters did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorRequestPathParamsInvalid:
+		return "the request's path parameters did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorRequestBodyInvalid:
+		return "the request's body did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorResponseHeadersInvalid:
+		return "the response's headers did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorResponseBodyInvalid:
+		return "the response's body did not match your appspec" + describeOpenapiErrDetail(e.Err)
+	case ErrorRouteNotFound:
+		// The requested path may contain secrets, which are masked in the log entry's URI but would be exposed here
+		return "a path for the request could not be found in your appspec"
+	case ErrorUnsupportedMethod:
+		return fmt.Sprintf("the path for the request in your appspec does not support the method \"%s\"", e.RequestedMethod)
+	case ErrorAuthNoMatchingScheme:
+		// The errs returned by AuthCallbacks may describe the credentials they were given
+		return "the request did not satisfy the security requirements in your appspec"
+	case ErrorAtRequestUnspecified:
+		if description := describeOpenapiErr(e.Err); description != "" {
+			return description
+		}
+	}
+	return err.Error()
+}
+
+// describeOpenapiErrDetail returns the description of a kin-openapi err prefixed with ": ", or an empty string if it can't be described
+func describeOpenapiErrDetail(err error) string {
+	if description := describeOpenapiErr(err); description != "" {
+		return ": " + description
+	}
+	return ""
+}
+
+// describeOpenapiErr returns a description of an err returned by kin-openapi which doesn't include any of the values that failed validation,
+// or an empty string if it's not a kind of err we know how to describe
+func describeOpenapiErr(err error) string {
+	descriptions := []string{}
+	switch e := err.(type) {
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			descriptions = append(descriptions, fmt.Sprintf("parameter \"%s\" in %s", e.Parameter.Name, e.Parameter.In))
+		} else if e.RequestBody != nil {
+			descriptions = append(descriptions, "request body")
+		}
+		descriptions = append(descriptions, e.Reason, describeOpenapiErr(e.Err))
+	case *openapi3filter.ResponseError:
+		descriptions = append(descriptions, e.Reason, describeOpenapiErr(e.Err))
+	case *openapi3filter.ParseError:
+		descriptions = append(descriptions, e.Reason, describeOpenapiErr(e.Cause))
+	case *openapi3.SchemaError:
+		location := "/" + strings.Join(e.JSONPointer(), "/")
+		if e.SchemaField == "" {
+			return fmt.Sprintf("value at \"%s\" doesn't match the schema", location)
+		}
+		return fmt.Sprintf("value at \"%s\" doesn't match the schema's \"%s\"", location, e.SchemaField)
+	case openapi3.MultiError:
+		for _, err := range e {
+			descriptions = append(descriptions, describeOpenapiErr(err))
+		}
+	default:
+		return ""
+	}
+
+	nonEmptyDescriptions := []string{}
+	for _, description := range descriptions {
+		if description != "" {
+			nonEmptyDescriptions = append(nonEmptyDescriptions, description)
+		}
+	}
+	return strings.Join(nonEmptyDescriptions, ": ")
+}
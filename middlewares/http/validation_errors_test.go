@@ -0,0 +1,112 @@
+package firetail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidRequestBodyValueIsNotLogged(t *testing.T) {
+	var loggedEntry logging.LogEntry
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+		LogEntrySanitiser: func(logEntry logging.LogEntry) logging.LogEntry {
+			loggedEntry = logEntry
+			return logEntry
+		},
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"hunter2\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	middleware(healthHandler).ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 400, responseRecorder.Code)
+	require.NotNil(t, loggedEntry.Validation)
+	assert.False(t, loggedEntry.Validation.Passed)
+	assert.Contains(t, loggedEntry.Validation.Error, "the request's body did not match your appspec")
+	assert.Contains(t, loggedEntry.Validation.Error, "value at \"/description\" doesn't match the schema's \"enum\"")
+	assert.NotContains(t, loggedEntry.Validation.Error, "hunter2")
+}
+
+func TestDescribeValidationErr(t *testing.T) {
+	schemaErr := &openapi3.SchemaError{
+		Value:       "hunter2",
+		SchemaField: "pattern",
+		Reason:      "string \"hunter2\" doesn't match the regular expression",
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name: "RequestBodyInvalid",
+			err: ErrorRequestBodyInvalid{Err: &openapi3filter.RequestError{
+				RequestBody: &openapi3.RequestBody{},
+				Reason:      "doesn't match schema",
+				Err:         schemaErr,
+			}},
+			expected: "the request's body did not match your appspec: request body: doesn't match schema: value at \"/\" doesn't match the schema's \"pattern\"",
+		},
+		{
+			name: "RequestQueryParamsInvalid",
+			err: ErrorRequestQueryParamsInvalid{Err: &openapi3filter.RequestError{
+				Parameter: &openapi3.Parameter{Name: "token", In: "query"},
+				Err:       &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Value: "hunter2", Reason: "an invalid number"},
+			}},
+			expected: "the request's query parameters did not match your appspec: parameter \"token\" in query: an invalid number",
+		},
+		{
+			name: "ResponseBodyInvalid",
+			err: ErrorResponseBodyInvalid{Err: &openapi3filter.ResponseError{
+				Reason: "response body doesn't match schema",
+				Err:    openapi3.MultiError{schemaErr, errors.New("hunter2")},
+			}},
+			expected: "the response's body did not match your appspec: response body doesn't match schema: value at \"/\" doesn't match the schema's \"pattern\"",
+		},
+		{
+			name:     "UnknownErr",
+			err:      ErrorRequestHeadersInvalid{Err: errors.New("hunter2")},
+			expected: "the request's headers did not match your appspec",
+		},
+		{
+			name:     "RouteNotFound",
+			err:      ErrorRouteNotFound{RequestedPath: "/users/hunter2"},
+			expected: "a path for the request could not be found in your appspec",
+		},
+		{
+			name:     "AuthNoMatchingScheme",
+			err:      ErrorAuthNoMatchingScheme{Err: &openapi3filter.SecurityRequirementsError{Errors: []error{errors.New("invalid api key hunter2")}}},
+			expected: "the request did not satisfy the security requirements in your appspec",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			description := describeValidationErr(testCase.err)
+			assert.Equal(t, testCase.expected, description)
+			assert.NotContains(t, description, "hunter2")
+		})
+	}
+}